@@ -0,0 +1,81 @@
+package consensus
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// grinDecimals number of decimal digits of a grin amount
+const grinDecimals = 9
+
+// ErrInvalidAmount is returned when parsing a malformed amount
+var ErrInvalidAmount = errors.New("invalid amount")
+
+// ErrAmountOverflow is returned when parsing an amount above the max
+// representable one
+var ErrAmountOverflow = errors.New("amount overflow")
+
+// FormatAmount formats amount of nanogrins in grins, e.g. "1.234567891"
+func FormatAmount(nanogrins uint64) string {
+	return fmt.Sprintf("%d.%09d", nanogrins/GrinBase, nanogrins%GrinBase)
+}
+
+// ParseAmount parses amount in grins, e.g. "1.234567891", into nanogrins.
+// Digits beyond nanogrin precision are rounded half up.
+func ParseAmount(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+
+	whole, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		whole, frac = s[:i], s[i+1:]
+	}
+
+	if whole == "" && frac == "" || !isDigits(whole) || !isDigits(frac) {
+		return 0, ErrInvalidAmount
+	}
+
+	// round digits beyond nanogrins
+	var roundUp bool
+	if len(frac) > grinDecimals {
+		roundUp = frac[grinDecimals] >= '5'
+		frac = frac[:grinDecimals]
+	}
+	frac += strings.Repeat("0", grinDecimals-len(frac))
+
+	var grins uint64
+	if whole != "" {
+		var err error
+		if grins, err = strconv.ParseUint(whole, 10, 64); err != nil {
+			return 0, ErrAmountOverflow
+		}
+	}
+
+	nanos, err := strconv.ParseUint(frac, 10, 64)
+	if err != nil {
+		return 0, ErrInvalidAmount
+	}
+
+	if roundUp {
+		nanos++
+	}
+
+	if grins > (math.MaxUint64-nanos)/GrinBase {
+		return 0, ErrAmountOverflow
+	}
+
+	return grins*GrinBase + nanos, nil
+}
+
+// isDigits checks s contains only decimal digits
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
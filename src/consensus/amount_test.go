@@ -0,0 +1,60 @@
+package consensus
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFormatAmount(t *testing.T) {
+	tests := []struct {
+		nanogrins uint64
+		s         string
+	}{
+		{0, "0.000000000"},
+		{1, "0.000000001"},
+		{MillGrin, "0.001000000"},
+		{GrinBase - 1, "0.999999999"},
+		{1234567891, "1.234567891"},
+		{math.MaxUint64, "18446744073.709551615"},
+	}
+
+	for _, tt := range tests {
+		if s := FormatAmount(tt.nanogrins); s != tt.s {
+			t.Errorf("%d formatted as %s, want %s", tt.nanogrins, s, tt.s)
+		}
+
+		if n, err := ParseAmount(tt.s); err != nil || n != tt.nanogrins {
+			t.Errorf("%s parsed as %d, %v, want %d", tt.s, n, err, tt.nanogrins)
+		}
+	}
+}
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		s         string
+		nanogrins uint64
+		err       error
+	}{
+		{"1", GrinBase, nil},
+		{".5", GrinBase / 2, nil},
+		{"0.0000000014", 1, nil},
+		{"0.0000000015", 2, nil},
+		{"0.9999999995", GrinBase, nil},
+		{"18446744073.7095516154", math.MaxUint64, nil},
+		{"18446744073.709551616", 0, ErrAmountOverflow},
+		{"18446744073.7095516155", 0, ErrAmountOverflow},
+		{"18446744074", 0, ErrAmountOverflow},
+		{"99999999999999999999", 0, ErrAmountOverflow},
+		{"-1", 0, ErrInvalidAmount},
+		{"", 0, ErrInvalidAmount},
+		{".", 0, ErrInvalidAmount},
+		{"1.2.3", 0, ErrInvalidAmount},
+	}
+
+	for _, tt := range tests {
+		n, err := ParseAmount(tt.s)
+		if err != tt.err || n != tt.nanogrins {
+			t.Errorf("%q parsed as %d, %v, want %d, %v", tt.s, n, err, tt.nanogrins, tt.err)
+		}
+	}
+}
@@ -1,7 +1,381 @@
 package consensus
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/blake2b"
+	"io"
+	"math/bits"
 )
 
-// BlockHash is hash of block (32 byte)
-type BlockHash []byte
\ No newline at end of file
+var (
+	// ErrInvalidBits is returned when a compact difficulty doesn't decode to a valid target
+	ErrInvalidBits = errors.New("invalid compact target")
+	// ErrUnknownBodyVersion is returned when message body version isn't supported
+	ErrUnknownBodyVersion = errors.New("unknown message body version")
+)
+
+// ReadBodyVersion reads leading version byte of message body and checks
+// it's the supported version
+func ReadBodyVersion(r io.Reader, version uint8) error {
+	var v uint8
+	if err := binary.Read(r, binary.BigEndian, &v); err != nil {
+		return err
+	}
+
+	if v != version {
+		return ErrUnknownBodyVersion
+	}
+
+	return nil
+}
+
+// BlockHeader of a block
+type BlockHeader struct {
+	// Version of the block
+	Version uint16
+	// Height of this block since the genesis block (height 0)
+	Height uint64
+	// Hash of the block previous to this in the chain.
+	Previous Hash
+	// Timestamp at which the block was built (unix time in seconds).
+	Timestamp uint64
+	// Merkle root of the UTXO set
+	UTXORoot Hash
+	// Merkle root of all range proofs in the UTXO set
+	RangeProofRoot Hash
+	// Merkle root of all transaction kernels in the UTXO set
+	KernelRoot Hash
+	// Nonce increment used to mine this block.
+	Nonce uint64
+	// Proof of work data.
+	Pow [ProofSize]uint32
+	// Difficulty used to mine the block, in compact "bits" encoding.
+	Bits uint32
+	// Total accumulated difficulty since genesis block
+	TotalDifficulty Difficulty
+}
+
+// Target returns the target the block hash must be lower than, decoded
+// from the compact bits of the header.
+func (h *BlockHeader) Target() ([8]uint8, error) {
+	if err := ValidateCompact(h.Bits); err != nil {
+		return [8]uint8{}, err
+	}
+
+	return TargetFromCompact(h.Bits), nil
+}
+
+// Difficulty returns difficulty the block was mined at, decoded from the
+// compact bits of the header
+func (h *BlockHeader) Difficulty() (Difficulty, error) {
+	target, err := h.Target()
+	if err != nil {
+		return 0, err
+	}
+
+	return Difficulty(binary.BigEndian.Uint64(MAXTarget[:]) / binary.BigEndian.Uint64(target[:])), nil
+}
+
+// Hash returns hash of the serialized header, which is the block hash
+func (h *BlockHeader) Hash() Hash {
+	buff := new(bytes.Buffer)
+
+	// writing to bytes.Buffer never fails
+	h.Write(buff)
+	return blake2b.Sum256(buff.Bytes())
+}
+
+// PreferBlock returns the header of the chain head to prefer: the one with
+// more total difficulty, on equal total difficulty the one with the lower
+// hash so all nodes pick the same head.
+func PreferBlock(a, b *BlockHeader) *BlockHeader {
+	switch {
+	case a.TotalDifficulty > b.TotalDifficulty:
+		return a
+	case a.TotalDifficulty < b.TotalDifficulty:
+		return b
+	}
+
+	ha, hb := a.Hash(), b.Hash()
+	if bytes.Compare(hb[:], ha[:]) < 0 {
+		return b
+	}
+
+	return a
+}
+
+// Write writes header as binary data to writer
+func (h *BlockHeader) Write(w io.Writer) error {
+	if err := h.writePrePow(w); err != nil {
+		return err
+	}
+
+	return binary.Write(w, binary.BigEndian, h.Pow[:])
+}
+
+// PrePowBytes returns header bytes without proof of work, the data the
+// proof of work is computed on
+func (h *BlockHeader) PrePowBytes() []byte {
+	buff := new(bytes.Buffer)
+
+	// writing to bytes.Buffer never fails
+	h.writePrePow(buff)
+	return buff.Bytes()
+}
+
+// writePrePow writes header fields but proof of work to writer
+func (h *BlockHeader) writePrePow(w io.Writer) error {
+	if err := binary.Write(w, binary.BigEndian, h.Version); err != nil {
+		return err
+	}
+
+	if err := binary.Write(w, binary.BigEndian, h.Height); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(h.Previous[:]); err != nil {
+		return err
+	}
+
+	if err := binary.Write(w, binary.BigEndian, h.Timestamp); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(h.UTXORoot[:]); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(h.RangeProofRoot[:]); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(h.KernelRoot[:]); err != nil {
+		return err
+	}
+
+	if err := binary.Write(w, binary.BigEndian, h.Nonce); err != nil {
+		return err
+	}
+
+	if err := binary.Write(w, binary.BigEndian, h.Bits); err != nil {
+		return err
+	}
+
+	return binary.Write(w, binary.BigEndian, uint64(h.TotalDifficulty))
+}
+
+// Read reads header from reader
+func (h *BlockHeader) Read(r io.Reader) error {
+	if err := binary.Read(r, binary.BigEndian, &h.Version); err != nil {
+		return err
+	}
+
+	if err := binary.Read(r, binary.BigEndian, &h.Height); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(r, h.Previous[:]); err != nil {
+		return err
+	}
+
+	if err := binary.Read(r, binary.BigEndian, &h.Timestamp); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(r, h.UTXORoot[:]); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(r, h.RangeProofRoot[:]); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(r, h.KernelRoot[:]); err != nil {
+		return err
+	}
+
+	if err := binary.Read(r, binary.BigEndian, &h.Nonce); err != nil {
+		return err
+	}
+
+	if err := binary.Read(r, binary.BigEndian, &h.Bits); err != nil {
+		return err
+	}
+
+	if err := binary.Read(r, binary.BigEndian, (*uint64)(&h.TotalDifficulty)); err != nil {
+		return err
+	}
+
+	return binary.Read(r, binary.BigEndian, h.Pow[:])
+}
+
+// Block of grin chain
+type Block struct {
+	// The header with metadata and commitments to the rest of the data
+	Header BlockHeader
+	// List of transaction inputs
+	Inputs []Input
+	// List of transaction outputs
+	Outputs []Output
+	// List of transaction kernels and associated proofs
+	Kernels []TxKernel
+}
+
+// Fee returns sum of kernel fees of block, coinbase kernel carries none.
+// False if the sum overflows.
+func (b *Block) Fee() (uint64, bool) {
+	var fee, carry uint64
+	for i := range b.Kernels {
+		fee, carry = bits.Add64(fee, b.Kernels[i].Fee, 0)
+		if carry != 0 {
+			return 0, false
+		}
+	}
+
+	return fee, true
+}
+
+// Write writes block as binary data to writer
+func (b *Block) Write(w io.Writer) error {
+	if err := binary.Write(w, binary.BigEndian, BlockBodyVersion); err != nil {
+		return err
+	}
+
+	if err := b.Header.Write(w); err != nil {
+		return err
+	}
+
+	if err := binary.Write(w, binary.BigEndian, uint64(len(b.Inputs))); err != nil {
+		return err
+	}
+
+	if err := binary.Write(w, binary.BigEndian, uint64(len(b.Outputs))); err != nil {
+		return err
+	}
+
+	if err := binary.Write(w, binary.BigEndian, uint64(len(b.Kernels))); err != nil {
+		return err
+	}
+
+	for i := range b.Inputs {
+		if err := b.Inputs[i].Write(w); err != nil {
+			return err
+		}
+	}
+
+	for i := range b.Outputs {
+		if err := b.Outputs[i].Write(w); err != nil {
+			return err
+		}
+	}
+
+	for i := range b.Kernels {
+		if err := b.Kernels[i].Write(w); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// countingWriter counts bytes written to the underlying writer
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+// Write implements io.Writer interface
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// WriteTo implements io.WriterTo interface, the block is written element
+// by element without materializing its bytes
+func (b *Block) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	err := b.Write(cw)
+	return cw.n, err
+}
+
+// Bytes implements p2p Message interface
+func (b *Block) Bytes() []byte {
+	buff := new(bytes.Buffer)
+
+	// writing to bytes.Buffer never fails
+	b.Write(buff)
+	return buff.Bytes()
+}
+
+// Type implements p2p Message interface
+func (b *Block) Type() uint8 {
+	return MsgTypeBlock
+}
+
+// checkBlockCounts checks declared numbers of block elements fit
+// MaxBlockWeight, before anything is read or allocated for them
+func checkBlockCounts(inputs, outputs, kernels uint64) error {
+	if inputs > MaxBlockInputs {
+		return fmt.Errorf("too many block inputs: %d > %d", inputs, MaxBlockInputs)
+	}
+
+	if outputs > MaxBlockOutputs {
+		return fmt.Errorf("too many block outputs: %d > %d", outputs, MaxBlockOutputs)
+	}
+
+	if kernels > MaxBlockKernels {
+		return fmt.Errorf("too many block kernels: %d > %d", kernels, MaxBlockKernels)
+	}
+
+	// each count is capped above, so the sum doesn't overflow
+	weight := inputs*uint64(BlockInputWeight) + outputs*uint64(BlockOutputWeight) + kernels*uint64(BlockKernelWeight)
+	if weight > uint64(MaxBlockWeight) {
+		return fmt.Errorf("too heavy block: %d > %d", weight, MaxBlockWeight)
+	}
+
+	return nil
+}
+
+// Read implements p2p Message interface
+func (b *Block) Read(r io.Reader) error {
+	if err := ReadBodyVersion(r, BlockBodyVersion); err != nil {
+		return err
+	}
+
+	if err := b.Header.Read(r); err != nil {
+		return err
+	}
+
+	var inputs, outputs, kernels uint64
+	if err := binary.Read(r, binary.BigEndian, &inputs); err != nil {
+		return err
+	}
+
+	if err := binary.Read(r, binary.BigEndian, &outputs); err != nil {
+		return err
+	}
+
+	if err := binary.Read(r, binary.BigEndian, &kernels); err != nil {
+		return err
+	}
+
+	if err := checkBlockCounts(inputs, outputs, kernels); err != nil {
+		return err
+	}
+
+	var err error
+	if b.Inputs, err = readInputs(r, inputs); err != nil {
+		return err
+	}
+
+	if b.Outputs, err = readOutputs(r, outputs); err != nil {
+		return err
+	}
+
+	b.Kernels, err = readKernels(r, kernels)
+	return err
+}
@@ -0,0 +1,150 @@
+package consensus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestHeaderBytesInBlock(t *testing.T) {
+	b := balancedBlock(8, 60)
+	b.Header = BlockHeader{
+		Version:         1,
+		Height:          5,
+		Previous:        Hash{1},
+		Timestamp:       1512086400,
+		UTXORoot:        Hash{2},
+		RangeProofRoot:  Hash{3},
+		KernelRoot:      Hash{4},
+		Nonce:           0x0102030405060708,
+		Bits:            0x08019999,
+		TotalDifficulty: 1000,
+	}
+	for i := range b.Header.Pow {
+		b.Header.Pow[i] = uint32(i + 1)
+	}
+
+	header := new(bytes.Buffer)
+	if err := b.Header.Write(header); err != nil {
+		t.Fatal(err)
+	}
+
+	// block body starts with its version byte followed by the header
+	block := b.Bytes()
+	if !bytes.HasPrefix(block[1:], header.Bytes()) {
+		t.Fatalf("header %x is not embedded in block %x", header.Bytes(), block)
+	}
+
+	var read BlockHeader
+	if err := read.Read(bytes.NewReader(block[1:])); err != nil {
+		t.Fatal(err)
+	}
+
+	if read != b.Header {
+		t.Errorf("header read from block as %+v, want %+v", read, b.Header)
+	}
+}
+
+func TestReadLargeBlockAllocations(t *testing.T) {
+	b := new(Block)
+	for i := 0; i < 20000; i++ {
+		b.Kernels = append(b.Kernels, TxKernel{Fee: uint64(i)})
+	}
+	body := b.Bytes()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	var read Block
+	if err := read.Read(bytes.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+	runtime.ReadMemStats(&after)
+
+	if len(read.Kernels) != len(b.Kernels) {
+		t.Fatalf("read %d kernels, want %d", len(read.Kernels), len(b.Kernels))
+	}
+
+	// allocations stay proportional to the body, decoded kernels and the
+	// growth of their slice take about six times the body size
+	const maxRatio = 8
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > maxRatio*uint64(len(body)) {
+		t.Errorf("reading block of %d bytes allocated %d bytes", len(body), allocated)
+	}
+}
+
+func TestPreferBlock(t *testing.T) {
+	a := &BlockHeader{Height: 5, Nonce: 1, TotalDifficulty: 1000}
+	b := &BlockHeader{Height: 5, Nonce: 2, TotalDifficulty: 1000}
+	ha, hb := a.Hash(), b.Hash()
+	lower, higher := a, b
+	if bytes.Compare(hb[:], ha[:]) < 0 {
+		lower, higher = b, a
+	}
+
+	// equal difficulty picks the lower hash whatever the order
+	if got := PreferBlock(lower, higher); got != lower {
+		t.Error("equal difficulty: preferred block of the higher hash")
+	}
+	if got := PreferBlock(higher, lower); got != lower {
+		t.Error("equal difficulty, swapped: preferred block of the higher hash")
+	}
+	if got := PreferBlock(a, a); got != a {
+		t.Error("same block not preferred to itself")
+	}
+
+	// more difficulty wins over lower hash
+	heavier := *higher
+	heavier.TotalDifficulty++
+	if got := PreferBlock(lower, &heavier); got != &heavier {
+		t.Error("preferred block of less total difficulty")
+	}
+	if got := PreferBlock(&heavier, lower); got != &heavier {
+		t.Error("swapped: preferred block of less total difficulty")
+	}
+}
+
+// blockCounts returns block body declaring the numbers of elements but
+// holding none of them
+func blockCounts(inputs, outputs, kernels uint64) []byte {
+	buff := new(bytes.Buffer)
+	buff.WriteByte(BlockBodyVersion)
+	var header BlockHeader
+	header.Write(buff)
+	for _, n := range []uint64{inputs, outputs, kernels} {
+		binary.Write(buff, binary.BigEndian, n)
+	}
+
+	return buff.Bytes()
+}
+
+func TestBlockCountsRejected(t *testing.T) {
+	tests := []struct {
+		inputs, outputs, kernels uint64
+		err                      string
+	}{
+		{0, 1000000, 0, "too many block outputs"},
+		{1000000, 0, 0, "too many block inputs"},
+		{0, 0, 1000000, "too many block kernels"},
+		{0, MaxBlockOutputs, MaxBlockKernels, "too heavy block"},
+	}
+
+	for _, tt := range tests {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		var b Block
+		err := b.Read(bytes.NewReader(blockCounts(tt.inputs, tt.outputs, tt.kernels)))
+		runtime.ReadMemStats(&after)
+
+		// rejected on the counts, before reading or allocating any element
+		if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+			t.Errorf("block of %d inputs, %d outputs, %d kernels: got %v, want %q",
+				tt.inputs, tt.outputs, tt.kernels, err, tt.err)
+		}
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 64*1024 {
+			t.Errorf("block of %d inputs, %d outputs, %d kernels: %d bytes allocated",
+				tt.inputs, tt.outputs, tt.kernels, allocated)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package consensus
+
+import (
+	"math/bits"
+)
+
+// coinbaseWeight is weight reserved in candidate block for the coinbase
+// output and kernel
+const coinbaseWeight = uint64(BlockOutputWeight + BlockKernelWeight)
+
+// CoinbaseBuilder builds coinbase output and kernel paying reward, it's up
+// to the miner wallet as only the wallet knows the blinding factor
+type CoinbaseBuilder func(reward uint64) (Output, TxKernel, error)
+
+// Weight returns transaction weight counted against MaxBlockWeight
+func (tx *Transaction) Weight() uint64 {
+	return uint64(len(tx.Inputs))*uint64(BlockInputWeight) +
+		uint64(len(tx.Outputs))*uint64(BlockOutputWeight) +
+		uint64(len(tx.Kernels))*uint64(BlockKernelWeight)
+}
+
+// Fee returns sum of kernel fees of transaction, false if it overflows
+func (tx *Transaction) Fee() (uint64, bool) {
+	var fee, carry uint64
+	for i := range tx.Kernels {
+		fee, carry = bits.Add64(fee, tx.Kernels[i].Fee, 0)
+		if carry != 0 {
+			return 0, false
+		}
+	}
+
+	return fee, true
+}
+
+// BuildCandidate builds block on top of prev to be mined at difficulty,
+// timestamped by the real clock. See BuildCandidateWithClock.
+func BuildCandidate(prev *BlockHeader, txs []*Transaction, coinbaseReward uint64, difficulty Difficulty, coinbase CoinbaseBuilder) (*Block, error) {
+	return BuildCandidateWithClock(prev, txs, coinbaseReward, difficulty, coinbase, RealClock)
+}
+
+// BuildCandidateWithClock builds block on top of prev to be mined at
+// difficulty, timestamped by clock. Transactions are taken in order as long
+// as the block stays within MaxBlockWeight, skipping those spending or
+// creating a commitment already in the block and those whose fees would
+// overflow the reward. Coinbase paying coinbaseReward plus fees of the
+// taken transactions is built by coinbase: a valid coinbase output needs
+// its blinding factor and a kernel signed by it, which only the miner
+// wallet holds, so unlike the other fields it can't be derived here.
+// Nonce and proof of work are left for mining.
+func BuildCandidateWithClock(prev *BlockHeader, txs []*Transaction, coinbaseReward uint64, difficulty Difficulty, coinbase CoinbaseBuilder, clock Clock) (*Block, error) {
+	b := new(Block)
+
+	weight := coinbaseWeight
+	reward := coinbaseReward
+	commits := make(map[Commitment]struct{})
+
+	for _, tx := range txs {
+		if weight+tx.Weight() > uint64(MaxBlockWeight) {
+			continue
+		}
+
+		fee, ok := tx.Fee()
+		if !ok {
+			continue
+		}
+
+		total, carry := bits.Add64(reward, fee, 0)
+		if carry != 0 || !addCommits(commits, tx) {
+			continue
+		}
+
+		weight += tx.Weight()
+		reward = total
+
+		b.Inputs = append(b.Inputs, tx.Inputs...)
+		b.Outputs = append(b.Outputs, tx.Outputs...)
+		b.Kernels = append(b.Kernels, tx.Kernels...)
+	}
+
+	output, kernel, err := coinbase(reward)
+	if err != nil {
+		return nil, err
+	}
+
+	b.Outputs = append(b.Outputs, output)
+	b.Kernels = append(b.Kernels, kernel)
+
+	SortInputs(b.Inputs)
+	SortOutputs(b.Outputs)
+	SortKernels(b.Kernels)
+
+	// timestamp must move forward even if local clock lags
+	timestamp := uint64(clock.Now().Unix())
+	if timestamp <= prev.Timestamp {
+		timestamp = prev.Timestamp + 1
+	}
+
+	b.Header = BlockHeader{
+		Version:         prev.Version,
+		Height:          prev.Height + 1,
+		Previous:        prev.Hash(),
+		Timestamp:       timestamp,
+		Bits:            CompactFromTarget(difficulty.Target()),
+		TotalDifficulty: prev.TotalDifficulty + difficulty,
+	}
+
+	return b, nil
+}
+
+// addCommits adds input and output commitments of tx to commits unless one
+// of them is there already
+func addCommits(commits map[Commitment]struct{}, tx *Transaction) bool {
+	for i := range tx.Inputs {
+		if _, ok := commits[tx.Inputs[i].Commit]; ok {
+			return false
+		}
+	}
+
+	for i := range tx.Outputs {
+		if _, ok := commits[tx.Outputs[i].Commit]; ok {
+			return false
+		}
+	}
+
+	for i := range tx.Inputs {
+		commits[tx.Inputs[i].Commit] = struct{}{}
+	}
+
+	for i := range tx.Outputs {
+		commits[tx.Outputs[i].Commit] = struct{}{}
+	}
+
+	return true
+}
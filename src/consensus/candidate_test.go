@@ -0,0 +1,59 @@
+package consensus
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// feeTx returns transaction with outputs outputs and one kernel paying fee,
+// commitments are tagged by id to keep them apart
+func feeTx(id byte, outputs int, fee uint64) *Transaction {
+	tx := &Transaction{Kernels: []TxKernel{{Fee: fee}}}
+	for i := 0; i < outputs; i++ {
+		var out Output
+		out.Commit[0] = id
+		out.Commit[1] = byte(i)
+		out.Commit[2] = byte(i >> 8)
+		tx.Outputs = append(tx.Outputs, out)
+	}
+
+	return tx
+}
+
+func TestBuildCandidate(t *testing.T) {
+	prev := &BlockHeader{Height: 10, Timestamp: 1000}
+	clock := NewMockClock(time.Unix(2000, 0))
+
+	// half of the block weight each, the third one doesn't fit
+	half := int(MaxBlockWeight/BlockOutputWeight) / 2
+	txs := []*Transaction{
+		feeTx(1, half-10, 3),
+		feeTx(2, half-10, 5),
+		feeTx(3, half-10, 7),
+		feeTx(4, 1, math.MaxUint64),
+	}
+
+	var paid uint64
+	coinbase := func(reward uint64) (Output, TxKernel, error) {
+		paid = reward
+		return Output{Features: CoinbaseOutput}, TxKernel{Features: CoinbaseKernel}, nil
+	}
+
+	b, err := BuildCandidateWithClock(prev, txs, 60, Difficulty(100), coinbase, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := 2*(half-10) + 1; len(b.Outputs) != want {
+		t.Errorf("block has %d outputs, want %d", len(b.Outputs), want)
+	}
+
+	if paid != 60+3+5 {
+		t.Errorf("coinbase pays %d, want %d", paid, 60+3+5)
+	}
+
+	if b.Header.Height != 11 || b.Header.Timestamp != 2000 || b.Header.TotalDifficulty != 100 {
+		t.Errorf("unexpected header %+v", b.Header)
+	}
+}
@@ -0,0 +1,60 @@
+package consensus
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells current time, so time based rules can be tested with MockClock
+type Clock interface {
+	// Now returns current time
+	Now() time.Time
+}
+
+// realClock is Clock of the system time
+type realClock struct{}
+
+// Now implements Clock interface
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// RealClock is Clock of the system time
+var RealClock Clock = realClock{}
+
+// MockClock is Clock standing still until it's set or advanced, safe for
+// concurrent use
+type MockClock struct {
+	sync.Mutex
+
+	now time.Time
+}
+
+// NewMockClock creates mock clock set to now
+func NewMockClock(now time.Time) *MockClock {
+	return &MockClock{now: now}
+}
+
+// Now implements Clock interface
+func (c *MockClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.now
+}
+
+// Set sets current time to now
+func (c *MockClock) Set(now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.now = now
+}
+
+// Advance moves current time forward by d
+func (c *MockClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.now = c.now.Add(d)
+}
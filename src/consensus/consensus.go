@@ -1,5 +1,7 @@
 package consensus
 
+import "math/bits"
+
 // MAXTarget The target is the 32-bytes hash block hashes must be lower than.
 var MAXTarget = [8]uint8{0xf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
 
@@ -61,6 +63,15 @@ const (
 	// Total maximum block weight
 	MaxBlockWeight uint32 = 80000
 
+	// Maximum number of inputs of a block made of inputs only
+	MaxBlockInputs uint64 = uint64(MaxBlockWeight / BlockInputWeight)
+
+	// Maximum number of outputs of a block made of outputs only
+	MaxBlockOutputs uint64 = uint64(MaxBlockWeight / BlockOutputWeight)
+
+	// Maximum number of kernels of a block made of kernels only
+	MaxBlockKernels uint64 = uint64(MaxBlockWeight / BlockKernelWeight)
+
 	// Fork every 250,000 blocks for first 2 years, simple number and just a
 	// little less than 6 months.
 	HardForkInterval uint64 = 250000
@@ -82,4 +93,34 @@ const (
 
 	// Minimum size time window used for difficulty adjustments
 	LowerTimeBound uint64 = BlockTimeWindow * 5 / 6
+
+	// Maximum factor difficulty may go up or down by in a single adjustment
+	MaxDifficultyChange uint64 = 4
+
+	// Maximum time in seconds a block timestamp may be ahead of local time
+	MaxFutureDrift uint64 = 12 * BlockTimeSec
 )
+
+const (
+	// CommitmentSize size of a Pedersen commitment
+	CommitmentSize = 33
+
+	// SignatureSize size of a kernel excess signature
+	SignatureSize = 64
+
+	// MaxRangeProofSize maximum size of an output range proof
+	MaxRangeProofSize = 5134
+)
+
+// BlockReward returns the block subsidy at height, currently constant
+func BlockReward(height uint64) uint64 {
+	return Reward
+}
+
+// CoinbaseValue returns value of the coinbase output of block at height
+// collecting txFees: the block subsidy plus the fees. False if the sum
+// overflows.
+func CoinbaseValue(height uint64, txFees uint64) (uint64, bool) {
+	value, carry := bits.Add64(BlockReward(height), txFees, 0)
+	return value, carry == 0
+}
@@ -0,0 +1,289 @@
+package consensus
+
+import (
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/blake2b"
+	"math/bits"
+)
+
+var (
+	// ErrInvalidPow is returned when header proof of work isn't a Cuckoo cycle
+	ErrInvalidPow = errors.New("invalid proof of work cycle")
+	// ErrPowAboveTarget is returned when proof of work hash doesn't meet header target
+	ErrPowAboveTarget = errors.New("proof of work hash above target")
+)
+
+// EdgeCount returns number of edges of the Cuckoo graph for sizeshift
+func EdgeCount(sizeshift uint8) uint64 {
+	return 1 << sizeshift
+}
+
+// EasinessThreshold returns the upper bound (excluded) of the edge nonces
+// eligible for the proof of work: easiness percent of the graph edges.
+func EasinessThreshold(sizeshift uint8, easiness uint32) uint64 {
+	return uint64(easiness) * EdgeCount(sizeshift) / 100
+}
+
+// Cuckoo is the Cuckoo Cycle graph of a block header: each edge nonce maps
+// to an edge between two nodes using siphash keyed by the header hash.
+type Cuckoo struct {
+	v         [4]uint64
+	mask      uint64
+	sizeshift uint8
+}
+
+// NewCuckoo creates Cuckoo graph of header bytes
+func NewCuckoo(header []byte, sizeshift uint8) *Cuckoo {
+	hashed := blake2b.Sum256(header)
+	k0 := binary.LittleEndian.Uint64(hashed[0:8])
+	k1 := binary.LittleEndian.Uint64(hashed[8:16])
+
+	c := new(Cuckoo)
+	c.v[0] = k0 ^ 0x736f6d6570736575
+	c.v[1] = k1 ^ 0x646f72616e646f6d
+	c.v[2] = k0 ^ 0x6c7967656e657261
+	c.v[3] = k1 ^ 0x7465646279746573
+	c.mask = EdgeCount(sizeshift)/2 - 1
+	c.sizeshift = sizeshift
+
+	return c
+}
+
+// siphash24 computes SipHash-2-4 of nonce with keys v
+func siphash24(v [4]uint64, nonce uint64) uint64 {
+	v0, v1, v2, v3 := v[0], v[1], v[2], v[3]^nonce
+
+	round := func() {
+		v0 += v1
+		v2 += v3
+		v1 = bits.RotateLeft64(v1, 13)
+		v3 = bits.RotateLeft64(v3, 16)
+		v1 ^= v0
+		v3 ^= v2
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v1
+		v0 += v3
+		v1 = bits.RotateLeft64(v1, 17)
+		v3 = bits.RotateLeft64(v3, 21)
+		v1 ^= v2
+		v3 ^= v0
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+
+	// 2 rounds
+	round()
+	round()
+
+	v0 ^= nonce
+	v2 ^= 0xff
+
+	// and then 4 rounds, hence siphash 2-4
+	round()
+	round()
+	round()
+	round()
+
+	return v0 ^ v1 ^ v2 ^ v3
+}
+
+// node returns the node of edge on side uorv (0 or 1) of the bipartite graph
+func (c *Cuckoo) node(edge uint64, uorv uint64) uint64 {
+	return (siphash24(c.v, 2*edge+uorv)&c.mask)<<1 | uorv
+}
+
+// Verify checks proof is a cycle of ProofSize edges with increasing nonces
+// below the easiness threshold.
+func (c *Cuckoo) Verify(proof [ProofSize]uint32, easiness uint32) bool {
+	threshold := EasinessThreshold(c.sizeshift, easiness)
+
+	var us, vs [ProofSize]uint64
+	for n := range proof {
+		nonce := uint64(proof[n])
+		if nonce >= threshold || (n != 0 && proof[n] <= proof[n-1]) {
+			return false
+		}
+
+		us[n] = c.node(nonce, 0)
+		vs[n] = c.node(nonce, 1)
+	}
+
+	// follow the cycle alternating edges sharing a v node then an u node
+	i := 0
+	count := len(proof)
+	for {
+		j := i
+		for k := range proof {
+			// find unique other j with same vs[j]
+			if k != i && vs[k] == vs[i] {
+				if j != i {
+					return false
+				}
+				j = k
+			}
+		}
+		if j == i {
+			return false
+		}
+
+		i = j
+		for k := range proof {
+			// find unique other i with same us[i]
+			if k != j && us[k] == us[j] {
+				if i != j {
+					return false
+				}
+				i = k
+			}
+		}
+		if i == j {
+			return false
+		}
+
+		count -= 2
+		if i == 0 {
+			break
+		}
+	}
+
+	return count == 0
+}
+
+// noNode marks a root in the forest built by FindCycle
+const noNode = ^uint64(0)
+
+// FindCycle searches edges below the easiness threshold for a cycle of
+// ProofSize edges, following the simple Cuckoo Cycle miner. It keeps a
+// slot per graph node so it's only practical for small sizeshifts.
+func (c *Cuckoo) FindCycle(easiness uint32) ([ProofSize]uint32, bool) {
+	threshold := EasinessThreshold(c.sizeshift, easiness)
+
+	// forest of the edges added so far, each node points towards its root
+	cuckoo := make([]uint64, EdgeCount(c.sizeshift))
+	for i := range cuckoo {
+		cuckoo[i] = noNode
+	}
+
+	path := func(u uint64) []uint64 {
+		p := []uint64{u}
+		for cuckoo[u] != noNode {
+			u = cuckoo[u]
+			p = append(p, u)
+		}
+		return p
+	}
+
+	for nonce := uint64(0); nonce < threshold; nonce++ {
+		u, v := c.node(nonce, 0), c.node(nonce, 1)
+		pu, pv := path(u), path(v)
+		nu, nv := len(pu)-1, len(pv)-1
+
+		if pu[nu] != pv[nv] {
+			// join the trees, reversing the shorter path so its node
+			// becomes the root
+			if nu < nv {
+				for i := nu; i > 0; i-- {
+					cuckoo[pu[i]] = pu[i-1]
+				}
+				cuckoo[u] = v
+			} else {
+				for i := nv; i > 0; i-- {
+					cuckoo[pv[i]] = pv[i-1]
+				}
+				cuckoo[v] = u
+			}
+			continue
+		}
+
+		// the edge closes a cycle through the node both paths join at
+		for nu > 0 && nv > 0 && pu[nu-1] == pv[nv-1] {
+			nu--
+			nv--
+		}
+
+		if nu+nv+1 == int(ProofSize) {
+			return c.cycleNonces(nonce, pu[:nu+1], pv[:nv+1])
+		}
+	}
+
+	return [ProofSize]uint32{}, false
+}
+
+// cycleNonces returns increasing nonces of the cycle closed by edge nonce
+// between the first nodes of paths pu and pv
+func (c *Cuckoo) cycleNonces(nonce uint64, pu, pv []uint64) ([ProofSize]uint32, bool) {
+	// edges keyed by their u node then v node
+	edges := make(map[[2]uint64]struct{}, ProofSize)
+	edges[[2]uint64{pu[0], pv[0]}] = struct{}{}
+	for _, p := range [][]uint64{pu, pv} {
+		for i := 0; i+1 < len(p); i++ {
+			if p[i]&1 == 0 {
+				edges[[2]uint64{p[i], p[i+1]}] = struct{}{}
+			} else {
+				edges[[2]uint64{p[i+1], p[i]}] = struct{}{}
+			}
+		}
+	}
+
+	var proof [ProofSize]uint32
+	n := 0
+	for e := uint64(0); e <= nonce && n < int(ProofSize); e++ {
+		key := [2]uint64{c.node(e, 0), c.node(e, 1)}
+		if _, ok := edges[key]; ok {
+			delete(edges, key)
+			proof[n] = uint32(e)
+			n++
+		}
+	}
+
+	return proof, n == int(ProofSize)
+}
+
+// VerifyPow checks the header proof of work is a valid Cuckoo cycle
+// under params
+func (h *BlockHeader) VerifyPow(params NetworkParams) bool {
+	return NewCuckoo(h.PrePowBytes(), params.Sizeshift).Verify(h.Pow, params.Easiness)
+}
+
+// PowHash returns hash of the header proof of work cycle, which must be
+// below the header target
+func (h *BlockHeader) PowHash() Hash {
+	var buff [ProofSize * 4]byte
+	for i, nonce := range h.Pow {
+		binary.BigEndian.PutUint32(buff[i*4:], nonce)
+	}
+
+	return blake2b.Sum256(buff[:])
+}
+
+// ValidatePoW checks header proof of work is a valid Cuckoo cycle under
+// params and the cycle hash is below the header target
+func ValidatePoW(header *BlockHeader, params NetworkParams) error {
+	target, err := header.Target()
+	if err != nil {
+		return err
+	}
+
+	if !header.VerifyPow(params) {
+		return ErrInvalidPow
+	}
+
+	hash := header.PowHash()
+	if binary.BigEndian.Uint64(hash[:8]) >= binary.BigEndian.Uint64(target[:]) {
+		return ErrPowAboveTarget
+	}
+
+	return nil
+}
+
+// EstimateHashrate approximates network hashrate in Cuckoo graphs per second
+// from the difficulty blocks are mined at every blockTimeSec seconds. A graph
+// holds a ProofSize-cycle with probability about 1/ProofSize, and each cycle
+// meets difficulty d with probability 1/d.
+func EstimateHashrate(difficulty Difficulty, blockTimeSec uint64) float64 {
+	if blockTimeSec == 0 {
+		return 0
+	}
+
+	return float64(difficulty) * float64(ProofSize) / float64(blockTimeSec)
+}
@@ -0,0 +1,112 @@
+package consensus
+
+import "testing"
+
+func TestEdgeCount(t *testing.T) {
+	tests := []struct {
+		sizeshift uint8
+		edges     uint64
+		// easiness 50 threshold
+		threshold uint64
+	}{
+		{12, 4096, 2048},
+		{30, 1 << 30, 1 << 29},
+	}
+
+	for _, tt := range tests {
+		if n := EdgeCount(tt.sizeshift); n != tt.edges {
+			t.Errorf("shift %d: %d edges, want %d", tt.sizeshift, n, tt.edges)
+		}
+
+		if n := EasinessThreshold(tt.sizeshift, 50); n != tt.threshold {
+			t.Errorf("shift %d: easiness threshold %d, want %d", tt.sizeshift, n, tt.threshold)
+		}
+
+		if n := EasinessThreshold(tt.sizeshift, 100); n != tt.edges {
+			t.Errorf("shift %d: full easiness threshold %d, want all %d edges", tt.sizeshift, n, tt.edges)
+		}
+	}
+}
+
+func TestEstimateHashrate(t *testing.T) {
+	// difficulty 1000 at a block a minute takes 1000*42 graphs a minute
+	if rate := EstimateHashrate(1000, 60); rate != 700 {
+		t.Errorf("hashrate of difficulty 1000 every 60s is %v graphs/s, want 700", rate)
+	}
+
+	if rate := EstimateHashrate(1000, 0); rate != 0 {
+		t.Errorf("hashrate without block time is %v, want 0", rate)
+	}
+
+	prev := EstimateHashrate(1, 60)
+	for _, d := range []Difficulty{2, 10, 1000, 1 << 20, 1 << 40} {
+		rate := EstimateHashrate(d, 60)
+		if rate <= prev {
+			t.Errorf("hashrate of difficulty %d is %v, not above %v of lower difficulty", d, rate, prev)
+		}
+		prev = rate
+	}
+
+	if slow, fast := EstimateHashrate(1000, 120), EstimateHashrate(1000, 60); slow >= fast {
+		t.Errorf("hashrate with slower blocks %v not below %v", slow, fast)
+	}
+}
+
+// powTestParams are network params with Cuckoo graphs small enough to
+// find cycles in tests
+var powTestParams = func() NetworkParams {
+	params := TestnetParams
+	params.Sizeshift = 10
+	params.Easiness = 100
+	return params
+}()
+
+// findCycle sets nonce and proof of work of h to the next Cuckoo cycle,
+// whatever its hash
+func findCycle(t *testing.T, h *BlockHeader, params NetworkParams) {
+	t.Helper()
+	for i := 0; i < 10000; i++ {
+		h.Nonce++
+		proof, ok := NewCuckoo(h.PrePowBytes(), params.Sizeshift).FindCycle(params.Easiness)
+		if ok {
+			h.Pow = proof
+			return
+		}
+	}
+	t.Fatal("no cycle found")
+}
+
+func TestValidatePoW(t *testing.T) {
+	// valid cycle meeting the easiest target
+	valid := BlockHeader{Height: 1, Bits: CompactFromTarget(MAXTarget)}
+	for i := 0; ; i++ {
+		findCycle(t, &valid, powTestParams)
+		err := ValidatePoW(&valid, powTestParams)
+		if err == nil {
+			break
+		}
+		if err != ErrPowAboveTarget || i == 1000 {
+			t.Fatalf("found cycle: %v", err)
+		}
+	}
+
+	invalid := valid
+	invalid.Pow[0], invalid.Pow[1] = invalid.Pow[1], invalid.Pow[0]
+	if err := ValidatePoW(&invalid, powTestParams); err != ErrInvalidPow {
+		t.Errorf("invalid cycle: got %v, want %v", err, ErrInvalidPow)
+	}
+
+	// cycle of another header
+	other := valid
+	other.Nonce++
+	if err := ValidatePoW(&other, powTestParams); err != ErrInvalidPow {
+		t.Errorf("cycle of another header: got %v, want %v", err, ErrInvalidPow)
+	}
+
+	// valid cycle missing the hardest target
+	hard := BlockHeader{Height: 1, Bits: CompactFromTarget([8]uint8{7: 1})}
+	findCycle(t, &hard, powTestParams)
+	if err := ValidatePoW(&hard, powTestParams); err != ErrPowAboveTarget {
+		t.Errorf("cycle above target: got %v, want %v", err, ErrPowAboveTarget)
+	}
+}
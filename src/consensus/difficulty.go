@@ -1,5 +1,12 @@
 package consensus
 
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+	"sort"
+)
+
 // difficulty is defined as the maximum target divided by the block hash.
 type Difficulty uint64
 
@@ -28,4 +35,347 @@ func (d Difficulty) FromHash() Difficulty {
 
 func (d Difficulty) IntoNum() uint64 {
 	return uint64(d)
-}
\ No newline at end of file
+}
+
+// CompactFromTarget encodes target in the compact "bits" format: the highest
+// byte is the number of significant bytes of the target, the 3 lower bytes
+// are the mantissa (Bitcoin-style).
+func CompactFromTarget(target [8]uint8) uint32 {
+	num := binary.BigEndian.Uint64(target[:])
+
+	size := uint32(bits.Len64(num)+7) / 8
+	var mantissa uint64
+	if size <= 3 {
+		mantissa = num << (8 * (3 - size))
+	} else {
+		mantissa = num >> (8 * (size - 3))
+	}
+
+	// the 0x00800000 bit is the sign bit, move to the next exponent
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		size++
+	}
+
+	return size<<24 | uint32(mantissa)
+}
+
+// TargetFromCompact decodes compact "bits" into the target. Use
+// ValidateCompact to check bits before decoding untrusted values.
+func TargetFromCompact(compact uint32) [8]uint8 {
+	size := compact >> 24
+	mantissa := uint64(compact & 0x007fffff)
+
+	var num uint64
+	switch {
+	case size <= 3:
+		num = mantissa >> (8 * (3 - size))
+	case size <= 8:
+		num = mantissa << (8 * (size - 3))
+	}
+
+	var target [8]uint8
+	binary.BigEndian.PutUint64(target[:], num)
+	return target
+}
+
+// ValidateCompact checks compact "bits" decode to a non zero target
+// at or below MAXTarget.
+func ValidateCompact(compact uint32) error {
+	size := compact >> 24
+	mantissa := uint64(compact & 0x007fffff)
+
+	// negative or zero
+	if compact&0x00800000 != 0 || mantissa == 0 {
+		return ErrInvalidBits
+	}
+
+	// overflow of 64 bits target
+	if size > 8 || (size > 3 && bits.Len64(mantissa)+int(8*(size-3)) > 64) {
+		return ErrInvalidBits
+	}
+
+	target := TargetFromCompact(compact)
+	if binary.BigEndian.Uint64(target[:]) == 0 ||
+		binary.BigEndian.Uint64(target[:]) > binary.BigEndian.Uint64(MAXTarget[:]) {
+		return ErrInvalidBits
+	}
+
+	return nil
+}
+
+// DifficultyData is timestamp and difficulty of a block used for
+// difficulty adjustment
+type DifficultyData struct {
+	// Timestamp of the block (unix time in seconds)
+	Timestamp uint64
+	// Difficulty of the block
+	Difficulty Difficulty
+}
+
+// NextDifficulty computes the proof-of-work difficulty that the next block
+// should comply with under default network parameters. Takes the history of
+// blocks ordered from the oldest to the most recent one.
+//
+// The difficulty calculation is based on both Digishield and GravityWave
+// family of difficulty computation, coming to something very close to Zcash.
+// The reference difficulty is an average of the difficulty over a window of
+// DifficultyAdjustWindow blocks. The corresponding timespan is calculated by
+// using the difference between the median timestamps at the beginning and
+// the end of the window.
+func NextDifficulty(history []DifficultyData) Difficulty {
+	return DefaultNetwork().NextDifficulty(history)
+}
+
+// NextDifficulty computes the proof-of-work difficulty that the next block
+// should comply with under network parameters p, see NextDifficulty.
+func (p NetworkParams) NextDifficulty(history []DifficultyData) Difficulty {
+	// Block times at the beginning and end of the adjustment window, used to
+	// calculate medians later.
+	var windowBegin, windowEnd []uint64
+	// Sum of difficulties in the window, used to calculate the average later.
+	var diffSum uint128
+
+	// Enumerating backward over blocks
+	for m := uint64(0); m < uint64(len(history)); m++ {
+		data := history[uint64(len(history))-1-m]
+
+		if m < p.DifficultyAdjustWindow {
+			diffSum = diffSum.add(uint64(data.Difficulty))
+			if m < p.MedianTimeWindow {
+				windowBegin = append(windowBegin, data.Timestamp)
+			}
+		} else if m < p.DifficultyAdjustWindow+p.MedianTimeWindow {
+			windowEnd = append(windowEnd, data.Timestamp)
+		} else {
+			break
+		}
+	}
+
+	// Check we have enough blocks
+	if uint64(len(windowEnd)) < p.MedianTimeWindow {
+		return Difficulty(p.MinimumDifficulty)
+	}
+
+	return p.adjustDifficulty(diffSum, median(windowBegin), median(windowEnd))
+}
+
+// median returns median of timestamps, sorts ts in place
+func median(ts []uint64) uint64 {
+	sort.Slice(ts, func(i, j int) bool { return ts[i] < ts[j] })
+	return ts[len(ts)/2]
+}
+
+// uint128 is unsigned 128 bits integer, sum of difficulties over a window
+// may not fit in 64 bits
+type uint128 struct {
+	hi, lo uint64
+}
+
+// add returns a + b
+func (a uint128) add(b uint64) uint128 {
+	lo, carry := bits.Add64(a.lo, b, 0)
+	return uint128{hi: a.hi + carry, lo: lo}
+}
+
+// sub returns a - b
+func (a uint128) sub(b uint64) uint128 {
+	lo, borrow := bits.Sub64(a.lo, b, 0)
+	return uint128{hi: a.hi - borrow, lo: lo}
+}
+
+// mulDiv returns a * b / c computed with 192 bits intermediate product so
+// it doesn't overflow, saturating at max uint64 if the quotient does
+func mulDiv(a uint128, b, c uint64) uint64 {
+	h1, lo := bits.Mul64(a.lo, b)
+	h2, l2 := bits.Mul64(a.hi, b)
+	mid, carry := bits.Add64(l2, h1, 0)
+	top := h2 + carry
+
+	// long division by 64 bits limbs, the quotient fits in the lowest one
+	if top >= c {
+		return math.MaxUint64
+	}
+
+	quo, rem := bits.Div64(top, mid, c)
+	if quo != 0 {
+		return math.MaxUint64
+	}
+
+	quo, _ = bits.Div64(rem, lo, c)
+	return quo
+}
+
+// adjustDifficulty computes next difficulty from the sum of difficulties over
+// the adjustment window and median timestamps at both ends of the window
+func (p NetworkParams) adjustDifficulty(diffSum uint128, beginTs, endTs uint64) Difficulty {
+	var timespan uint64
+	if beginTs > endTs {
+		timespan = beginTs - endTs
+	}
+
+	// Dampened average time
+	tsDamp := (3*p.BlockTimeWindow() + timespan) / 4
+
+	// Apply time bounds
+	adjTs := tsDamp
+	if adjTs < p.LowerTimeBound {
+		adjTs = p.LowerTimeBound
+	} else if adjTs > p.UpperTimeBound {
+		adjTs = p.UpperTimeBound
+	}
+
+	next := mulDiv(diffSum, p.BlockTimeWindow(), p.DifficultyAdjustWindow*adjTs)
+
+	// Limit change against the average difficulty of the window
+	if p.MaxDifficultyChange > 0 {
+		avg := mulDiv(diffSum, 1, p.DifficultyAdjustWindow)
+		if upper := mulDiv(uint128{lo: avg}, p.MaxDifficultyChange, 1); next > upper {
+			next = upper
+		} else if next < avg/p.MaxDifficultyChange {
+			next = avg / p.MaxDifficultyChange
+		}
+	}
+
+	if next < p.MinimumDifficulty {
+		return Difficulty(p.MinimumDifficulty)
+	}
+
+	return Difficulty(next)
+}
+
+// DifficultyWindow keeps the latest blocks needed for difficulty adjustment
+// in a ring buffer and maintains the running sum of difficulties, so next
+// difficulty is updated in constant time on each new block. It holds
+// DifficultyAdjustWindow blocks plus MedianTimeWindow older ones for the
+// median timestamp at the end of the window, sized by network parameters.
+type DifficultyWindow struct {
+	params NetworkParams
+
+	ring []DifficultyData
+	// position of the next push
+	next uint64
+	// number of pushed blocks, up to ring size
+	count uint64
+	// sum of difficulties of the latest DifficultyAdjustWindow blocks
+	diffSum uint128
+}
+
+// NewDifficultyWindow creates empty difficulty window of network params
+func NewDifficultyWindow(params NetworkParams) *DifficultyWindow {
+	return &DifficultyWindow{
+		params: params,
+		ring:   make([]DifficultyData, params.DifficultyAdjustWindow+params.MedianTimeWindow),
+	}
+}
+
+// clone returns copy of the window
+func (w *DifficultyWindow) clone() *DifficultyWindow {
+	c := *w
+	c.ring = append([]DifficultyData(nil), w.ring...)
+
+	return &c
+}
+
+// at returns m-th block backward from the most recent one
+func (w *DifficultyWindow) at(m uint64) DifficultyData {
+	size := uint64(len(w.ring))
+	return w.ring[(w.next+size-1-m)%size]
+}
+
+// Push adds the most recent block timestamp and difficulty
+func (w *DifficultyWindow) Push(ts uint64, diff Difficulty) {
+	// block leaving the adjustment window
+	if w.count >= w.params.DifficultyAdjustWindow {
+		w.diffSum = w.diffSum.sub(uint64(w.at(w.params.DifficultyAdjustWindow - 1).Difficulty))
+	}
+
+	w.ring[w.next] = DifficultyData{Timestamp: ts, Difficulty: diff}
+	w.next = (w.next + 1) % uint64(len(w.ring))
+	if w.count < uint64(len(w.ring)) {
+		w.count++
+	}
+
+	w.diffSum = w.diffSum.add(uint64(diff))
+}
+
+// full checks whether window holds enough blocks for difficulty adjustment
+func (w *DifficultyWindow) full() bool {
+	return w.count == uint64(len(w.ring))
+}
+
+// medianTime returns median timestamp of the latest MedianTimeWindow
+// blocks, false while fewer blocks were pushed
+func (w *DifficultyWindow) medianTime() (uint64, bool) {
+	if w.count < w.params.MedianTimeWindow {
+		return 0, false
+	}
+
+	ts := make([]uint64, w.params.MedianTimeWindow)
+	for m := range ts {
+		ts[m] = w.at(uint64(m)).Timestamp
+	}
+
+	return median(ts), true
+}
+
+// Next returns difficulty the next block should comply with, same as
+// NextDifficulty of the window network parameters over the pushed blocks
+func (w *DifficultyWindow) Next() Difficulty {
+	if !w.full() {
+		return Difficulty(w.params.MinimumDifficulty)
+	}
+
+	windowBegin := make([]uint64, w.params.MedianTimeWindow)
+	windowEnd := make([]uint64, w.params.MedianTimeWindow)
+	for m := range windowBegin {
+		windowBegin[m] = w.at(uint64(m)).Timestamp
+		windowEnd[m] = w.at(w.params.DifficultyAdjustWindow + uint64(m)).Timestamp
+	}
+
+	return w.params.adjustDifficulty(w.diffSum, median(windowBegin), median(windowEnd))
+}
+
+// Target returns the target block hashes must be lower than to meet the
+// difficulty: MAXTarget divided by the difficulty.
+func (d Difficulty) Target() [8]uint8 {
+	if d == 0 {
+		return MAXTarget
+	}
+
+	var target [8]uint8
+	binary.BigEndian.PutUint64(target[:], binary.BigEndian.Uint64(MAXTarget[:])/uint64(d))
+	return target
+}
+
+// CurrentTarget returns the target the next block must be mined against
+func CurrentTarget(window *DifficultyWindow) [8]uint8 {
+	return window.Next().Target()
+}
+
+// ReorgDifficulty recomputes total difficulty current of the chain when
+// blocks with difficulties disconnected are replaced by the branch connected.
+// The result never drops below total difficulty of the default network
+// genesis, nor wraps above max uint64.
+func ReorgDifficulty(current Difficulty, disconnected []Difficulty, connected []Difficulty) Difficulty {
+	genesis := DefaultNetwork().Genesis.TotalDifficulty
+
+	total := current
+	for _, d := range disconnected {
+		if total < d || total-d < genesis {
+			total = genesis
+			continue
+		}
+		total -= d
+	}
+
+	for _, d := range connected {
+		sum, carry := bits.Add64(uint64(total), uint64(d), 0)
+		if carry != 0 {
+			return math.MaxUint64
+		}
+		total = Difficulty(sum)
+	}
+
+	return total
+}
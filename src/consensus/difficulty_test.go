@@ -0,0 +1,192 @@
+package consensus
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// filledWindow returns difficulty window of blocks at diff mined on time
+func filledWindow(diff Difficulty) *DifficultyWindow {
+	w := NewDifficultyWindow(MainnetParams)
+	for i := uint64(0); i < DifficultyAdjustWindow+MedianTimeWindow; i++ {
+		w.Push(1512086400+i*BlockTimeSec, diff)
+	}
+
+	return w
+}
+
+func TestCurrentTarget(t *testing.T) {
+	low := CurrentTarget(filledWindow(1000))
+	high := CurrentTarget(filledWindow(4000))
+
+	if binary.BigEndian.Uint64(high[:]) >= binary.BigEndian.Uint64(low[:]) {
+		t.Errorf("target %x at higher difficulty is not below %x", high, low)
+	}
+}
+
+// hugeDifficulty makes the window sum of difficulties just above max uint64,
+// so a 64 bits sum wraps around to almost zero
+const hugeDifficulty = Difficulty(math.MaxUint64/DifficultyAdjustWindow + 1)
+
+// hugeDifficultyHistory returns history of blocks at hugeDifficulty spaced
+// by interval seconds
+func hugeDifficultyHistory(interval uint64) []DifficultyData {
+	history := make([]DifficultyData, DifficultyAdjustWindow+MedianTimeWindow)
+	for i := range history {
+		history[i] = DifficultyData{
+			Timestamp:  1e9 + uint64(i)*interval,
+			Difficulty: hugeDifficulty,
+		}
+	}
+
+	return history
+}
+
+func TestNextDifficultyHugeSum(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval uint64
+		min      Difficulty
+	}{
+		// blocks too fast, difficulty goes up
+		{"fast", 1, hugeDifficulty},
+		// blocks too slow, difficulty drops by a bounded factor only
+		{"slow", 1000 * BlockTimeSec, hugeDifficulty / Difficulty(MaxDifficultyChange)},
+	}
+
+	for _, tt := range tests {
+		history := hugeDifficultyHistory(tt.interval)
+
+		if next := NextDifficulty(history); next < tt.min {
+			t.Errorf("%s: NextDifficulty = %d, want at least %d", tt.name, next, tt.min)
+		}
+
+		w := NewDifficultyWindow(MainnetParams)
+		for _, data := range history {
+			w.Push(data.Timestamp, data.Difficulty)
+		}
+
+		if next := w.Next(); next < tt.min {
+			t.Errorf("%s: DifficultyWindow.Next = %d, want at least %d", tt.name, next, tt.min)
+		}
+	}
+}
+
+func TestDifficultyWindowNext(t *testing.T) {
+	w := NewDifficultyWindow(MainnetParams)
+	var history []DifficultyData
+
+	// blocks come faster then slower than the block time, difficulty
+	// follows the adjustment
+	timestamp := uint64(1e9)
+	blocks := 3 * (DifficultyAdjustWindow + MedianTimeWindow)
+	for i := uint64(0); i < blocks; i++ {
+		interval := BlockTimeSec/2 + i%7
+		if i > blocks/2 {
+			interval = 2*BlockTimeSec + i%11
+		}
+		timestamp += interval
+
+		data := DifficultyData{Timestamp: timestamp, Difficulty: NextDifficulty(history)}
+		history = append(history, data)
+		w.Push(data.Timestamp, data.Difficulty)
+
+		if want, got := NextDifficulty(history), w.Next(); got != want {
+			t.Fatalf("block %d: window next difficulty %d, want %d", i, got, want)
+		}
+	}
+}
+
+func TestDifficultyWindowParams(t *testing.T) {
+	params := MainnetParams
+	params.DifficultyAdjustWindow = 10
+	params.MedianTimeWindow = 5
+	params.LowerTimeBound = params.BlockTimeWindow() * 5 / 6
+	params.UpperTimeBound = params.BlockTimeWindow() * 4 / 3
+
+	w := NewDifficultyWindow(params)
+	var history []DifficultyData
+	for i := uint64(0); i < 40; i++ {
+		data := DifficultyData{Timestamp: 1e9 + i*i, Difficulty: Difficulty(1000 + 37*i)}
+		history = append(history, data)
+		w.Push(data.Timestamp, data.Difficulty)
+
+		if want, got := params.NextDifficulty(history), w.Next(); got != want {
+			t.Fatalf("block %d: window next difficulty %d, want %d", i, got, want)
+		}
+	}
+}
+
+func TestReorgDifficultyBounds(t *testing.T) {
+	genesis := DefaultNetwork().Genesis.TotalDifficulty
+
+	if got := ReorgDifficulty(genesis+5, []Difficulty{100}, nil); got != genesis {
+		t.Errorf("reorg below genesis: %d, want %d", got, genesis)
+	}
+
+	if got := ReorgDifficulty(math.MaxUint64-10, []Difficulty{5}, []Difficulty{10, 10}); got != math.MaxUint64 {
+		t.Errorf("reorg above max: %d, want saturated", got)
+	}
+}
+
+func TestCompactRoundTrip(t *testing.T) {
+	targets := [][8]uint8{
+		{0, 0, 0, 0, 0, 0, 0, 1},
+		{0, 0, 0, 0, 0, 0x12, 0x34, 0x56},
+		{0, 0, 0, 0x01, 0x23, 0x45, 0, 0},
+		// mantissa with the sign bit set moves to the next exponent
+		{0, 0, 0, 0, 0, 0x80, 0, 0},
+		MAXTarget,
+		Difficulty(MinimumDifficulty).Target(),
+	}
+
+	for _, target := range targets {
+		bits := CompactFromTarget(target)
+		if err := ValidateCompact(bits); err != nil {
+			t.Errorf("target %x: bits %08x: %v", target, bits, err)
+			continue
+		}
+
+		// compact keeps the 3 most significant bytes of the target
+		decoded := TargetFromCompact(bits)
+		got := binary.BigEndian.Uint64(decoded[:])
+		want := binary.BigEndian.Uint64(target[:])
+		if got > want || want-got > want>>15 {
+			t.Errorf("target %x decoded from bits %08x as %x", target, bits, got)
+		}
+
+		if again := CompactFromTarget(TargetFromCompact(bits)); again != bits {
+			t.Errorf("bits %08x encoded back as %08x", bits, again)
+		}
+	}
+}
+
+func TestMaxDifficultyChange(t *testing.T) {
+	// time bounds far wider than the clamp let the timespan alone drop
+	// difficulty 100 times
+	params := MainnetParams
+	params.LowerTimeBound = params.BlockTimeWindow() / 100
+	params.UpperTimeBound = params.BlockTimeWindow() * 100
+	if err := params.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	const diff = Difficulty(1e6)
+	history := make([]DifficultyData, params.DifficultyAdjustWindow+params.MedianTimeWindow)
+	for i := range history {
+		// blocks 1000 times slower than the block time
+		history[i] = DifficultyData{Timestamp: 1e9 + uint64(i)*1000*params.BlockTimeSec, Difficulty: diff}
+	}
+
+	unclamped := params
+	unclamped.MaxDifficultyChange = 0
+	if next := unclamped.NextDifficulty(history); next >= diff/Difficulty(params.MaxDifficultyChange) {
+		t.Fatalf("difficulty without clamp %d, want below %d", next, diff/Difficulty(params.MaxDifficultyChange))
+	}
+
+	want := diff / Difficulty(params.MaxDifficultyChange)
+	if next := params.NextDifficulty(history); next != want {
+		t.Errorf("clamped difficulty %d, want %d", next, want)
+	}
+}
@@ -0,0 +1,42 @@
+package consensus
+
+import (
+	"encoding/hex"
+	"errors"
+)
+
+// Hash is hash of a block, header or transaction kernel (32 byte)
+type Hash [BlockHashSize]byte
+
+// FromHex decodes hash from hex string
+func FromHex(s string) (Hash, error) {
+	var h Hash
+
+	if hex.DecodedLen(len(s)) != BlockHashSize {
+		return h, errors.New("invalid hash length")
+	}
+
+	_, err := hex.Decode(h[:], []byte(s))
+	return h, err
+}
+
+// String implements Stringer interface
+func (h Hash) String() string {
+	return hex.EncodeToString(h[:])
+}
+
+// MarshalText implements encoding.TextMarshaler interface
+func (h Hash) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler interface
+func (h *Hash) UnmarshalText(text []byte) error {
+	hash, err := FromHex(string(text))
+	if err != nil {
+		return err
+	}
+
+	*h = hash
+	return nil
+}
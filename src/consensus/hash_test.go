@@ -0,0 +1,62 @@
+package consensus
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestHashHexRoundTrip(t *testing.T) {
+	s := "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+	h, err := FromHex(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range h {
+		if h[i] != byte(i) {
+			t.Fatalf("byte %d decoded as %x", i, h[i])
+		}
+	}
+
+	if h.String() != s {
+		t.Errorf("hash formatted as %s, want %s", h, s)
+	}
+
+	var text Hash
+	if err := text.UnmarshalText([]byte(strings.ToUpper(s))); err != nil || text != h {
+		t.Errorf("upper case hex decoded as %s, %v", text, err)
+	}
+
+	for _, invalid := range []string{"", s[:62], s + "00", "zz" + s[2:]} {
+		if _, err := FromHex(invalid); err == nil {
+			t.Errorf("invalid hex %q decoded", invalid)
+		}
+	}
+}
+
+func TestHashMapKey(t *testing.T) {
+	a, b := Hash{1}, Hash{2}
+
+	seen := map[Hash]int{a: 1}
+	seen[b]++
+	seen[Hash{1}]++
+
+	if len(seen) != 2 || seen[a] != 2 || seen[b] != 1 {
+		t.Errorf("map keyed by hash holds %v", seen)
+	}
+
+	// text marshalling makes hashes usable as JSON object keys
+	data, err := json.Marshal(seen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded map[Hash]int
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 2 || decoded[a] != 2 || decoded[b] != 1 {
+		t.Errorf("%s decoded as %v", data, decoded)
+	}
+}
@@ -14,6 +14,20 @@ const (
 	// peer-to-peer networking layer only for DoS protection.
 	MaxMsgLen uint64 = 20000000
 
+	// DefaultPort port mainnet nodes listen on by default
+	DefaultPort uint16 = 13414
+
+	// TestnetPort port testnet nodes listen on by default
+	TestnetPort uint16 = 13413
+
+)
+
+// Versions of message bodies starting with a version byte, so complex
+// messages evolve independently of the protocol version
+const (
+	BlockBodyVersion       uint8 = 1
+	TransactionBodyVersion uint8 = 1
+	HeadersBodyVersion     uint8 = 1
 )
 
 // Types of p2p messages
@@ -30,6 +44,15 @@ const (
 	MsgTypeGetBlock
 	MsgTypeBlock
 	MsgTypeTransaction
+	MsgTypeCompactBlock
+	MsgTypeGetTip
+	MsgTypeTip
+	MsgTypeSetFilter
+	MsgTypeReject
+	MsgTypeInv
+	MsgTypePeerAddrsV2
+	MsgTypeGetUTXOSet
+	MsgTypeUTXOSetChunk
 )
 
 // Capabilities of node
@@ -44,6 +67,14 @@ const (
 	CapUtxoHist = 1 << 1
 	// Can provide a list of healthy peers
 	CapPeerList = 1 << 2
+	// Can receive compact blocks and rebuild them from its transaction pool.
+	CapCompactBlock = 1 << 3
+	// Can receive message bodies compressed with flate.
+	CapCompression = 1 << 4
+	// Can receive peer addresses with their capabilities in PeerAddrsV2.
+	CapPeerAddrsV2 = 1 << 5
+	// Keeps blocks beyond the cut-through horizon, same as full history.
+	CapArchival = CapFullHist
 	CapFullNode = CapFullHist | CapUtxoHist | CapPeerList
 )
 
@@ -0,0 +1,159 @@
+package consensus
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// NetworkParams are consensus parameters which may differ between networks
+type NetworkParams struct {
+	// Name of the network
+	Name string
+
+	// Port nodes listen on by default
+	Port uint16
+
+	// Sizeshift Cuckoo Cycle size shift used for mining and validating.
+	Sizeshift uint8
+
+	// Easiness Cuckoo Cycle easiness, percentage of the graph edges
+	// eligible for the proof of work.
+	Easiness uint32
+
+	// BlockTimeSec Block interval, in seconds, the network tunes its next target for.
+	BlockTimeSec uint64
+
+	// MinimumDifficulty The minimum mining difficulty we'll allow
+	MinimumDifficulty uint64
+
+	// MedianTimeWindow Time window in blocks to calculate block time median
+	MedianTimeWindow uint64
+
+	// DifficultyAdjustWindow Number of blocks used to calculate difficulty adjustments
+	DifficultyAdjustWindow uint64
+
+	// LowerTimeBound Minimum size time window used for difficulty adjustments
+	LowerTimeBound uint64
+
+	// UpperTimeBound Maximum size time window used for difficulty adjustments
+	UpperTimeBound uint64
+
+	// MaxDifficultyChange Maximum factor difficulty may go up or down by in
+	// a single adjustment, zero means no limit
+	MaxDifficultyChange uint64
+
+	// Genesis header of the first block of the network
+	Genesis BlockHeader
+}
+
+// MainnetParams consensus parameters of the main network
+var MainnetParams = NetworkParams{
+	Name:                   "mainnet",
+	Port:                   DefaultPort,
+	Sizeshift:              DefaultSizeshift,
+	Easiness:               Easiness,
+	BlockTimeSec:           BlockTimeSec,
+	MinimumDifficulty:      MinimumDifficulty,
+	MedianTimeWindow:       MedianTimeWindow,
+	DifficultyAdjustWindow: DifficultyAdjustWindow,
+	LowerTimeBound:         LowerTimeBound,
+	UpperTimeBound:         UpperTimeBound,
+	MaxDifficultyChange:    MaxDifficultyChange,
+	Genesis: BlockHeader{
+		Version:         1,
+		Timestamp:       1514764800,
+		Bits:            0x08019999,
+		TotalDifficulty: Difficulty(MinimumDifficulty),
+	},
+}
+
+// testnetBlockTimeSec block interval of the test network, in seconds
+const testnetBlockTimeSec uint64 = 30
+
+// TestnetParams consensus parameters of the test network, with smaller
+// Cuckoo graphs and shorter block time for faster mining
+var TestnetParams = NetworkParams{
+	Name:                   "testnet",
+	Port:                   TestnetPort,
+	Sizeshift:              16,
+	Easiness:               Easiness,
+	BlockTimeSec:           testnetBlockTimeSec,
+	MinimumDifficulty:      MinimumDifficulty,
+	MedianTimeWindow:       MedianTimeWindow,
+	DifficultyAdjustWindow: DifficultyAdjustWindow,
+	LowerTimeBound:         DifficultyAdjustWindow * testnetBlockTimeSec * 5 / 6,
+	UpperTimeBound:         DifficultyAdjustWindow * testnetBlockTimeSec * 4 / 3,
+	MaxDifficultyChange:    MaxDifficultyChange,
+	Genesis: BlockHeader{
+		Version:         1,
+		Timestamp:       1512086400,
+		Bits:            0x08019999,
+		TotalDifficulty: Difficulty(MinimumDifficulty),
+	},
+}
+
+// defaultNetwork parameters used where none are passed explicitly
+var defaultNetwork atomic.Pointer[NetworkParams]
+
+func init() {
+	defaultNetwork.Store(&MainnetParams)
+}
+
+// DefaultNetwork returns parameters used where none are passed explicitly,
+// mainnet unless changed by SetDefaultNetwork
+func DefaultNetwork() *NetworkParams {
+	return defaultNetwork.Load()
+}
+
+// SetDefaultNetwork replaces default network parameters, safe for
+// concurrent use
+func SetDefaultNetwork(p *NetworkParams) {
+	defaultNetwork.Store(p)
+}
+
+// GenesisHash returns hash of the genesis block, which identifies the network
+func (p NetworkParams) GenesisHash() Hash {
+	return p.Genesis.Hash()
+}
+
+// BlockTimeWindow Average time span of the difficulty adjustment window
+func (p NetworkParams) BlockTimeWindow() uint64 {
+	return p.DifficultyAdjustWindow * p.BlockTimeSec
+}
+
+// Validate checks parameters are self-consistent
+func (p NetworkParams) Validate() error {
+	if p.Sizeshift == 0 || p.Sizeshift > 63 {
+		return errors.New("cuckoo size shift out of range")
+	}
+
+	if p.Easiness == 0 || p.Easiness > 100 {
+		return errors.New("cuckoo easiness must be a percentage")
+	}
+
+	if ProofSize%2 != 0 || uint64(ProofSize) > EasinessThreshold(p.Sizeshift, p.Easiness) {
+		return errors.New("proof size must be even and fit the graph")
+	}
+
+	if p.BlockTimeSec == 0 {
+		return errors.New("block time must not be zero")
+	}
+
+	if p.MinimumDifficulty == 0 {
+		return errors.New("minimum difficulty must not be zero")
+	}
+
+	if p.MedianTimeWindow == 0 || p.DifficultyAdjustWindow == 0 {
+		return errors.New("difficulty windows must not be empty")
+	}
+
+	if p.MedianTimeWindow > p.DifficultyAdjustWindow {
+		return errors.New("median time window larger than difficulty adjustment window")
+	}
+
+	if !(p.LowerTimeBound < p.BlockTimeWindow() && p.BlockTimeWindow() < p.UpperTimeBound) {
+		return errors.New("block time window out of time bounds")
+	}
+
+	return nil
+}
@@ -0,0 +1,37 @@
+package consensus
+
+import "testing"
+
+func TestNetworkParamsValidate(t *testing.T) {
+	for _, p := range []NetworkParams{MainnetParams, TestnetParams} {
+		if err := p.Validate(); err != nil {
+			t.Errorf("%s params: %v", p.Name, err)
+		}
+	}
+
+	broken := map[string]func(p *NetworkParams){
+		"zero size shift":        func(p *NetworkParams) { p.Sizeshift = 0 },
+		"huge size shift":        func(p *NetworkParams) { p.Sizeshift = 64 },
+		"zero easiness":          func(p *NetworkParams) { p.Easiness = 0 },
+		"easiness above 100":     func(p *NetworkParams) { p.Easiness = 101 },
+		"graph below proof size": func(p *NetworkParams) { p.Sizeshift = 4 },
+		"zero block time":        func(p *NetworkParams) { p.BlockTimeSec = 0 },
+		"zero difficulty":        func(p *NetworkParams) { p.MinimumDifficulty = 0 },
+		"empty median window":    func(p *NetworkParams) { p.MedianTimeWindow = 0 },
+		"median above window":    func(p *NetworkParams) { p.MedianTimeWindow = p.DifficultyAdjustWindow + 1 },
+		"lower bound above window": func(p *NetworkParams) {
+			p.LowerTimeBound = p.BlockTimeWindow()
+		},
+		"upper bound below window": func(p *NetworkParams) {
+			p.UpperTimeBound = p.BlockTimeWindow()
+		},
+	}
+
+	for name, breakParams := range broken {
+		p := MainnetParams
+		breakParams(&p)
+		if err := p.Validate(); err == nil {
+			t.Errorf("%s: params validated", name)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package consensus
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"golang.org/x/crypto/blake2b"
+	"math/big"
+)
+
+// secp256k1 curve y^2 = x^3 + 7 over the field of p, with base point G of order n
+var (
+	secpP, _  = new(big.Int).SetString("fffffffffffffffffffffffffffffffffffffffffffffffffffffffefffffc2f", 16)
+	secpN, _  = new(big.Int).SetString("fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141", 16)
+	secpGx, _ = new(big.Int).SetString("79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798", 16)
+	secpGy, _ = new(big.Int).SetString("483ada7726a3c4655da4fbfc0e1108a8fd17b448a68554199c47d08ffb10d4b8", 16)
+	// generator H of values in Pedersen commitments r*G + v*H
+	secpHx, _ = new(big.Int).SetString("50929b74c1a04954b78b4b6035e97a5e078a5a0f28ec96d547bfee9ace803ac0", 16)
+	secpHy, _ = new(big.Int).SetString("31d3c6863973926e049e637cb1b5f40a36dac28af1766968c30c2313f3a38904", 16)
+)
+
+// curvePoint is an affine point of secp256k1, nil coordinates for infinity
+type curvePoint struct {
+	x, y *big.Int
+}
+
+// isInfinity checks whether point is the point at infinity
+func (a curvePoint) isInfinity() bool {
+	return a.x == nil
+}
+
+// add returns a + b
+func (a curvePoint) add(b curvePoint) curvePoint {
+	if a.isInfinity() {
+		return b
+	}
+	if b.isInfinity() {
+		return a
+	}
+
+	var lambda *big.Int
+	if a.x.Cmp(b.x) == 0 {
+		// a == -b
+		sum := new(big.Int).Add(a.y, b.y)
+		if sum.Mod(sum, secpP).Sign() == 0 {
+			return curvePoint{}
+		}
+
+		// tangent slope 3x^2 / 2y
+		num := new(big.Int).Mul(a.x, a.x)
+		num.Mul(num, big.NewInt(3))
+		den := new(big.Int).Lsh(a.y, 1)
+		lambda = num.Mul(num, den.ModInverse(den.Mod(den, secpP), secpP))
+	} else {
+		num := new(big.Int).Sub(b.y, a.y)
+		den := new(big.Int).Sub(b.x, a.x)
+		lambda = num.Mul(num, den.ModInverse(den.Mod(den, secpP), secpP))
+	}
+	lambda.Mod(lambda, secpP)
+
+	x := new(big.Int).Mul(lambda, lambda)
+	x.Sub(x, a.x).Sub(x, b.x).Mod(x, secpP)
+
+	y := new(big.Int).Sub(a.x, x)
+	y.Mul(y, lambda).Sub(y, a.y).Mod(y, secpP)
+
+	return curvePoint{x: x, y: y}
+}
+
+// neg returns -a
+func (a curvePoint) neg() curvePoint {
+	if a.isInfinity() {
+		return a
+	}
+
+	return curvePoint{x: a.x, y: new(big.Int).Sub(secpP, a.y)}
+}
+
+// mul returns k * a
+func (a curvePoint) mul(k *big.Int) curvePoint {
+	var result curvePoint
+	for i := k.BitLen() - 1; i >= 0; i-- {
+		result = result.add(result)
+		if k.Bit(i) == 1 {
+			result = result.add(a)
+		}
+	}
+
+	return result
+}
+
+// decompressPoint parses 33 bytes compressed point. Public key prefixes
+// (0x02, 0x03) give y parity. Pedersen commitment prefixes (0x08, 0x09) are
+// 9 ^ is_quad(y) as in secp256k1-zkp: 0x08 when y is a quadratic residue.
+func decompressPoint(data Commitment) (curvePoint, bool) {
+	switch data[0] {
+	case 0x02, 0x03, 0x08, 0x09:
+	default:
+		return curvePoint{}, false
+	}
+
+	x := new(big.Int).SetBytes(data[1:])
+	if x.Cmp(secpP) >= 0 {
+		return curvePoint{}, false
+	}
+
+	// y^2 = x^3 + 7
+	y2 := new(big.Int).Exp(x, big.NewInt(3), secpP)
+	y2.Add(y2, big.NewInt(7)).Mod(y2, secpP)
+
+	y := new(big.Int).ModSqrt(y2, secpP)
+	if y == nil {
+		return curvePoint{}, false
+	}
+
+	// -1 isn't a residue mod p, so exactly one of y, -y is
+	var flip bool
+	if data[0] == 0x02 || data[0] == 0x03 {
+		flip = y.Bit(0) != uint(data[0]&1)
+	} else {
+		flip = (big.Jacobi(y, secpP) == 1) != (data[0] == 0x08)
+	}
+
+	if flip {
+		y.Sub(secpP, y)
+	}
+
+	return curvePoint{x: x, y: y}, true
+}
+
+// KernelSigMessage returns the message signed by kernel excess signature:
+// hash of fee, features and lock height
+func KernelSigMessage(fee, lockHeight uint64, features uint8) Hash {
+	var buff [17]byte
+	binary.BigEndian.PutUint64(buff[0:8], fee)
+	buff[8] = features
+	binary.BigEndian.PutUint64(buff[9:17], lockHeight)
+
+	return blake2b.Sum256(buff[:])
+}
+
+// compressPoint serializes point as public key, prefix giving y parity
+func compressPoint(a curvePoint) [CommitmentSize]byte {
+	var buff [CommitmentSize]byte
+	buff[0] = 0x02 | byte(a.y.Bit(0))
+	a.x.FillBytes(buff[1:])
+
+	return buff
+}
+
+// aggsigChallenge returns challenge of secp256k1-zkp aggsig single signer:
+// sha256 of compressed nonce point, compressed public key and message,
+// false if it overflows curve order
+func aggsigChallenge(nonce, pubKey curvePoint, msg Hash) (*big.Int, bool) {
+	r := compressPoint(nonce)
+	p := compressPoint(pubKey)
+
+	h := sha256.New()
+	h.Write(r[:])
+	h.Write(p[:])
+	h.Write(msg[:])
+
+	e := new(big.Int).SetBytes(h.Sum(nil))
+	return e, e.Cmp(secpN) < 0
+}
+
+// VerifyKernelSignature verifies aggsig signature of the kernel message by
+// the kernel excess used as public key, as secp256k1_aggsig_verify_single
+// of secp256k1-zkp does for a complete signature with the excess as total
+// public key. Signature is nonce point x coordinate r followed by s, both
+// big-endian. Nonce point R is the one with x r and quadratic residue y,
+// valid when s*G - e*P equals R, e being the challenge of R, P and message.
+func VerifyKernelSignature(excess [CommitmentSize]byte, sig [SignatureSize]byte, fee, lockHeight uint64, features uint8) bool {
+	pub, ok := decompressPoint(Commitment(excess))
+	if !ok {
+		return false
+	}
+
+	s := new(big.Int).SetBytes(sig[32:])
+	if s.Cmp(secpN) >= 0 {
+		return false
+	}
+
+	// prefix 0x08 picks quadratic residue y
+	var rBytes Commitment
+	rBytes[0] = 0x08
+	copy(rBytes[1:], sig[:32])
+	nonce, ok := decompressPoint(rBytes)
+	if !ok {
+		return false
+	}
+
+	e, ok := aggsigChallenge(nonce, pub, KernelSigMessage(fee, lockHeight, features))
+	if !ok {
+		return false
+	}
+
+	g := curvePoint{x: secpGx, y: secpGy}
+	point := g.mul(s).add(pub.mul(e).neg())
+
+	return !point.isInfinity() && point.x.Cmp(nonce.x) == 0 && big.Jacobi(point.y, secpP) == 1
+}
+
+// VerifySignature verifies kernel excess signature
+func (k *TxKernel) VerifySignature() bool {
+	return VerifyKernelSignature(k.Excess, k.ExcessSig, k.Fee, k.LockHeight, uint8(k.Features))
+}
@@ -0,0 +1,59 @@
+package consensus
+
+import (
+	"math/big"
+	"testing"
+)
+
+// signKernel signs kernel message by secret key x with nonce k the way
+// secp256k1_aggsig_sign_single does: nonce is negated unless k*G has
+// quadratic residue y, then s = k + e*x
+func signKernel(x, k int64, fee, lockHeight uint64, features uint8) ([CommitmentSize]byte, [SignatureSize]byte) {
+	g := curvePoint{x: secpGx, y: secpGy}
+	pub := g.mul(big.NewInt(x))
+
+	nonce := big.NewInt(k)
+	r := g.mul(nonce)
+	if big.Jacobi(r.y, secpP) != 1 {
+		nonce.Sub(secpN, nonce)
+		r = r.neg()
+	}
+
+	e, _ := aggsigChallenge(r, pub, KernelSigMessage(fee, lockHeight, features))
+	s := e.Mul(e, big.NewInt(x))
+	s.Add(s, nonce).Mod(s, secpN)
+
+	var sig [SignatureSize]byte
+	r.x.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	return commitPoint(pub), sig
+}
+
+func TestVerifyKernelSignature(t *testing.T) {
+	for k := int64(1); k < 5; k++ {
+		excess, sig := signKernel(12345, k, 8, 0, 0)
+		if !VerifyKernelSignature(excess, sig, 8, 0, 0) {
+			t.Fatalf("nonce %d: valid signature rejected", k)
+		}
+
+		if VerifyKernelSignature(excess, sig, 9, 0, 0) {
+			t.Errorf("nonce %d: signature of other fee accepted", k)
+		}
+
+		if VerifyKernelSignature(excess, sig, 8, 1, 0) {
+			t.Errorf("nonce %d: signature of other lock height accepted", k)
+		}
+
+		tampered := sig
+		tampered[63] ^= 1
+		if VerifyKernelSignature(excess, tampered, 8, 0, 0) {
+			t.Errorf("nonce %d: tampered signature accepted", k)
+		}
+
+		other, _ := signKernel(54321, k, 8, 0, 0)
+		if VerifyKernelSignature(other, sig, 8, 0, 0) {
+			t.Errorf("nonce %d: signature accepted for other excess", k)
+		}
+	}
+}
@@ -0,0 +1,391 @@
+package consensus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/blake2b"
+	"io"
+)
+
+// ErrInvalidCommitment is returned when commitment isn't a point of secp256k1
+var ErrInvalidCommitment = errors.New("invalid commitment")
+
+// Commitment is a Pedersen commitment, compressed point of secp256k1
+type Commitment [CommitmentSize]byte
+
+// IsValid checks whether commitment decodes to a point of secp256k1
+func (c Commitment) IsValid() bool {
+	_, ok := decompressPoint(c)
+	return ok
+}
+
+// Input a transaction input, spends an output by its commitment
+type Input struct {
+	// Commit of the spent output
+	Commit Commitment
+}
+
+// Write writes input as binary data to writer
+func (i *Input) Write(w io.Writer) error {
+	_, err := w.Write(i.Commit[:])
+	return err
+}
+
+// Read reads input from reader
+func (i *Input) Read(r io.Reader) error {
+	if _, err := io.ReadFull(r, i.Commit[:]); err != nil {
+		return err
+	}
+
+	if !i.Commit.IsValid() {
+		return ErrInvalidCommitment
+	}
+
+	return nil
+}
+
+// OutputFeatures are options for an output's structure or use
+type OutputFeatures uint8
+
+const (
+	// DefaultOutput no flags
+	DefaultOutput OutputFeatures = 0
+	// CoinbaseOutput output is a coinbase output, must not be spent until maturity
+	CoinbaseOutput OutputFeatures = 1 << 0
+)
+
+// Output for a transaction, defining the new ownership of coins that are being
+// transferred.
+type Output struct {
+	// Options for an output's structure or use
+	Features OutputFeatures
+	// The homomorphic commitment representing the output's amount
+	Commit Commitment
+	// A proof that the commitment is in the right range
+	RangeProof []byte
+}
+
+// IsCoinbase checks whether output is a coinbase output
+func (o *Output) IsCoinbase() bool {
+	return o.Features&CoinbaseOutput != 0
+}
+
+// Write writes output as binary data to writer
+func (o *Output) Write(w io.Writer) error {
+	if err := binary.Write(w, binary.BigEndian, uint8(o.Features)); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(o.Commit[:]); err != nil {
+		return err
+	}
+
+	// Write range proof [len][bytes]
+	if err := binary.Write(w, binary.BigEndian, uint64(len(o.RangeProof))); err != nil {
+		return err
+	}
+
+	_, err := w.Write(o.RangeProof)
+	return err
+}
+
+// Read reads output from reader
+func (o *Output) Read(r io.Reader) error {
+	if err := binary.Read(r, binary.BigEndian, (*uint8)(&o.Features)); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(r, o.Commit[:]); err != nil {
+		return err
+	}
+
+	if !o.Commit.IsValid() {
+		return ErrInvalidCommitment
+	}
+
+	var proofLen uint64
+	if err := binary.Read(r, binary.BigEndian, &proofLen); err != nil {
+		return err
+	}
+
+	if proofLen > MaxRangeProofSize {
+		return errors.New("range proof too big")
+	}
+
+	o.RangeProof = make([]byte, proofLen)
+	_, err := io.ReadFull(r, o.RangeProof)
+	return err
+}
+
+// KernelFeatures are options for a kernel's structure or use
+type KernelFeatures uint8
+
+const (
+	// PlainKernel no flags
+	PlainKernel KernelFeatures = 0
+	// CoinbaseKernel kernel matching a coinbase output, carries no fee
+	CoinbaseKernel KernelFeatures = 1 << 0
+	// HeightLockedKernel kernel is not valid before its lock height
+	HeightLockedKernel KernelFeatures = 1 << 1
+)
+
+var (
+	// ErrCoinbaseKernelFee is returned for a coinbase kernel with non-zero fee
+	ErrCoinbaseKernelFee = errors.New("coinbase kernel with non-zero fee")
+	// ErrMissingLockHeight is returned for a height-locked kernel without lock height
+	ErrMissingLockHeight = errors.New("height-locked kernel without lock height")
+)
+
+// TxKernel is the "kernel" of a transaction: it carries the excess
+// commitment, the signature proving it and the transaction fee.
+type TxKernel struct {
+	// Options for a kernel's structure or use
+	Features KernelFeatures
+	// Fee originally included in the transaction this proof is for.
+	Fee uint64
+	// This kernel is not valid earlier than lock height blocks
+	LockHeight uint64
+	// Remainder of the sum of all transaction commitments.
+	Excess [CommitmentSize]byte
+	// The signature proving the excess is a valid public key, which signs
+	// the transaction fee.
+	ExcessSig [SignatureSize]byte
+}
+
+// Write writes kernel as binary data to writer
+func (k *TxKernel) Write(w io.Writer) error {
+	if err := binary.Write(w, binary.BigEndian, uint8(k.Features)); err != nil {
+		return err
+	}
+
+	if err := binary.Write(w, binary.BigEndian, k.Fee); err != nil {
+		return err
+	}
+
+	if err := binary.Write(w, binary.BigEndian, k.LockHeight); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(k.Excess[:]); err != nil {
+		return err
+	}
+
+	_, err := w.Write(k.ExcessSig[:])
+	return err
+}
+
+// Read reads kernel from reader
+func (k *TxKernel) Read(r io.Reader) error {
+	if err := binary.Read(r, binary.BigEndian, (*uint8)(&k.Features)); err != nil {
+		return err
+	}
+
+	if err := binary.Read(r, binary.BigEndian, &k.Fee); err != nil {
+		return err
+	}
+
+	if err := binary.Read(r, binary.BigEndian, &k.LockHeight); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(r, k.Excess[:]); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(r, k.ExcessSig[:]); err != nil {
+		return err
+	}
+
+	return k.Validate()
+}
+
+// Validate checks kernel fields are consistent with its features
+func (k *TxKernel) Validate() error {
+	if k.Features&CoinbaseKernel != 0 && k.Fee != 0 {
+		return ErrCoinbaseKernelFee
+	}
+
+	if k.Features&HeightLockedKernel != 0 && k.LockHeight == 0 {
+		return ErrMissingLockHeight
+	}
+
+	return nil
+}
+
+// Hash returns hash of the serialized kernel
+func (k *TxKernel) Hash() Hash {
+	buff := new(bytes.Buffer)
+
+	// writing to bytes.Buffer never fails
+	k.Write(buff)
+	return blake2b.Sum256(buff.Bytes())
+}
+
+// Transaction a grin transaction: inputs spent, outputs created and kernels
+// proving the transaction balances
+type Transaction struct {
+	// List of inputs spent by the transaction
+	Inputs []Input
+	// List of outputs the transaction produces
+	Outputs []Output
+	// List of kernels that make up this transaction
+	Kernels []TxKernel
+}
+
+// Write writes transaction as binary data to writer
+func (tx *Transaction) Write(w io.Writer) error {
+	if err := binary.Write(w, binary.BigEndian, TransactionBodyVersion); err != nil {
+		return err
+	}
+
+	if err := binary.Write(w, binary.BigEndian, uint64(len(tx.Inputs))); err != nil {
+		return err
+	}
+
+	if err := binary.Write(w, binary.BigEndian, uint64(len(tx.Outputs))); err != nil {
+		return err
+	}
+
+	if err := binary.Write(w, binary.BigEndian, uint64(len(tx.Kernels))); err != nil {
+		return err
+	}
+
+	for i := range tx.Inputs {
+		if err := tx.Inputs[i].Write(w); err != nil {
+			return err
+		}
+	}
+
+	for i := range tx.Outputs {
+		if err := tx.Outputs[i].Write(w); err != nil {
+			return err
+		}
+	}
+
+	for i := range tx.Kernels {
+		if err := tx.Kernels[i].Write(w); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Bytes implements p2p Message interface
+func (tx *Transaction) Bytes() []byte {
+	buff := new(bytes.Buffer)
+
+	// writing to bytes.Buffer never fails
+	tx.Write(buff)
+	return buff.Bytes()
+}
+
+// Hash returns hash of the serialized transaction in canonical order, used
+// as transaction id. The id doesn't depend on order of inputs, outputs and
+// kernels, the transaction itself is left unsorted.
+func (tx *Transaction) Hash() Hash {
+	canonical := Transaction{
+		Inputs:  append([]Input(nil), tx.Inputs...),
+		Outputs: append([]Output(nil), tx.Outputs...),
+		Kernels: append([]TxKernel(nil), tx.Kernels...),
+	}
+
+	SortInputs(canonical.Inputs)
+	SortOutputs(canonical.Outputs)
+	SortKernels(canonical.Kernels)
+
+	return blake2b.Sum256(canonical.Bytes())
+}
+
+// Type implements p2p Message interface
+func (tx *Transaction) Type() uint8 {
+	return MsgTypeTransaction
+}
+
+// Read implements p2p Message interface
+func (tx *Transaction) Read(r io.Reader) error {
+	if err := ReadBodyVersion(r, TransactionBodyVersion); err != nil {
+		return err
+	}
+
+	var inputs, outputs, kernels uint64
+	if err := binary.Read(r, binary.BigEndian, &inputs); err != nil {
+		return err
+	}
+
+	if err := binary.Read(r, binary.BigEndian, &outputs); err != nil {
+		return err
+	}
+
+	if err := binary.Read(r, binary.BigEndian, &kernels); err != nil {
+		return err
+	}
+
+	var err error
+	if tx.Inputs, err = readInputs(r, inputs); err != nil {
+		return err
+	}
+
+	if tx.Outputs, err = readOutputs(r, outputs); err != nil {
+		return err
+	}
+
+	tx.Kernels, err = readKernels(r, kernels)
+	return err
+}
+
+// maxPrealloc limits elements allocated ahead from a count read off the
+// wire, so a bogus count can't make us allocate more than the body holds
+const maxPrealloc = 1024
+
+// preallocLen returns capacity to allocate for count elements read off the wire
+func preallocLen(count uint64) int {
+	if count > maxPrealloc {
+		return maxPrealloc
+	}
+
+	return int(count)
+}
+
+// readInputs reads count inputs one by one from reader
+func readInputs(r io.Reader, count uint64) ([]Input, error) {
+	inputs := make([]Input, 0, preallocLen(count))
+	for i := uint64(0); i < count; i++ {
+		var input Input
+		if err := input.Read(r); err != nil {
+			return nil, err
+		}
+		inputs = append(inputs, input)
+	}
+
+	return inputs, nil
+}
+
+// readOutputs reads count outputs one by one from reader
+func readOutputs(r io.Reader, count uint64) ([]Output, error) {
+	outputs := make([]Output, 0, preallocLen(count))
+	for i := uint64(0); i < count; i++ {
+		var output Output
+		if err := output.Read(r); err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, output)
+	}
+
+	return outputs, nil
+}
+
+// readKernels reads count kernels one by one from reader
+func readKernels(r io.Reader, count uint64) ([]TxKernel, error) {
+	kernels := make([]TxKernel, 0, preallocLen(count))
+	for i := uint64(0); i < count; i++ {
+		var kernel TxKernel
+		if err := kernel.Read(r); err != nil {
+			return nil, err
+		}
+		kernels = append(kernels, kernel)
+	}
+
+	return kernels, nil
+}
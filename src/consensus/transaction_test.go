@@ -0,0 +1,134 @@
+package consensus
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestKernelFeaturesRoundTrip(t *testing.T) {
+	kernels := map[string]TxKernel{
+		"plain":         {Features: PlainKernel, Fee: 8, Excess: excess(3)},
+		"coinbase":      {Features: CoinbaseKernel, Excess: excess(7)},
+		"height-locked": {Features: HeightLockedKernel, Fee: 8, LockHeight: 1000, Excess: excess(5)},
+	}
+
+	for name, k := range kernels {
+		buff := new(bytes.Buffer)
+		if err := k.Write(buff); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		// features are written before the fee
+		if buff.Bytes()[0] != uint8(k.Features) {
+			t.Errorf("%s: features written as %x", name, buff.Bytes()[0])
+		}
+
+		var got TxKernel
+		if err := got.Read(buff); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+
+		if got != k {
+			t.Errorf("%s kernel read as %+v, want %+v", name, got, k)
+		}
+	}
+}
+
+func TestKernelFeaturesRejected(t *testing.T) {
+	kernels := []struct {
+		name   string
+		kernel TxKernel
+		err    error
+	}{
+		{"coinbase with fee", TxKernel{Features: CoinbaseKernel, Fee: 1}, ErrCoinbaseKernelFee},
+		{"height-locked without lock height", TxKernel{Features: HeightLockedKernel}, ErrMissingLockHeight},
+	}
+
+	for _, tt := range kernels {
+		if err := tt.kernel.Validate(); err != tt.err {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+
+		buff := new(bytes.Buffer)
+		if err := tt.kernel.Write(buff); err != nil {
+			t.Fatal(err)
+		}
+
+		var got TxKernel
+		if err := got.Read(buff); err != tt.err {
+			t.Errorf("%s read: got %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestTransactionHashIgnoresOrder(t *testing.T) {
+	tx := &Transaction{
+		Inputs:  []Input{{Commit: Commitment{8, 1}}, {Commit: Commitment{8, 2}}, {Commit: Commitment{9, 3}}},
+		Outputs: []Output{{Commit: Commitment{8, 4}}, {Commit: Commitment{9, 5}}},
+		Kernels: []TxKernel{{Fee: 2, Excess: excess(1)}, {Fee: 1, Excess: excess(2)}},
+	}
+	hash := tx.Hash()
+
+	reordered := &Transaction{
+		Inputs:  []Input{tx.Inputs[2], tx.Inputs[0], tx.Inputs[1]},
+		Outputs: []Output{tx.Outputs[1], tx.Outputs[0]},
+		Kernels: []TxKernel{tx.Kernels[1], tx.Kernels[0]},
+	}
+	if reordered.Hash() != hash {
+		t.Error("reordered transaction hashes differently")
+	}
+
+	// hashing doesn't sort the transaction itself
+	if reordered.Inputs[0] != tx.Inputs[2] {
+		t.Error("Hash reordered inputs of the transaction")
+	}
+
+	changed := *reordered
+	changed.Inputs = []Input{tx.Inputs[0], tx.Inputs[1]}
+	if changed.Hash() == hash {
+		t.Error("transaction without an input hashes the same")
+	}
+}
+
+func TestCommitmentIsValid(t *testing.T) {
+	valid := pedersen(3, 1000)
+	if !valid.IsValid() {
+		t.Fatalf("commitment %x not valid", valid)
+	}
+
+	// x^3 + 7 of x = 5 isn't a square, there's no point of x = 5
+	offCurve := Commitment{0x02}
+	offCurve[CommitmentSize-1] = 5
+
+	var garbage Commitment
+	for i := range garbage {
+		garbage[i] = byte(i*37 + 11)
+	}
+	// x above the field prime
+	aboveP := Commitment{0x08}
+	for i := 1; i < CommitmentSize; i++ {
+		aboveP[i] = 0xff
+	}
+
+	for name, c := range map[string]Commitment{
+		"zero":      {},
+		"garbage":   garbage,
+		"off curve": offCurve,
+		"above p":   aboveP,
+	} {
+		if c.IsValid() {
+			t.Errorf("%s commitment %x valid", name, c)
+		}
+
+		var read Input
+		if err := read.Read(bytes.NewReader(c[:])); err != ErrInvalidCommitment {
+			t.Errorf("input of %s commitment: got %v, want %v", name, err, ErrInvalidCommitment)
+		}
+	}
+
+	var read Input
+	if err := read.Read(bytes.NewReader(valid[:])); err != nil || read.Commit != valid {
+		t.Errorf("input of valid commitment read as %x, %v", read.Commit, err)
+	}
+}
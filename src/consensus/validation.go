@@ -0,0 +1,278 @@
+package consensus
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"sort"
+	"time"
+)
+
+var (
+	// ErrNonCanonicalOrder is returned when block inputs, outputs or kernels are not sorted
+	ErrNonCanonicalOrder = errors.New("block elements are not in canonical order")
+	// ErrUnknownInput is returned when an input spends an output not in the chain
+	ErrUnknownInput = errors.New("input spends unknown output")
+	// ErrImmatureCoinbase is returned when spending a coinbase output before maturity
+	ErrImmatureCoinbase = errors.New("coinbase output spent before maturity")
+	// ErrKernelLocked is returned when a kernel lock height is not reached yet
+	ErrKernelLocked = errors.New("kernel lock height not reached")
+	// ErrDuplicateInput is returned when block spends the same output twice
+	ErrDuplicateInput = errors.New("duplicate input commitment")
+	// ErrOutputSpentInBlock is returned when block output has commitment of its input
+	ErrOutputSpentInBlock = errors.New("output commitment duplicates input")
+	// ErrFutureTimestamp is returned when block timestamp is too far ahead of local time
+	ErrFutureTimestamp = errors.New("block timestamp too far in the future")
+	// ErrInvalidKernelSig is returned when kernel excess signature doesn't verify
+	ErrInvalidKernelSig = errors.New("invalid kernel signature")
+	// ErrBrokenLinkage is returned when header previous hash isn't the hash of the header before
+	ErrBrokenLinkage = errors.New("header doesn't link to previous one")
+	// ErrInvalidHeight is returned when header height doesn't follow the header before
+	ErrInvalidHeight = errors.New("header height doesn't follow previous one")
+	// ErrWrongDifficulty is returned when header bits don't match the adjusted difficulty
+	ErrWrongDifficulty = errors.New("header difficulty doesn't match adjustment")
+	// ErrTimestampTooOld is returned when header timestamp isn't above median of the previous ones
+	ErrTimestampTooOld = errors.New("header timestamp not above median time")
+	// ErrCoinbaseValue is returned when block commitments don't balance with coinbase value
+	ErrCoinbaseValue = errors.New("coinbase value doesn't match block reward plus fees")
+)
+
+// ValidateBlock checks block is consistent with consensus rules
+func ValidateBlock(b *Block) error {
+	return ValidateBlockWithClock(b, RealClock)
+}
+
+// ValidateBlockWithClock checks block is consistent with consensus rules,
+// timestamp is checked against current time of clock
+func ValidateBlockWithClock(b *Block, clock Clock) error {
+	now := uint64(clock.Now().Unix())
+	if err := ValidateFutureTimestamp(b.Header.Timestamp, now, time.Duration(MaxFutureDrift)*time.Second); err != nil {
+		return err
+	}
+
+	if !CanonicalOrder(b.Inputs, b.Outputs, b.Kernels) {
+		return ErrNonCanonicalOrder
+	}
+
+	inputs := make(map[Commitment]struct{}, len(b.Inputs))
+	for i := range b.Inputs {
+		if _, ok := inputs[b.Inputs[i].Commit]; ok {
+			return ErrDuplicateInput
+		}
+		inputs[b.Inputs[i].Commit] = struct{}{}
+	}
+
+	for i := range b.Outputs {
+		if _, ok := inputs[b.Outputs[i].Commit]; ok {
+			return ErrOutputSpentInBlock
+		}
+	}
+
+	for i := range b.Kernels {
+		if !b.Kernels[i].VerifySignature() {
+			return ErrInvalidKernelSig
+		}
+	}
+
+	if !kernelSumsBalance(b) {
+		return ErrCoinbaseValue
+	}
+
+	return nil
+}
+
+// kernelSumsBalance checks outputs less inputs of block b equal kernel
+// excesses plus its new coins times H. Transactions burn their fees, the
+// coinbase output pays CoinbaseValue, so the block creates CoinbaseValue
+// less fees. Blinding factors add up to the excesses and values cancel out
+// only when the coinbase output carries exactly CoinbaseValue.
+func kernelSumsBalance(b *Block) bool {
+	var sum curvePoint
+	for i := range b.Outputs {
+		p, ok := decompressPoint(b.Outputs[i].Commit)
+		if !ok {
+			return false
+		}
+		sum = sum.add(p)
+	}
+
+	for i := range b.Inputs {
+		p, ok := decompressPoint(b.Inputs[i].Commit)
+		if !ok {
+			return false
+		}
+		sum = sum.add(p.neg())
+	}
+
+	for i := range b.Kernels {
+		p, ok := decompressPoint(Commitment(b.Kernels[i].Excess))
+		if !ok {
+			return false
+		}
+		sum = sum.add(p.neg())
+	}
+
+	// hostile fees must not wrap the created value around
+	fee, ok := b.Fee()
+	if !ok {
+		return false
+	}
+
+	value, ok := CoinbaseValue(b.Header.Height, fee)
+	if !ok {
+		return false
+	}
+	created := value - fee
+	h := curvePoint{x: secpHx, y: secpHy}
+
+	return sum.add(h.mul(new(big.Int).SetUint64(created)).neg()).isInfinity()
+}
+
+// ValidateHeaderChain checks headers follow prev one by one: each links to
+// the hash of the header before and increments its height. Timestamps
+// needn't increase but must be above the median of the previous
+// MedianTimeWindow ones. Once the difficulty window is full, bits of each
+// header must encode the difficulty adjusted over the window. Window holds
+// the blocks up to prev and is left unchanged, so it's only short of
+// blocks near genesis.
+func ValidateHeaderChain(headers []*BlockHeader, prev *BlockHeader, window *DifficultyWindow) error {
+	window = window.clone()
+
+	for _, h := range headers {
+		if h.Previous != prev.Hash() {
+			return ErrBrokenLinkage
+		}
+
+		if h.Height != prev.Height+1 {
+			return ErrInvalidHeight
+		}
+
+		if median, ok := window.medianTime(); ok && h.Timestamp <= median {
+			return ErrTimestampTooOld
+		}
+
+		diff, err := h.Difficulty()
+		if err != nil {
+			return err
+		}
+
+		if window.full() && h.Bits != CompactFromTarget(window.Next().Target()) {
+			return ErrWrongDifficulty
+		}
+
+		window.Push(h.Timestamp, diff)
+		prev = h
+	}
+
+	return nil
+}
+
+// ValidateFutureTimestamp checks candidate block timestamp is at most
+// maxDrift ahead of now, both in seconds since Unix epoch
+func ValidateFutureTimestamp(candidate uint64, now uint64, maxDrift time.Duration) error {
+	if candidate > now && candidate-now > uint64(maxDrift/time.Second) {
+		return ErrFutureTimestamp
+	}
+
+	return nil
+}
+
+// ValidateTxAgainstChain checks transaction can be included in the block at
+// currentHeight: spent outputs are known to the chain, coinbase outputs
+// matured for CoinbaseMaturity blocks and kernel lock heights are reached.
+// lookup returns the height of the block which created the output of commit
+// and whether it's a coinbase output.
+func ValidateTxAgainstChain(tx *Transaction, currentHeight uint64,
+	lookup func(commit Commitment) (birthHeight uint64, isCoinbase bool, ok bool)) error {
+
+	for i := range tx.Inputs {
+		birthHeight, isCoinbase, ok := lookup(tx.Inputs[i].Commit)
+		if !ok {
+			return ErrUnknownInput
+		}
+
+		if isCoinbase && currentHeight < birthHeight+CoinbaseMaturity {
+			return ErrImmatureCoinbase
+		}
+	}
+
+	for i := range tx.Kernels {
+		if tx.Kernels[i].LockHeight > currentHeight {
+			return ErrKernelLocked
+		}
+	}
+
+	return nil
+}
+
+// CanonicalOrder checks inputs and outputs are sorted by commitment and
+// kernels by hash
+func CanonicalOrder(inputs []Input, outputs []Output, kernels []TxKernel) bool {
+	for i := 1; i < len(inputs); i++ {
+		if bytes.Compare(inputs[i-1].Commit[:], inputs[i].Commit[:]) > 0 {
+			return false
+		}
+	}
+
+	for i := 1; i < len(outputs); i++ {
+		if bytes.Compare(outputs[i-1].Commit[:], outputs[i].Commit[:]) > 0 {
+			return false
+		}
+	}
+
+	for i := 1; i < len(kernels); i++ {
+		prev, cur := kernels[i-1].Hash(), kernels[i].Hash()
+		if bytes.Compare(prev[:], cur[:]) > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// SortInputs sorts inputs in canonical order
+func SortInputs(inputs []Input) {
+	sort.Slice(inputs, func(i, j int) bool {
+		return bytes.Compare(inputs[i].Commit[:], inputs[j].Commit[:]) < 0
+	})
+}
+
+// SortOutputs sorts outputs in canonical order
+func SortOutputs(outputs []Output) {
+	sort.Slice(outputs, func(i, j int) bool {
+		return bytes.Compare(outputs[i].Commit[:], outputs[j].Commit[:]) < 0
+	})
+}
+
+// SortKernels sorts kernels in canonical order
+func SortKernels(kernels []TxKernel) {
+	sorter := kernelsByHash{
+		kernels: kernels,
+		hashes:  make([]Hash, len(kernels)),
+	}
+
+	for i := range kernels {
+		sorter.hashes[i] = kernels[i].Hash()
+	}
+
+	sort.Sort(sorter)
+}
+
+// kernelsByHash sorts kernels by their precomputed hashes
+type kernelsByHash struct {
+	kernels []TxKernel
+	hashes  []Hash
+}
+
+func (s kernelsByHash) Len() int {
+	return len(s.kernels)
+}
+
+func (s kernelsByHash) Less(i, j int) bool {
+	return bytes.Compare(s.hashes[i][:], s.hashes[j][:]) < 0
+}
+
+func (s kernelsByHash) Swap(i, j int) {
+	s.kernels[i], s.kernels[j] = s.kernels[j], s.kernels[i]
+	s.hashes[i], s.hashes[j] = s.hashes[j], s.hashes[i]
+}
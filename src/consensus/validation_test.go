@@ -0,0 +1,332 @@
+package consensus
+
+import (
+	"math/big"
+	"testing"
+	"time"
+)
+
+// commitPoint encodes p as commitment, prefix telling whether y is a
+// quadratic residue
+func commitPoint(p curvePoint) Commitment {
+	var c Commitment
+	c[0] = 0x09
+	if big.Jacobi(p.y, secpP) == 1 {
+		c[0] = 0x08
+	}
+	p.x.FillBytes(c[1:])
+
+	return c
+}
+
+// pedersen returns commitment r*G + v*H
+func pedersen(r, v uint64) Commitment {
+	g := curvePoint{x: secpGx, y: secpGy}
+	h := curvePoint{x: secpHx, y: secpHy}
+
+	return commitPoint(g.mul(new(big.Int).SetUint64(r)).add(h.mul(new(big.Int).SetUint64(v))))
+}
+
+// excess returns kernel excess r*G
+func excess(r uint64) [CommitmentSize]byte {
+	g := curvePoint{x: secpGx, y: secpGy}
+	return commitPoint(g.mul(new(big.Int).SetUint64(r)))
+}
+
+// balancedBlock builds block paying coinbase value to coinbase output,
+// with a transaction spending 1000 and paying fee if fee is non-zero
+func balancedBlock(fee, coinbase uint64) *Block {
+	b := new(Block)
+	b.Header.Height = 5
+	b.Outputs = append(b.Outputs, Output{Features: CoinbaseOutput, Commit: pedersen(7, coinbase)})
+	b.Kernels = append(b.Kernels, TxKernel{Features: CoinbaseKernel, Excess: excess(7)})
+
+	if fee > 0 {
+		b.Inputs = append(b.Inputs, Input{Commit: pedersen(11, 1000)})
+		b.Outputs = append(b.Outputs, Output{Commit: pedersen(20, 1000-fee)})
+		b.Kernels = append(b.Kernels, TxKernel{Excess: excess(20 - 11), Fee: fee})
+	}
+
+	return b
+}
+
+func TestKernelSumsBalance(t *testing.T) {
+	reward := BlockReward(5)
+	tests := []struct {
+		name     string
+		fee      uint64
+		coinbase uint64
+		ok       bool
+	}{
+		{"no fees", 0, reward, true},
+		{"fees", 8, reward + 8, true},
+		{"no fees, coinbase above reward", 0, reward + 1, false},
+		{"fees not collected", 8, reward, false},
+	}
+
+	for _, tt := range tests {
+		if ok := kernelSumsBalance(balancedBlock(tt.fee, tt.coinbase)); ok != tt.ok {
+			t.Errorf("%s: got %v, want %v", tt.name, ok, tt.ok)
+		}
+	}
+}
+
+func TestKernelSumsFeeOverflow(t *testing.T) {
+	b := balancedBlock(8, BlockReward(5)+8)
+	b.Kernels = append(b.Kernels, TxKernel{Fee: ^uint64(0)})
+
+	if kernelSumsBalance(b) {
+		t.Error("block with overflowing fees balances")
+	}
+}
+
+// headerChain returns n headers from genesis each meeting the difficulty
+// adjusted over the ones before, with the difficulty window of them
+func headerChain(t *testing.T, n int) ([]*BlockHeader, *DifficultyWindow) {
+	window := NewDifficultyWindow(MainnetParams)
+	var headers []*BlockHeader
+
+	prev := &BlockHeader{Timestamp: 1e9}
+	for i := 0; i < n; i++ {
+		h := &BlockHeader{
+			Height:    uint64(i),
+			Timestamp: prev.Timestamp + BlockTimeSec/2,
+			Bits:      CompactFromTarget(window.Next().Target()),
+		}
+		if i > 0 {
+			h.Previous = prev.Hash()
+		}
+
+		diff, err := h.Difficulty()
+		if err != nil {
+			t.Fatal(err)
+		}
+		window.Push(h.Timestamp, diff)
+
+		headers = append(headers, h)
+		prev = h
+	}
+
+	return headers, window
+}
+
+// nextHeader returns header following prev meeting window difficulty
+func nextHeader(prev *BlockHeader, window *DifficultyWindow) *BlockHeader {
+	return &BlockHeader{
+		Height:    prev.Height + 1,
+		Previous:  prev.Hash(),
+		Timestamp: prev.Timestamp + BlockTimeSec,
+		Bits:      CompactFromTarget(window.Next().Target()),
+	}
+}
+
+func TestValidateHeaderChain(t *testing.T) {
+	headers, window := headerChain(t, 40)
+	prev := headers[len(headers)-1]
+
+	valid := nextHeader(prev, window)
+	if err := ValidateHeaderChain([]*BlockHeader{valid}, prev, window); err != nil {
+		t.Fatalf("valid header: %v", err)
+	}
+
+	broken := nextHeader(prev, window)
+	broken.Previous[0] ^= 1
+	if err := ValidateHeaderChain([]*BlockHeader{broken}, prev, window); err != ErrBrokenLinkage {
+		t.Errorf("broken linkage: got %v, want %v", err, ErrBrokenLinkage)
+	}
+
+	wrong := nextHeader(prev, window)
+	wrong.Bits = CompactFromTarget((window.Next() * 2).Target())
+	if err := ValidateHeaderChain([]*BlockHeader{wrong}, prev, window); err != ErrWrongDifficulty {
+		t.Errorf("wrong difficulty: got %v, want %v", err, ErrWrongDifficulty)
+	}
+
+	old := nextHeader(prev, window)
+	old.Timestamp = headers[len(headers)-int(MedianTimeWindow)].Timestamp
+	if err := ValidateHeaderChain([]*BlockHeader{old}, prev, window); err != ErrTimestampTooOld {
+		t.Errorf("old timestamp: got %v, want %v", err, ErrTimestampTooOld)
+	}
+
+	// window of the caller is left as it was
+	if err := ValidateHeaderChain([]*BlockHeader{valid}, prev, window); err != nil {
+		t.Errorf("valid header after failed ones: %v", err)
+	}
+}
+
+func TestCanonicalOrder(t *testing.T) {
+	var (
+		inputs  []Input
+		outputs []Output
+		kernels []TxKernel
+	)
+	for i := uint64(1); i <= 5; i++ {
+		inputs = append(inputs, Input{Commit: pedersen(i, 1000)})
+		outputs = append(outputs, Output{Commit: pedersen(i+10, 1000)})
+		kernels = append(kernels, TxKernel{Fee: i})
+	}
+
+	SortInputs(inputs)
+	SortOutputs(outputs)
+	SortKernels(kernels)
+	if !CanonicalOrder(inputs, outputs, kernels) {
+		t.Fatal("sorted lists are not in canonical order")
+	}
+
+	// sorted list is left as it is
+	sorted := append([]TxKernel(nil), kernels...)
+	SortKernels(sorted)
+	for i := range sorted {
+		if sorted[i] != kernels[i] {
+			t.Fatalf("sorting sorted kernels moved kernel %d", i)
+		}
+	}
+
+	// swapping the last two elements of any list breaks the order
+	swapped := append([]Input(nil), inputs...)
+	swapped[3], swapped[4] = swapped[4], swapped[3]
+	if CanonicalOrder(swapped, outputs, kernels) {
+		t.Error("shuffled inputs are in canonical order")
+	}
+
+	swappedOutputs := append([]Output(nil), outputs...)
+	swappedOutputs[3], swappedOutputs[4] = swappedOutputs[4], swappedOutputs[3]
+	if CanonicalOrder(inputs, swappedOutputs, kernels) {
+		t.Error("shuffled outputs are in canonical order")
+	}
+
+	swappedKernels := append([]TxKernel(nil), kernels...)
+	swappedKernels[3], swappedKernels[4] = swappedKernels[4], swappedKernels[3]
+	if CanonicalOrder(inputs, outputs, swappedKernels) {
+		t.Error("shuffled kernels are in canonical order")
+	}
+
+	b := &Block{Inputs: swapped, Outputs: outputs, Kernels: kernels}
+	if err := ValidateBlock(b); err != ErrNonCanonicalOrder {
+		t.Errorf("block with shuffled inputs: got %v, want %v", err, ErrNonCanonicalOrder)
+	}
+
+	// the helpers restore the order of shuffled lists
+	SortInputs(swapped)
+	SortOutputs(swappedOutputs)
+	SortKernels(swappedKernels)
+	if !CanonicalOrder(swapped, swappedOutputs, swappedKernels) {
+		t.Error("shuffled lists are not in canonical order once sorted")
+	}
+}
+
+func TestValidateTxAgainstChain(t *testing.T) {
+	coinbase, regular := pedersen(1, 60), pedersen(2, 60)
+	lookup := func(commit Commitment) (uint64, bool, bool) {
+		switch commit {
+		case coinbase:
+			return 100, true, true
+		case regular:
+			return 100, false, true
+		}
+		return 0, false, false
+	}
+
+	tests := []struct {
+		name   string
+		input  Commitment
+		height uint64
+		lock   uint64
+		err    error
+	}{
+		{"immature coinbase", coinbase, 100 + CoinbaseMaturity - 1, 0, ErrImmatureCoinbase},
+		{"mature coinbase", coinbase, 100 + CoinbaseMaturity, 0, nil},
+		{"regular output", regular, 101, 0, nil},
+		{"unknown output", pedersen(3, 60), 101, 0, ErrUnknownInput},
+		{"locked kernel", regular, 101, 102, ErrKernelLocked},
+		{"unlocked kernel", regular, 102, 102, nil},
+	}
+
+	for _, tt := range tests {
+		tx := &Transaction{
+			Inputs:  []Input{{Commit: tt.input}},
+			Kernels: []TxKernel{{LockHeight: tt.lock}},
+		}
+
+		if err := ValidateTxAgainstChain(tx, tt.height, lookup); err != tt.err {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestDuplicateCommitments(t *testing.T) {
+	repeated := balancedBlock(8, BlockReward(5)+8)
+	repeated.Inputs = append(repeated.Inputs, repeated.Inputs[0])
+
+	spent := balancedBlock(8, BlockReward(5)+8)
+	spent.Outputs = append(spent.Outputs, Output{Commit: spent.Inputs[0].Commit})
+
+	tests := []struct {
+		name string
+		b    *Block
+		err  error
+	}{
+		{"repeated input", repeated, ErrDuplicateInput},
+		{"output of spent input", spent, ErrOutputSpentInBlock},
+	}
+
+	for _, tt := range tests {
+		SortInputs(tt.b.Inputs)
+		SortOutputs(tt.b.Outputs)
+		SortKernels(tt.b.Kernels)
+
+		if err := ValidateBlock(tt.b); err != tt.err {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestValidateFutureTimestamp(t *testing.T) {
+	const now = 1e9
+	drift := time.Duration(MaxFutureDrift) * time.Second
+
+	tests := []struct {
+		name      string
+		timestamp uint64
+		err       error
+	}{
+		{"past", now - 1, nil},
+		{"now", now, nil},
+		{"at drift", now + MaxFutureDrift, nil},
+		{"past drift", now + MaxFutureDrift + 1, ErrFutureTimestamp},
+	}
+
+	clock := NewMockClock(time.Unix(now, 0))
+	for _, tt := range tests {
+		if err := ValidateFutureTimestamp(tt.timestamp, now, drift); err != tt.err {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+
+		// the rest of the empty block is invalid, so only the future
+		// timestamp error is checked
+		b := &Block{Header: BlockHeader{Timestamp: tt.timestamp}}
+		if err := ValidateBlockWithClock(b, clock); (err == ErrFutureTimestamp) != (tt.err != nil) {
+			t.Errorf("%s block: got %v", tt.name, err)
+		}
+	}
+}
+
+func TestCoinbaseValue(t *testing.T) {
+	reward := BlockReward(5)
+	tests := []struct {
+		name  string
+		fees  uint64
+		value uint64
+		ok    bool
+	}{
+		{"no fees", 0, reward, true},
+		{"fees", 8, reward + 8, true},
+		{"fees overflow", ^uint64(0) - reward + 1, 0, false},
+	}
+
+	for _, tt := range tests {
+		value, ok := CoinbaseValue(5, tt.fees)
+		if ok != tt.ok || (ok && value != tt.value) {
+			t.Errorf("%s: got %d, %v, want %d, %v", tt.name, value, ok, tt.value, tt.ok)
+		}
+	}
+}
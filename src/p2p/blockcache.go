@@ -0,0 +1,124 @@
+package p2p
+
+import (
+	"consensus"
+	"container/list"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// ErrBlockNotFound is sent in Reject of requested block we don't have
+var ErrBlockNotFound = errors.New("block not found")
+
+// BlockSource gives blocks served to peers asking for them
+type BlockSource interface {
+	// GetBlock returns block by hash, nil if unknown
+	GetBlock(hash consensus.Hash) *consensus.Block
+}
+
+// cachedBlock is a serialized block
+type cachedBlock struct {
+	hash consensus.Hash
+	data []byte
+}
+
+// BlockCache keeps recently served blocks serialized so peers asking for
+// the same block don't make us serialize it again. When full the least
+// recently used block is evicted.
+type BlockCache struct {
+	sync.Mutex
+
+	source BlockSource
+	max    int
+	// elements of lru by block hash
+	blocks map[consensus.Hash]*list.Element
+	// cached blocks from the most recently used one
+	lru *list.List
+	// incremented by Invalidate, blocks fetched before are not cached
+	generation uint64
+}
+
+// NewBlockCache creates cache of at most max blocks taken from source
+func NewBlockCache(source BlockSource, max int) *BlockCache {
+	return &BlockCache{
+		source: source,
+		max:    max,
+		blocks: make(map[consensus.Hash]*list.Element),
+		lru:    list.New(),
+	}
+}
+
+// Get returns serialized block by hash, from cache or from the block source.
+// The block is fetched and serialized without holding the lock.
+func (c *BlockCache) Get(hash consensus.Hash) ([]byte, bool) {
+	c.Lock()
+	if el, ok := c.blocks[hash]; ok {
+		c.lru.MoveToFront(el)
+		data := el.Value.(*cachedBlock).data
+		c.Unlock()
+		return data, true
+	}
+	generation := c.generation
+	c.Unlock()
+
+	b := c.source.GetBlock(hash)
+	if b == nil {
+		return nil, false
+	}
+	data := b.Bytes()
+
+	c.Lock()
+	defer c.Unlock()
+
+	// chain reorganized meanwhile, the block may be gone from it
+	if c.generation != generation {
+		return data, true
+	}
+
+	// fetched concurrently by another peer
+	if el, ok := c.blocks[hash]; ok {
+		c.lru.MoveToFront(el)
+		return el.Value.(*cachedBlock).data, true
+	}
+
+	c.blocks[hash] = c.lru.PushFront(&cachedBlock{hash: hash, data: data})
+
+	if c.lru.Len() > c.max {
+		oldest := c.lru.Remove(c.lru.Back()).(*cachedBlock)
+		delete(c.blocks, oldest.hash)
+	}
+
+	return data, true
+}
+
+// Invalidate drops all cached blocks, must be called on chain reorg
+func (c *BlockCache) Invalidate() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.blocks = make(map[consensus.Hash]*list.Element)
+	c.lru.Init()
+	c.generation++
+}
+
+// rawBlock is a block message sent as already serialized data
+type rawBlock []byte
+
+// Bytes implements Message interface
+func (b *rawBlock) Bytes() []byte {
+	return *b
+}
+
+// Type implements Message interface
+func (b *rawBlock) Type() uint8 {
+	return consensus.MsgTypeBlock
+}
+
+// Read implements Message interface
+func (b *rawBlock) Read(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	*b = data
+	return err
+}
@@ -0,0 +1,63 @@
+package p2p
+
+import (
+	"consensus"
+	"testing"
+)
+
+// blockingSource serves blocks once release is closed
+type blockingSource struct {
+	blocks  map[consensus.Hash]*consensus.Block
+	fetched chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingSource) GetBlock(hash consensus.Hash) *consensus.Block {
+	s.fetched <- struct{}{}
+	<-s.release
+	return s.blocks[hash]
+}
+
+func TestBlockCacheGet(t *testing.T) {
+	b := &consensus.Block{Header: consensus.BlockHeader{Height: 1}}
+	hash := b.Header.Hash()
+
+	source := &blockingSource{
+		blocks:  map[consensus.Hash]*consensus.Block{hash: b},
+		fetched: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	c := NewBlockCache(source, 8)
+
+	done := make(chan bool)
+	go func() {
+		_, ok := c.Get(hash)
+		done <- ok
+	}()
+	<-source.fetched
+
+	// lock is not held while the source is fetching
+	c.Invalidate()
+	close(source.release)
+
+	if !<-done {
+		t.Fatal("block not found")
+	}
+
+	if c.lru.Len() != 0 {
+		t.Error("block fetched before Invalidate was cached")
+	}
+
+	if _, ok := c.Get(hash); !ok {
+		t.Fatal("block not found")
+	}
+	<-source.fetched
+
+	if c.lru.Len() != 1 {
+		t.Error("block was not cached")
+	}
+
+	if _, ok := c.Get(consensus.Hash{}); ok {
+		t.Error("unknown block found")
+	}
+}
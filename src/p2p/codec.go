@@ -0,0 +1,267 @@
+package p2p
+
+import (
+	"bufio"
+	"bytes"
+	"consensus"
+	"fmt"
+	"io"
+)
+
+// messageTypes creates empty message by type
+var messageTypes = map[uint8]func() Message{
+	consensus.MsgTypeError:        func() Message { return new(PeerError) },
+	consensus.MsgTypeHand:         func() Message { return new(hand) },
+	consensus.MsgTypeShake:        func() Message { return new(shake) },
+	consensus.MsgTypePing:         func() Message { return new(Ping) },
+	consensus.MsgTypePong:         func() Message { return new(Pong) },
+	consensus.MsgTypeGetPeerAddrs: func() Message { return new(GetPeerAddrs) },
+	consensus.MsgTypePeerAddrs:    func() Message { return new(PeerAddrs) },
+	consensus.MsgTypeGetHeaders:   func() Message { return new(GetHeaders) },
+	consensus.MsgTypeHeaders:      func() Message { return new(Headers) },
+	consensus.MsgTypeGetBlock:     func() Message { return new(GetBlockHash) },
+	consensus.MsgTypeBlock:        func() Message { return new(consensus.Block) },
+	consensus.MsgTypeTransaction:  func() Message { return new(consensus.Transaction) },
+	consensus.MsgTypeCompactBlock: func() Message { return new(CompactBlock) },
+	consensus.MsgTypeGetTip:       func() Message { return new(GetTip) },
+	consensus.MsgTypeTip:          func() Message { return new(Tip) },
+	consensus.MsgTypeSetFilter:    func() Message { return new(SetFilter) },
+	consensus.MsgTypeReject:       func() Message { return new(Reject) },
+	consensus.MsgTypeInv:          func() Message { return new(Inv) },
+	consensus.MsgTypePeerAddrsV2:  func() Message { return new(PeerAddrsV2) },
+	consensus.MsgTypeGetUTXOSet:   func() Message { return new(GetUTXOSet) },
+	consensus.MsgTypeUTXOSetChunk: func() Message { return new(UTXOSetChunk) },
+}
+
+// newMessage creates empty message of type typ
+func newMessage(typ uint8) (Message, error) {
+	create, ok := messageTypes[typ]
+	if !ok {
+		return nil, fmt.Errorf("unknown message type %d", typ)
+	}
+
+	return create(), nil
+}
+
+// maxRetainedBuf is the largest body buffer Decoder keeps for reuse, the
+// buffer of larger bodies is dropped after the message
+const maxRetainedBuf = 64 * 1024
+
+// Decoder reads consecutive protocol messages from a stream
+type Decoder struct {
+	r *bufio.Reader
+
+	// body buffer reused across messages
+	buf []byte
+	// maximum length of message body, zero for MaxMsgLen
+	maxLen uint64
+	// messages are framed without the magic code
+	trusted bool
+}
+
+// NewDecoder creates decoder reading from r
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{
+		r: bufio.NewReader(r),
+	}
+}
+
+// SetTrusted sets framing of trusted transports (e.g. local IPC between
+// node and wallet): headers carry no magic code, just type and length. The
+// encoder of the remote must use the same framing.
+func (d *Decoder) SetTrusted(trusted bool) {
+	d.trusted = trusted
+}
+
+// SetMaxMessageLen limits length of message bodies accepted from the
+// remote, compressed or decompressed, as returned by negotiateMaxMsgLen.
+// Zero means MaxMsgLen.
+func (d *Decoder) SetMaxMessageLen(n uint64) {
+	d.maxLen = n
+}
+
+// Next reads the next message header and body and returns the decoded message
+func (d *Decoder) Next() (Message, error) {
+	var header Header
+	if d.trusted {
+		if err := header.readFrame(d.r); err != nil {
+			return nil, err
+		}
+	} else if err := header.Read(d.r); err != nil {
+		return nil, err
+	}
+
+	maxLen := d.maxLen
+	if maxLen == 0 {
+		maxLen = consensus.MaxMsgLen
+	}
+
+	if header.Len > maxLen {
+		return nil, ErrMessageTooBig
+	}
+
+	msg, err := newMessage(header.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := d.readBody(header.Len)
+	if err != nil {
+		return nil, err
+	}
+
+	countMessage(header.Type, Inbound)
+	if !header.Compressed {
+		return msg, msg.Read(bytes.NewReader(body))
+	}
+
+	r, err := decompressBody(bytes.NewReader(body), maxLen)
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, msg.Read(r)
+}
+
+// readBody reads body of n bytes. Buffer grows as the bytes arrive, so a
+// header announcing large body doesn't allocate it before it's sent.
+func (d *Decoder) readBody(n uint64) ([]byte, error) {
+	if n <= uint64(cap(d.buf)) {
+		body := d.buf[:n]
+		if _, err := io.ReadFull(d.r, body); err != nil {
+			return nil, err
+		}
+
+		return body, nil
+	}
+
+	buff := bytes.NewBuffer(d.buf[:0])
+	read, err := buff.ReadFrom(io.LimitReader(d.r, int64(n)))
+	if err != nil {
+		return nil, err
+	}
+
+	if uint64(read) < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	if buff.Cap() <= maxRetainedBuf {
+		d.buf = buff.Bytes()
+	}
+
+	return buff.Bytes(), nil
+}
+
+// Encoder writes protocol messages to a stream through one buffered writer
+type Encoder struct {
+	cw *countingWriter
+	w  *bufio.Writer
+
+	// compress large message bodies
+	compress bool
+	// maximum length of message body, zero for MaxMsgLen
+	maxLen uint64
+	// messages are framed without the magic code
+	trusted bool
+}
+
+// NewEncoder creates encoder writing to w
+func NewEncoder(w io.Writer) *Encoder {
+	cw := &countingWriter{w: w}
+	return &Encoder{
+		cw: cw,
+		w:  bufio.NewWriter(cw),
+	}
+}
+
+// SetCompression enables compression of message bodies above
+// compressThreshold, remote must have CapCompression
+func (e *Encoder) SetCompression(enabled bool) {
+	e.compress = enabled
+}
+
+// SetTrusted sets framing of trusted transports, see Decoder.SetTrusted
+func (e *Encoder) SetTrusted(trusted bool) {
+	e.trusted = trusted
+}
+
+// writeHeader writes header framed as set by SetTrusted
+func (e *Encoder) writeHeader(header *Header) error {
+	if e.trusted {
+		return header.writeFrame(e.w)
+	}
+
+	return header.Write(e.w)
+}
+
+// SetMaxMessageLen limits length of message bodies the remote accepts,
+// zero means MaxMsgLen
+func (e *Encoder) SetMaxMessageLen(n uint64) {
+	e.maxLen = n
+}
+
+// Encode frames and buffers msg, Flush must be called to write it out.
+// Message above the length limit fails with ErrMessageTooBig and nothing
+// is written, once it fails otherwise the encoder must not be reused.
+func (e *Encoder) Encode(msg Message) error {
+	maxLen := e.maxLen
+	if maxLen == 0 {
+		maxLen = consensus.MaxMsgLen
+	}
+
+	// the remote limits decompressed bodies as well, so the limit applies
+	// before compression
+	data := msg.Bytes()
+	if uint64(len(data)) > maxLen {
+		return ErrMessageTooBig
+	}
+
+	if e.compress && len(data) > compressThreshold {
+		if compressed := compressBody(data); len(compressed) < len(data) {
+			header := Header{
+				magic:      consensus.MagicCode,
+				Type:       msg.Type(),
+				Len:        uint64(len(compressed)),
+				Compressed: true,
+			}
+
+			if err := e.writeHeader(&header); err != nil {
+				return err
+			}
+
+			if _, err := e.w.Write(compressed); err != nil {
+				return err
+			}
+
+			countMessage(msg.Type(), Outbound)
+			return nil
+		}
+	}
+
+	header := Header{
+		magic: consensus.MagicCode,
+		Type:  msg.Type(),
+		Len:   uint64(len(data)),
+	}
+
+	if err := e.writeHeader(&header); err != nil {
+		return err
+	}
+
+	if _, err := e.w.Write(data); err != nil {
+		return err
+	}
+
+	countMessage(msg.Type(), Outbound)
+	return nil
+}
+
+// Flush writes buffered messages to the underlying writer
+func (e *Encoder) Flush() error {
+	return e.w.Flush()
+}
+
+// Written returns number of bytes written to the underlying writer
+func (e *Encoder) Written() uint64 {
+	return e.cw.n
+}
@@ -0,0 +1,211 @@
+package p2p
+
+import (
+	"bytes"
+	"consensus"
+	"io"
+	"testing"
+)
+
+func TestDecoderTruncatedBody(t *testing.T) {
+	header := Header{
+		magic: consensus.MagicCode,
+		Type:  consensus.MsgTypePing,
+		Len:   consensus.MaxMsgLen,
+	}
+
+	buff := new(bytes.Buffer)
+	if err := header.Write(buff); err != nil {
+		t.Fatal(err)
+	}
+	buff.Write(make([]byte, 100))
+
+	dec := NewDecoder(buff)
+	if _, err := dec.Next(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("truncated body returned %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+
+	if cap(dec.buf) > maxRetainedBuf {
+		t.Errorf("decoder retained %d bytes buffer", cap(dec.buf))
+	}
+}
+
+func TestDecoderRetainedBuffer(t *testing.T) {
+	buff := new(bytes.Buffer)
+	enc := NewEncoder(buff)
+	msgs := []Message{
+		&Ping{Nonce: 1},
+		&PeerError{Code: 1, Message: string(make([]byte, 2*maxRetainedBuf))},
+		&Ping{Nonce: 2},
+	}
+	for _, msg := range msgs {
+		if err := enc.Encode(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := enc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	dec := NewDecoder(buff)
+	for i, want := range msgs {
+		msg, err := dec.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(msg.Bytes(), want.Bytes()) {
+			t.Errorf("message %d decoded as %v", i, msg)
+		}
+
+		if cap(dec.buf) > maxRetainedBuf {
+			t.Errorf("decoder retained %d bytes buffer after message %d", cap(dec.buf), i)
+		}
+	}
+}
+
+func TestDecoderMaxMessageLen(t *testing.T) {
+	msg := &PeerError{Code: 1, Message: string(make([]byte, 4*compressThreshold))}
+
+	for _, compress := range []bool{false, true} {
+		buff := new(bytes.Buffer)
+		enc := NewEncoder(buff)
+		enc.SetCompression(compress)
+		if err := enc.Encode(msg); err != nil {
+			t.Fatal(err)
+		}
+		if err := enc.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		dec := NewDecoder(buff)
+		dec.SetMaxMessageLen(negotiateMaxMsgLen(2 * compressThreshold))
+		if _, err := dec.Next(); err != ErrMessageTooBig {
+			t.Errorf("compressed %v: message above negotiated length returned %v, want %v", compress, err, ErrMessageTooBig)
+		}
+	}
+}
+
+func TestDecoderConsecutiveMessages(t *testing.T) {
+	buff := new(bytes.Buffer)
+	for _, v := range messageVectors {
+		if _, err := WriteMessage(buff, v.msg); err != nil {
+			t.Fatalf("%s: %v", v.name, err)
+		}
+	}
+
+	dec := NewDecoder(buff)
+	for _, v := range messageVectors {
+		msg, err := dec.Next()
+		if err != nil {
+			t.Fatalf("%s: %v", v.name, err)
+		}
+
+		if msg.Type() != v.msg.Type() || !bytes.Equal(msg.Bytes(), v.msg.Bytes()) {
+			t.Errorf("%s decoded as %T %v", v.name, msg, msg)
+		}
+	}
+
+	if _, err := dec.Next(); err != io.EOF {
+		t.Errorf("decoding past the last message returned %v, want %v", err, io.EOF)
+	}
+}
+
+func BenchmarkDecoderNext(b *testing.B) {
+	buff := new(bytes.Buffer)
+	for i := 0; i < 100; i++ {
+		if _, err := WriteMessage(buff, &Ping{TotalDifficulty: 1000, Height: uint64(i), Nonce: uint64(i)}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	stream := buff.Bytes()
+	r := bytes.NewReader(stream)
+	dec := NewDecoder(r)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(stream) / 100))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%100 == 0 {
+			r.Reset(stream)
+		}
+
+		if _, err := dec.Next(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestEncoderDecoderRoundTrip(t *testing.T) {
+	buff := new(bytes.Buffer)
+	enc := NewEncoder(buff)
+	for _, v := range messageVectors {
+		if err := enc.Encode(v.msg); err != nil {
+			t.Fatalf("%s: %v", v.name, err)
+		}
+	}
+	if err := enc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := enc.Written(); n != uint64(buff.Len()) {
+		t.Errorf("encoder reports %d bytes written, %d written", n, buff.Len())
+	}
+
+	dec := NewDecoder(buff)
+	for _, v := range messageVectors {
+		msg, err := dec.Next()
+		if err != nil {
+			t.Fatalf("%s: %v", v.name, err)
+		}
+
+		if msg.Type() != v.msg.Type() || !bytes.Equal(msg.Bytes(), v.msg.Bytes()) {
+			t.Errorf("%s decoded as %T %v", v.name, msg, msg)
+		}
+	}
+
+	if _, err := dec.Next(); err != io.EOF {
+		t.Errorf("decoding past the last message returned %v, want %v", err, io.EOF)
+	}
+}
+
+func TestTrustedFraming(t *testing.T) {
+	for _, encTrusted := range []bool{false, true} {
+		for _, decTrusted := range []bool{false, true} {
+			buff := new(bytes.Buffer)
+			enc := NewEncoder(buff)
+			enc.SetTrusted(encTrusted)
+			for _, v := range messageVectors {
+				if err := enc.Encode(v.msg); err != nil {
+					t.Fatalf("%s: %v", v.name, err)
+				}
+			}
+			if err := enc.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			dec := NewDecoder(buff)
+			dec.SetTrusted(decTrusted)
+
+			if encTrusted != decTrusted {
+				if msg, err := dec.Next(); err == nil {
+					t.Errorf("trusted encoder %v, decoder %v: decoded %T %v, want error", encTrusted, decTrusted, msg, msg)
+				}
+				continue
+			}
+
+			for _, v := range messageVectors {
+				msg, err := dec.Next()
+				if err != nil {
+					t.Fatalf("trusted %v: %s: %v", encTrusted, v.name, err)
+				}
+				if msg.Type() != v.msg.Type() || !bytes.Equal(msg.Bytes(), v.msg.Bytes()) {
+					t.Errorf("trusted %v: %s decoded as %T %v", encTrusted, v.name, msg, msg)
+				}
+			}
+			if _, err := dec.Next(); err != io.EOF {
+				t.Errorf("trusted %v: decoding past the last message returned %v, want %v", encTrusted, err, io.EOF)
+			}
+		}
+	}
+}
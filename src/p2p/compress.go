@@ -0,0 +1,55 @@
+package p2p
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	// msgFlagCompressed is set in the header message type when the body is
+	// compressed, message types themselves stay below it
+	msgFlagCompressed uint8 = 0x80
+	// compressThreshold is the minimum body size worth compressing
+	compressThreshold = 16 * 1024
+)
+
+// compressBody returns data compressed with flate
+func compressBody(data []byte) []byte {
+	buff := new(bytes.Buffer)
+
+	// writing to bytes.Buffer never fails, nor does a valid level
+	fw, err := flate.NewWriter(buff, flate.DefaultCompression)
+	if err != nil {
+		panic(err)
+	}
+
+	if _, err := fw.Write(data); err != nil {
+		panic(err)
+	}
+
+	if err := fw.Close(); err != nil {
+		panic(err)
+	}
+
+	return buff.Bytes()
+}
+
+// decompressBody reads compressed body from r. Decompressed size is limited
+// by maxLen so a small body can't expand to exhaust memory.
+func decompressBody(r io.Reader, maxLen uint64) (io.Reader, error) {
+	fr := flate.NewReader(r)
+	defer fr.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(fr, int64(maxLen)+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if uint64(len(data)) > maxLen {
+		return nil, ErrMessageTooBig
+	}
+
+	return bytes.NewReader(data), nil
+}
@@ -0,0 +1,75 @@
+package p2p
+
+import (
+	"bytes"
+	"consensus"
+	"testing"
+)
+
+// largeBlock returns block of n kernels
+func largeBlock(n int) *consensus.Block {
+	b := new(consensus.Block)
+	b.Header.Height = 42
+	for i := 0; i < n; i++ {
+		b.Kernels = append(b.Kernels, consensus.TxKernel{Fee: uint64(i)})
+	}
+
+	return b
+}
+
+func TestCompressedBlockRoundTrip(t *testing.T) {
+	block := largeBlock(1000)
+	body := block.Bytes()
+
+	buff := new(bytes.Buffer)
+	enc := NewEncoder(buff)
+	enc.SetCompression(true)
+	if err := enc.Encode(block); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var header Header
+	if err := header.Read(bytes.NewReader(buff.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if !header.Compressed || header.Len >= uint64(len(body)) {
+		t.Fatalf("block of %d bytes sent as %d bytes, compressed %v", len(body), header.Len, header.Compressed)
+	}
+
+	msg, err := NewDecoder(buff).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type() != consensus.MsgTypeBlock || !bytes.Equal(msg.Bytes(), body) {
+		t.Error("decompressed block differs from the sent one")
+	}
+}
+
+func TestZipBombRejected(t *testing.T) {
+	// tiny body expanding above the maximum message length
+	bomb := compressBody(make([]byte, consensus.MaxMsgLen+1))
+	header := Header{
+		magic:      consensus.MagicCode,
+		Type:       consensus.MsgTypeBlock,
+		Len:        uint64(len(bomb)),
+		Compressed: true,
+	}
+
+	buff := new(bytes.Buffer)
+	if err := header.Write(buff); err != nil {
+		t.Fatal(err)
+	}
+	buff.Write(bomb)
+	data := buff.Bytes()
+
+	if _, err := ReadMessage(bytes.NewReader(data), new(consensus.Block)); err != ErrMessageTooBig {
+		t.Errorf("ReadMessage: got %v, want %v", err, ErrMessageTooBig)
+	}
+
+	if _, err := NewDecoder(bytes.NewReader(data)).Next(); err != ErrMessageTooBig {
+		t.Errorf("Decoder: got %v, want %v", err, ErrMessageTooBig)
+	}
+}
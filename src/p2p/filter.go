@@ -0,0 +1,126 @@
+package p2p
+
+import (
+	"bytes"
+	"consensus"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	// maxFilterSize maximum size of bloom filter in bytes
+	maxFilterSize = 36000
+	// maxFilterHashes maximum number of hash functions of bloom filter
+	maxFilterHashes = 50
+)
+
+// BloomFilter is a probabilistic set of transaction ids. MayContain never
+// reports false for an inserted id, but may report true for ids which were
+// never inserted.
+type BloomFilter struct {
+	// number of hash functions
+	hashes uint8
+	bits   []byte
+}
+
+// NewBloomFilter creates empty filter of size bytes using hashes hash functions
+func NewBloomFilter(size int, hashes uint8) *BloomFilter {
+	return &BloomFilter{
+		hashes: hashes,
+		bits:   make([]byte, size),
+	}
+}
+
+// bitIndex returns index of the bit set for id by i-th hash function. Ids
+// are hashes already, so two halves of id give independent hashes combined
+// by double hashing.
+func (f *BloomFilter) bitIndex(id consensus.Hash, i uint8) uint64 {
+	h1 := binary.BigEndian.Uint64(id[0:8])
+	h2 := binary.BigEndian.Uint64(id[8:16])
+
+	return (h1 + uint64(i)*h2) % uint64(len(f.bits)*8)
+}
+
+// Insert adds id to the filter
+func (f *BloomFilter) Insert(id consensus.Hash) {
+	if len(f.bits) == 0 {
+		return
+	}
+
+	for i := uint8(0); i < f.hashes; i++ {
+		n := f.bitIndex(id, i)
+		f.bits[n/8] |= 1 << (n % 8)
+	}
+}
+
+// MayContain checks whether id may have been inserted to the filter
+func (f *BloomFilter) MayContain(id consensus.Hash) bool {
+	if len(f.bits) == 0 {
+		return false
+	}
+
+	for i := uint8(0); i < f.hashes; i++ {
+		n := f.bitIndex(id, i)
+		if f.bits[n/8]&(1<<(n%8)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// SetFilter sets filter of transactions known by the sender, transactions
+// the filter may contain are not relayed to it. Empty filter clears it.
+type SetFilter struct {
+	Filter BloomFilter
+}
+
+// Bytes implements Message interface
+func (m *SetFilter) Bytes() []byte {
+	buff := new(bytes.Buffer)
+
+	if err := binary.Write(buff, binary.BigEndian, m.Filter.hashes); err != nil {
+		panic(err)
+	}
+
+	if err := binary.Write(buff, binary.BigEndian, uint32(len(m.Filter.bits))); err != nil {
+		panic(err)
+	}
+
+	if _, err := buff.Write(m.Filter.bits); err != nil {
+		panic(err)
+	}
+
+	return buff.Bytes()
+}
+
+// Type implements Message interface
+func (m *SetFilter) Type() uint8 {
+	return consensus.MsgTypeSetFilter
+}
+
+// Read implements Message interface
+func (m *SetFilter) Read(r io.Reader) error {
+
+	if err := binary.Read(r, binary.BigEndian, &m.Filter.hashes); err != nil {
+		return err
+	}
+
+	if m.Filter.hashes > maxFilterHashes {
+		return fmt.Errorf("too many filter hashes: %d > %d", m.Filter.hashes, maxFilterHashes)
+	}
+
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return err
+	}
+
+	if size > maxFilterSize {
+		return fmt.Errorf("too big filter: %d > %d", size, maxFilterSize)
+	}
+
+	m.Filter.bits = make([]byte, size)
+	_, err := io.ReadFull(r, m.Filter.bits)
+	return err
+}
@@ -0,0 +1,88 @@
+package p2p
+
+import (
+	"bytes"
+	"consensus"
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+)
+
+// testID returns transaction id derived from n
+func testID(n int) consensus.Hash {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(n))
+	return sha256.Sum256(buf[:])
+}
+
+func TestBloomFilterNoFalseNegatives(t *testing.T) {
+	const n = 2000
+	f := NewBloomFilter(2048, 6)
+	for i := 0; i < n; i++ {
+		f.Insert(testID(i))
+	}
+
+	for i := 0; i < n; i++ {
+		if !f.MayContain(testID(i)) {
+			t.Fatalf("inserted id %d not in the filter", i)
+		}
+	}
+
+	// roughly 2% false positives at this size, far below all
+	var positives int
+	for i := n; i < 2*n; i++ {
+		if f.MayContain(testID(i)) {
+			positives++
+		}
+	}
+	if positives > n/10 {
+		t.Errorf("%d of %d ids never inserted are reported", positives, n)
+	}
+
+	if empty := NewBloomFilter(0, 6); empty.MayContain(testID(0)) {
+		t.Error("empty filter reports id")
+	}
+}
+
+func TestSetFilterRoundTrip(t *testing.T) {
+	msg := &SetFilter{Filter: *NewBloomFilter(64, 3)}
+	msg.Filter.Insert(testID(1))
+
+	var got SetFilter
+	r := bytes.NewReader(msg.Bytes())
+	if err := got.Read(r); err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Len() != 0 || got.Filter.hashes != msg.Filter.hashes || !bytes.Equal(got.Filter.bits, msg.Filter.bits) {
+		t.Errorf("filter read as %+v with %d bytes left, want %+v", got.Filter, r.Len(), msg.Filter)
+	}
+	if !got.Filter.MayContain(testID(1)) {
+		t.Error("read filter lost inserted id")
+	}
+
+	tooBig := &SetFilter{Filter: *NewBloomFilter(maxFilterSize+1, 3)}
+	if err := new(SetFilter).Read(bytes.NewReader(tooBig.Bytes())); err == nil {
+		t.Error("filter above maximum size read")
+	}
+}
+
+func TestPeerFilter(t *testing.T) {
+	p, remote := pipePeer(t)
+	p.Start()
+
+	tx := &consensus.Transaction{Kernels: []consensus.TxKernel{{Fee: 8}}}
+	filter := NewBloomFilter(64, 3)
+	filter.Insert(tx.Hash())
+
+	if _, err := WriteMessage(remote, &SetFilter{Filter: *filter}); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "filter set", func() bool { return p.knowsTransaction(tx) })
+
+	// empty filter clears it
+	if _, err := WriteMessage(remote, new(SetFilter)); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "filter cleared", func() bool { return !p.knowsTransaction(tx) })
+}
@@ -5,11 +5,22 @@ import (
 	"consensus"
 	"encoding/binary"
 	"bytes"
-	"github.com/sirupsen/logrus"
 	"io"
 	"errors"
+	"encoding/hex"
+	"golang.org/x/crypto/blake2b"
+	"math/rand"
 )
 
+// ErrWrongNetwork is returned when peer genesis block differs from ours
+var ErrWrongNetwork = errors.New("peer is on another network")
+
+// ErrSelfConnection is returned when handshake comes from our own node
+var ErrSelfConnection = errors.New("connected to self")
+
+// localCapabilities are capabilities advertised in handshake
+const localCapabilities = consensus.CapFullNode | consensus.CapCompression | consensus.CapPeerAddrsV2
+
 // First part of a handshake, sender advertises its version and
 // characteristics.
 type hand struct {
@@ -17,11 +28,16 @@ type hand struct {
 	Version uint32
 	// Capabilities of the sender
 	Capabilities consensus.Capabilities
-	// randomly generated for each handshake, helps detect self
+	// random nonce of the sender process, the same in all its handshakes,
+	// identifies the sender and detects connections to self
 	Nonce uint64
 	// total difficulty accumulated by the sender, used to check whether sync
 	// may be needed
 	TotalDifficulty consensus.Difficulty
+	// hash of the genesis block of the sender network
+	Genesis consensus.Hash
+	// maximum message length the sender accepts
+	MaxMsgLen uint64
 	// network address of the sender
 	SenderAddr   *net.TCPAddr
 	ReceiverAddr *net.TCPAddr
@@ -31,71 +47,40 @@ type hand struct {
 }
 
 func (h *hand) Bytes() []byte {
-	logrus.Info("hand struct to bytes")
+	logger.Debug("hand struct to bytes")
 	buff := new(bytes.Buffer)
 
 	if err := binary.Write(buff, binary.BigEndian, h.Version); err != nil {
-		logrus.Fatal(err)
+		panic(err)
 	}
 
 	if err := binary.Write(buff, binary.BigEndian, uint32(h.Capabilities)); err != nil {
-		logrus.Fatal(err)
+		panic(err)
 	}
 
 	if err := binary.Write(buff, binary.BigEndian, h.Nonce); err != nil {
-		logrus.Fatal(err)
+		panic(err)
 	}
 
 	if err := binary.Write(buff, binary.BigEndian, uint64(h.TotalDifficulty)); err != nil {
-		logrus.Fatal(err)
+		panic(err)
 	}
 
-	// Write Sender addr
-	switch len(h.SenderAddr.IP) {
-	case net.IPv4len:
-		{
-			if _, err := buff.Write([]byte{0}); err != nil {
-				logrus.Fatal(err)
-			}
-		}
-	case net.IPv6len:
-		{
-			if _, err := buff.Write([]byte{1}); err != nil {
-				logrus.Fatal(err)
-			}
-		}
-	default:
-		logrus.Fatal("invalid netaddr")
-	}
+	buff.Write(h.Genesis[:])
 
-	if _, err := buff.Write(h.SenderAddr.IP); err != nil {
-		logrus.Fatal(err)
+	if err := binary.Write(buff, binary.BigEndian, h.MaxMsgLen); err != nil {
+		panic(err)
 	}
 
-	binary.Write(buff, binary.BigEndian, uint16(h.SenderAddr.Port))
-
-	// Write Recv addr
-	switch len(h.ReceiverAddr.IP) {
-	case net.IPv4len:
-		{
-			if _, err := buff.Write([]byte{0}); err != nil {
-				logrus.Fatal(err)
-			}
-		}
-	case net.IPv6len:
-		{
-			if _, err := buff.Write([]byte{1}); err != nil {
-				logrus.Fatal(err)
-			}
-		}
-	default:
-		logrus.Fatal("invalid netaddr")
+	// Write Sender addr
+	if err := WriteNetAddr(buff, h.SenderAddr); err != nil {
+		panic(err)
 	}
 
-	if _, err := buff.Write(h.ReceiverAddr.IP); err != nil {
-		logrus.Fatal(err)
+	// Write Recv addr
+	if err := WriteNetAddr(buff, h.ReceiverAddr); err != nil {
+		panic(err)
 	}
-	binary.Write(buff, binary.BigEndian, uint16(h.ReceiverAddr.Port))
 
 	// Write user agent [len][string]
 	binary.Write(buff, binary.BigEndian, uint64(len(h.UserAgent)))
@@ -130,61 +115,26 @@ func (h *hand) Read(r io.Reader) error {
 		return err
 	}
 
-	// read Sender addr
-	var ipFlag int8
-	var ipAddr []byte
-	var ipPort uint16
-
-	if err := binary.Read(r, binary.BigEndian, &ipFlag); err != nil {
+	if _, err := io.ReadFull(r, h.Genesis[:]); err != nil {
 		return err
 	}
 
-	if ipFlag == 0 {
-		// for ipv4 addr
-		ipAddr = make([]byte, net.IPv4len)
-	} else {
-		// for ipv6 addr
-		ipAddr = make([]byte, net.IPv6len)
-	}
-
-	if _, err := io.ReadFull(r, ipAddr); err != nil {
+	if err := binary.Read(r, binary.BigEndian, &h.MaxMsgLen); err != nil {
 		return err
 	}
 
-	if err := binary.Read(r, binary.BigEndian, &ipPort); err != nil {
+	// read Sender addr
+	addr, err := ReadNetAddr(r)
+	if err != nil {
 		return err
 	}
-
-	h.SenderAddr = &net.TCPAddr{
-		IP: ipAddr,
-		Port: int(ipPort),
-	}
+	h.SenderAddr = addr
 
 	// read Recv addr
-	if err := binary.Read(r, binary.BigEndian, &ipFlag); err != nil {
-		return err
-	}
-
-	if ipFlag == 0 {
-		// for ipv4 addr
-		ipAddr = make([]byte, net.IPv4len)
-	} else {
-		// for ipv6 addr
-		ipAddr = make([]byte, net.IPv6len)
-	}
-
-	if _, err := io.ReadFull(r, ipAddr); err != nil {
-		return err
-	}
-
-	if err := binary.Read(r, binary.BigEndian, &ipPort); err != nil {
+	if addr, err = ReadNetAddr(r); err != nil {
 		return err
 	}
-
-	h.ReceiverAddr = &net.TCPAddr{
-		IP: ipAddr,
-		Port: int(ipPort),
-	}
+	h.ReceiverAddr = addr
 
 	// read user agent
 	var userAgentLen uint64
@@ -192,7 +142,11 @@ func (h *hand) Read(r io.Reader) error {
 		return err
 	}
 
-	logrus.Debug("userAgentlen: ", userAgentLen)
+	logger.Debug("userAgentlen: ", userAgentLen)
+
+	if remaining, ok := bodyRemaining(r); ok && userAgentLen > remaining {
+		return ErrLengthMismatch
+	}
 
 	buff := make([]byte, userAgentLen)
 	if _, err := io.ReadFull(r, buff); err != nil {
@@ -210,28 +164,45 @@ type shake struct {
 	Version uint32
 	// capabilities of the sender
 	Capabilities consensus.Capabilities
+	// random nonce of the sender process, the same in all its handshakes,
+	// identifies the sender and detects connections to self
+	Nonce uint64
 	// total difficulty accumulated by the sender, used to check whether sync
 	// may be needed
 	TotalDifficulty consensus.Difficulty
+	// hash of the genesis block of the sender network
+	Genesis consensus.Hash
+	// maximum message length the sender accepts
+	MaxMsgLen uint64
 
 	// name of version of the software
 	UserAgent string
 }
 
 func (h *shake) Bytes() []byte {
-	logrus.Info("shake struct to bytes")
+	logger.Debug("shake struct to bytes")
 	buff := new(bytes.Buffer)
 
 	if err := binary.Write(buff, binary.BigEndian, h.Version); err != nil {
-		logrus.Fatal(err)
+		panic(err)
 	}
 
 	if err := binary.Write(buff, binary.BigEndian, uint32(h.Capabilities)); err != nil {
-		logrus.Fatal(err)
+		panic(err)
+	}
+
+	if err := binary.Write(buff, binary.BigEndian, h.Nonce); err != nil {
+		panic(err)
 	}
 
 	if err := binary.Write(buff, binary.BigEndian, uint64(h.TotalDifficulty)); err != nil {
-		logrus.Fatal(err)
+		panic(err)
+	}
+
+	buff.Write(h.Genesis[:])
+
+	if err := binary.Write(buff, binary.BigEndian, h.MaxMsgLen); err != nil {
+		panic(err)
 	}
 
 	// Write user agent [len][string]
@@ -259,16 +230,32 @@ func (h *shake) Read(r io.Reader) error {
 		return err
 	}
 
+	if err := binary.Read(r, binary.BigEndian, &h.Nonce); err != nil {
+		return err
+	}
+
 	if err := binary.Read(r, binary.BigEndian, (*uint64)(&h.TotalDifficulty)); err != nil {
 		return err
 	}
 
+	if _, err := io.ReadFull(r, h.Genesis[:]); err != nil {
+		return err
+	}
+
+	if err := binary.Read(r, binary.BigEndian, &h.MaxMsgLen); err != nil {
+		return err
+	}
+
 	var userAgentLen uint64
 	if err := binary.Read(r, binary.BigEndian, &userAgentLen); err != nil {
 		return err
 	}
 
-	logrus.Debug("userAgentlen: ", userAgentLen)
+	logger.Debug("userAgentlen: ", userAgentLen)
+
+	if remaining, ok := bodyRemaining(r); ok && userAgentLen > remaining {
+		return ErrLengthMismatch
+	}
 
 	buff := make([]byte, userAgentLen)
 	if _, err := io.ReadFull(r, buff); err != nil {
@@ -279,62 +266,159 @@ func (h *shake) Read(r io.Reader) error {
 	return nil
 }
 
-// shakeByHand sends hand to receive shake
-func shakeByHand(conn net.Conn) (*shake, error) {
+// PeerID identifies peer node across connections, it's derived from the
+// nonce and user agent the peer presented in handshake
+type PeerID [8]byte
+
+// newPeerID derives PeerID from handshake nonce and user agent
+func newPeerID(nonce uint64, userAgent string) PeerID {
+	buff := make([]byte, 8, 8+len(userAgent))
+	binary.BigEndian.PutUint64(buff, nonce)
+	buff = append(buff, userAgent...)
+
+	var id PeerID
+	sum := blake2b.Sum256(buff)
+	copy(id[:], sum[:])
+	return id
+}
+
+// String returns hex form of the id
+func (id PeerID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// localNonce is sent in every hand and shake of this process, so remotes
+// derive the same PeerID for all our connections and detect duplicates
+var localNonce = handshakeNonce()
+
+// handshakeNonce returns random non-zero nonce sent in handshake
+func handshakeNonce() uint64 {
+	for {
+		if nonce := rand.Uint64(); nonce != 0 {
+			return nonce
+		}
+	}
+}
+
+// tcpAddr returns addr as TCP address, connections over other transports
+// (e.g. net.Pipe) are advertised with unspecified address
+func tcpAddr(addr net.Addr) *net.TCPAddr {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp
+	}
+
+	return &net.TCPAddr{IP: net.IPv4zero}
+}
+
+// negotiateMaxMsgLen returns maximum message length of connection with
+// remote accepting messages up to remote length: the smaller of both limits,
+// ours if remote sent none
+func negotiateMaxMsgLen(remote uint64) uint64 {
+	if remote == 0 || remote > consensus.MaxMsgLen {
+		return consensus.MaxMsgLen
+	}
+
+	return remote
+}
+
+// checkGenesis checks remote genesis hash is ours, otherwise the remote is
+// on another network and is sent PeerError before the connection is closed
+func checkGenesis(conn net.Conn, genesis consensus.Hash) error {
+	if genesis == consensus.DefaultNetwork().GenesisHash() {
+		return nil
+	}
+
+	sendPeerError(conn, ErrCodeWrongNetwork, ErrWrongNetwork.Error())
+	conn.Close()
+	return ErrWrongNetwork
+}
+
+// shakeByHand sends hand to receive shake, advertising listenPort as the
+// sender port unless it's zero
+func shakeByHand(conn net.Conn, listenPort uint16) (*shake, error) {
 
-	logrus.Info("start peer shakeByHand")
+	logger.Info("start peer shakeByHand")
 	// create hand
-	sender := conn.LocalAddr().(*net.TCPAddr)
-	receiver := conn.RemoteAddr().(*net.TCPAddr)
-	nonce := uint64(1)
+	sender := tcpAddr(conn.LocalAddr())
+	if listenPort != 0 {
+		sender = &net.TCPAddr{IP: sender.IP, Port: int(listenPort), Zone: sender.Zone}
+	}
+	receiver := tcpAddr(conn.RemoteAddr())
+
+	// link-local peers can't be advertised in hand
+	if err := validateNetAddr(sender); err != nil {
+		return nil, err
+	}
+
+	if err := validateNetAddr(receiver); err != nil {
+		return nil, err
+	}
 
 	msg := hand {
 		Version:         consensus.ProtocolVersion,
-		Capabilities:    consensus.CapFullNode,
-		Nonce:           nonce,
+		Capabilities:    localCapabilities,
+		Nonce:           localNonce,
 		TotalDifficulty: consensus.Difficulty(1),
+		Genesis:         consensus.DefaultNetwork().GenesisHash(),
+		MaxMsgLen:       consensus.MaxMsgLen,
 		SenderAddr:      sender,
 		ReceiverAddr:    receiver,
 		UserAgent:       userAgent,
 	}
 
-	logrus.Info("send hand to peer")
+	logger.Debug("send hand to peer")
 	// Send own hand
 	if _, err := WriteMessage(conn, &msg); err != nil {
 		return nil, err
 	}
 
-	logrus.Info("recv shake from peer")
+	logger.Debug("recv shake from peer")
 
 	// Read peer shake
-	// TODO: check nonce
 	sh := new(shake)
-	if _, err := ReadMessage(conn, sh); err != nil {
+	if _, err := readConnMessage(conn, sh); err != nil {
 		return nil, err
 	}
-	logrus.Debug("receive shake: ", sh)
+	logger.Debug("receive shake: ", sh)
+
+	if err := checkGenesis(conn, sh.Genesis); err != nil {
+		return nil, err
+	}
+
+	if sh.Nonce == localNonce {
+		return nil, ErrSelfConnection
+	}
 
 	return sh, nil
 }
 
-// handByShake sends shake and return received hand
-func handByShake(conn net.Conn) (*hand, error) {
+// handByShake sends shake with our nonce and return received hand
+func handByShake(conn net.Conn, nonce uint64) (*hand, error) {
 
-	logrus.Info("start peer shakeByHand")
+	logger.Info("start peer handByShake")
 	var h hand
 	// Recv remote hand
-	if _, err := ReadMessage(conn, &h); err != nil {
+	if _, err := readConnMessage(conn, &h); err != nil {
 		return nil, err
 	}
 
-	logrus.Debug("receive shake: ", h)
+	logger.Debug("receive hand: ", h)
+
+	if err := checkGenesis(conn, h.Genesis); err != nil {
+		return nil, err
+	}
+
+	if h.Nonce == nonce {
+		return nil, ErrSelfConnection
+	}
 
-	// Read peer shake
-	// TODO: check nonce
 	msg := shake {
 		Version: consensus.ProtocolVersion,
-		Capabilities: consensus.CapFullNode,
+		Capabilities: localCapabilities,
+		Nonce: nonce,
 		TotalDifficulty: consensus.Difficulty(1),
+		Genesis: consensus.DefaultNetwork().GenesisHash(),
+		MaxMsgLen: consensus.MaxMsgLen,
 		UserAgent: userAgent,
 
 	}
@@ -0,0 +1,233 @@
+package p2p
+
+import (
+	"consensus"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestHandshakeNonceStable(t *testing.T) {
+	for i := 0; i < 2; i++ {
+		local, remote := net.Pipe()
+
+		shaken := make(chan *shake, 1)
+		go func() {
+			defer local.Close()
+
+			sh, err := shakeByHand(local, 0)
+			if err != nil {
+				t.Error(err)
+			}
+			shaken <- sh
+		}()
+
+		// remote is another node presenting its own nonce
+		h, err := handByShake(remote, ^localNonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sh := <-shaken
+		remote.Close()
+
+		if h.Nonce != localNonce {
+			t.Errorf("hand nonce %d, want %d", h.Nonce, localNonce)
+		}
+		if sh != nil && sh.Nonce != ^localNonce {
+			t.Errorf("shake nonce %d, want %d", sh.Nonce, ^localNonce)
+		}
+	}
+}
+
+func TestSelfConnection(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	go shakeByHand(local, 0)
+	if _, err := handByShake(remote, localNonce); err != ErrSelfConnection {
+		t.Errorf("accepting our own hand: got %v, want %v", err, ErrSelfConnection)
+	}
+
+	local, remote = net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	// remote answers with our own nonce
+	go func() {
+		if _, err := ReadMessage(remote, new(hand)); err != nil {
+			return
+		}
+		WriteMessage(remote, remoteShake(localNonce))
+	}()
+	if _, err := shakeByHand(local, 0); err != ErrSelfConnection {
+		t.Errorf("dialing node shaking with our nonce: got %v, want %v", err, ErrSelfConnection)
+	}
+}
+
+func TestSameNonceSamePeer(t *testing.T) {
+	// accept connection from remote node presenting nonce
+	accept := func(nonce uint64) *Peer {
+		local, remote := net.Pipe()
+		t.Cleanup(func() {
+			local.Close()
+			remote.Close()
+		})
+
+		go func() {
+			if _, err := WriteMessage(remote, remoteHand(nonce, remote.LocalAddr(), remote.RemoteAddr())); err != nil {
+				return
+			}
+			ReadMessage(remote, new(shake))
+		}()
+
+		p, err := AcceptNewPeer(local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	first, second, other := accept(1), accept(1), accept(2)
+	if first.PeerID() != second.PeerID() {
+		t.Errorf("connections presenting the same nonce have ids %v and %v", first.PeerID(), second.PeerID())
+	}
+	if first.PeerID() == other.PeerID() {
+		t.Errorf("connections presenting different nonces have the same id %v", first.PeerID())
+	}
+
+	ps := NewPeerSet()
+	if !ps.Add(first) {
+		t.Fatal("first connection of the peer not added")
+	}
+	if ps.Add(second) {
+		t.Error("second connection of the same peer added")
+	}
+	if !ps.Add(other) {
+		t.Error("connection of another peer not added")
+	}
+}
+
+// expectWrongNetwork reads PeerError of ErrCodeWrongNetwork followed by
+// closed connection from conn
+func expectWrongNetwork(t *testing.T, conn net.Conn) {
+	t.Helper()
+	var perr PeerError
+	if _, err := ReadMessage(conn, &perr); err != nil {
+		t.Fatal(err)
+	}
+	if perr.Code != ErrCodeWrongNetwork {
+		t.Errorf("PeerError code %d, want %d", perr.Code, ErrCodeWrongNetwork)
+	}
+	if _, err := ReadMessage(conn, new(Ping)); err != io.EOF {
+		t.Errorf("read after PeerError: got %v, want %v", err, io.EOF)
+	}
+}
+
+func TestWrongNetworkRejected(t *testing.T) {
+	other := consensus.Hash{0xee}
+	result := make(chan error, 1)
+
+	// our hand answered with shake of another network
+	local, remote := net.Pipe()
+	defer remote.Close()
+	go func() {
+		_, err := shakeByHand(local, 0)
+		result <- err
+	}()
+	if _, err := ReadMessage(remote, new(hand)); err != nil {
+		t.Fatal(err)
+	}
+	sh := remoteShake(^localNonce)
+	sh.Genesis = other
+	if _, err := WriteMessage(remote, sh); err != nil {
+		t.Fatal(err)
+	}
+	expectWrongNetwork(t, remote)
+	if err := <-result; err != ErrWrongNetwork {
+		t.Errorf("shake of another network: got %v, want %v", err, ErrWrongNetwork)
+	}
+
+	// hand of another network
+	local, remote = net.Pipe()
+	defer remote.Close()
+	go func() {
+		_, err := handByShake(local, localNonce)
+		result <- err
+	}()
+	addr := &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 3414}
+	h := remoteHand(^localNonce, addr, addr)
+	h.Genesis = other
+	if _, err := WriteMessage(remote, h); err != nil {
+		t.Fatal(err)
+	}
+	expectWrongNetwork(t, remote)
+	if err := <-result; err != ErrWrongNetwork {
+		t.Errorf("hand of another network: got %v, want %v", err, ErrWrongNetwork)
+	}
+}
+
+func TestNegotiatedMaxMessageLen(t *testing.T) {
+	const remoteMax = 4 * compressThreshold
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	accepted := make(chan *Peer, 1)
+	go func() {
+		p, err := acceptPeer(local, localNonce)
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- p
+	}()
+
+	addr := &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 3414}
+	h := remoteHand(^localNonce, addr, addr)
+	h.Capabilities |= consensus.CapCompression
+	h.MaxMsgLen = remoteMax
+	if _, err := WriteMessage(remote, h); err != nil {
+		t.Fatal(err)
+	}
+	var sh shake
+	if _, err := ReadMessage(remote, &sh); err != nil {
+		t.Fatal(err)
+	}
+
+	p := <-accepted
+	if p == nil {
+		t.FailNow()
+	}
+	defer p.Close()
+	if sh.MaxMsgLen != consensus.MaxMsgLen {
+		t.Errorf("advertised %d, want %d", sh.MaxMsgLen, consensus.MaxMsgLen)
+	}
+	if n := p.MaxMessageLen(); n != remoteMax {
+		t.Fatalf("negotiated %d, want the smaller %d", n, remoteMax)
+	}
+	p.Start()
+
+	// message above the remote limit isn't sent even if it compresses below
+	big := &PeerError{Code: ErrCodeBadMessage, Message: strings.Repeat("x", remoteMax)}
+	if err := p.Send(big); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Send(&Ping{Nonce: 1}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := NewDecoder(remote).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type() != consensus.MsgTypePing {
+		t.Errorf("received %T, want the Ping following the skipped message", msg)
+	}
+
+	// message above the limit from remote is rejected as well, its body
+	// isn't read
+	go WriteMessage(remote, big)
+	var perr PeerError
+	if _, err := ReadMessage(remote, &perr); err != nil || perr.Code != ErrCodeBadMessage {
+		t.Errorf("message above the limit answered with %+v, %v, want PeerError %d", perr, err, ErrCodeBadMessage)
+	}
+}
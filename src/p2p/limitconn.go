@@ -0,0 +1,184 @@
+package p2p
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tokenBucket is a simple token bucket refilled at rate tokens per second
+// holding at most burst tokens.
+type tokenBucket struct {
+	sync.Mutex
+
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket creates full bucket
+func newTokenBucket(rate, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// refill adds tokens accumulated since last call, must be called with lock held
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// take removes n tokens from the bucket and returns how long caller
+// should wait until the tokens are actually available.
+func (b *tokenBucket) take(n int) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+
+	b.refill()
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// allow takes one token if available
+func (b *tokenBucket) allow() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// LimitedConn is net.Conn limiting read and write bandwidth and counting
+// transferred bytes.
+type LimitedConn struct {
+	net.Conn
+
+	// The following fields are only meant to be used *atomically*
+	bytesRead    uint64
+	bytesWritten uint64
+
+	reader *tokenBucket
+	writer *tokenBucket
+
+	// closed on Close to cut throttling waits short
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewLimitedConn wraps c limiting reads to readBps and writes to writeBps
+// bytes per second. Zero or negative limit means unlimited.
+func NewLimitedConn(c net.Conn, readBps, writeBps int) net.Conn {
+	lc := &LimitedConn{Conn: c, closed: make(chan struct{})}
+
+	if readBps > 0 {
+		lc.reader = newTokenBucket(readBps, readBps)
+	}
+
+	if writeBps > 0 {
+		lc.writer = newTokenBucket(writeBps, writeBps)
+	}
+
+	return lc
+}
+
+// Read implements net.Conn interface
+func (c *LimitedConn) Read(b []byte) (int, error) {
+	if c.reader != nil && len(b) > int(c.reader.burst) {
+		b = b[:int(c.reader.burst)]
+	}
+
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(&c.bytesRead, uint64(n))
+
+	if c.reader != nil && n > 0 {
+		c.wait(c.reader.take(n))
+	}
+
+	return n, err
+}
+
+// Write implements net.Conn interface
+func (c *LimitedConn) Write(b []byte) (int, error) {
+	if c.writer == nil {
+		n, err := c.Conn.Write(b)
+		atomic.AddUint64(&c.bytesWritten, uint64(n))
+		return n, err
+	}
+
+	var written int
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > int(c.writer.burst) {
+			chunk = chunk[:int(c.writer.burst)]
+		}
+
+		if !c.wait(c.writer.take(len(chunk))) {
+			return written, net.ErrClosed
+		}
+
+		n, err := c.Conn.Write(chunk)
+		atomic.AddUint64(&c.bytesWritten, uint64(n))
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		b = b[n:]
+	}
+
+	return written, nil
+}
+
+// Close implements net.Conn interface, pending Read and Write return
+// without waiting for their bandwidth share
+func (c *LimitedConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// wait waits for d unless the connection is closed meanwhile. Returns false
+// if it's closed.
+func (c *LimitedConn) wait(d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-c.closed:
+		return false
+	}
+}
+
+// BytesRead returns total bytes read from connection
+func (c *LimitedConn) BytesRead() uint64 {
+	return atomic.LoadUint64(&c.bytesRead)
+}
+
+// BytesWritten returns total bytes written to connection
+func (c *LimitedConn) BytesWritten() uint64 {
+	return atomic.LoadUint64(&c.bytesWritten)
+}
@@ -0,0 +1,35 @@
+package p2p
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLimitedConnWriteRate(t *testing.T) {
+	const rate = 100000
+
+	client, server := net.Pipe()
+	defer server.Close()
+	go io.Copy(io.Discard, server)
+
+	conn := NewLimitedConn(client, 0, rate).(*LimitedConn)
+	defer conn.Close()
+
+	// the first second worth of bytes is the burst, the rest is throttled
+	data := make([]byte, rate*3/2)
+	start := time.Now()
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+
+	if elapsed < 400*time.Millisecond || elapsed > time.Second {
+		t.Errorf("%d bytes written in %v at %d bytes/s, want about 500ms", len(data), elapsed, rate)
+	}
+
+	if n := conn.BytesWritten(); n != uint64(len(data)) {
+		t.Errorf("%d bytes counted, want %d", n, len(data))
+	}
+}
@@ -0,0 +1,51 @@
+package p2p
+
+import (
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Logger is used by the package to report what's going on
+type Logger interface {
+	Debug(args ...interface{})
+	Info(args ...interface{})
+	Warn(args ...interface{})
+	Error(args ...interface{})
+}
+
+// logger used by the package, forwards to the logger set by SetLogger
+var logger Logger = currentLogger{}
+
+// activeLogger set by SetLogger, logrus standard logger by default
+var activeLogger atomic.Pointer[Logger]
+
+func init() {
+	SetLogger(logrus.StandardLogger())
+}
+
+// SetLogger replaces the logger used by the package, safe for concurrent
+// use with running peers. Passing nil silences the package.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = nopLogger{}
+	}
+
+	activeLogger.Store(&l)
+}
+
+// currentLogger forwards to the logger set by SetLogger
+type currentLogger struct{}
+
+func (currentLogger) Debug(args ...interface{}) { (*activeLogger.Load()).Debug(args...) }
+func (currentLogger) Info(args ...interface{})  { (*activeLogger.Load()).Info(args...) }
+func (currentLogger) Warn(args ...interface{})  { (*activeLogger.Load()).Warn(args...) }
+func (currentLogger) Error(args ...interface{}) { (*activeLogger.Load()).Error(args...) }
+
+// nopLogger discards everything
+type nopLogger struct{}
+
+func (nopLogger) Debug(args ...interface{}) {}
+func (nopLogger) Info(args ...interface{})  {}
+func (nopLogger) Warn(args ...interface{})  {}
+func (nopLogger) Error(args ...interface{}) {}
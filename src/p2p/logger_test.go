@@ -0,0 +1,133 @@
+package p2p
+
+import (
+	"bytes"
+	"consensus"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestSetLoggerConcurrent(t *testing.T) {
+	defer SetLogger(logrus.StandardLogger())
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			logger.Debug("concurrent log")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			SetLogger(nil)
+			SetLogger(logrus.StandardLogger())
+		}
+	}()
+	wg.Wait()
+}
+
+// logEntry is a message logged at level
+type logEntry struct {
+	level string
+	msg   string
+}
+
+// captureLogger records logged messages
+type captureLogger struct {
+	mu      sync.Mutex
+	entries []logEntry
+}
+
+func (l *captureLogger) log(level string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, logEntry{level, fmt.Sprint(args...)})
+}
+
+func (l *captureLogger) Debug(args ...interface{}) { l.log("debug", args...) }
+func (l *captureLogger) Info(args ...interface{})  { l.log("info", args...) }
+func (l *captureLogger) Warn(args ...interface{})  { l.log("warn", args...) }
+func (l *captureLogger) Error(args ...interface{}) { l.log("error", args...) }
+
+// logged tells whether msg was logged at level
+func (l *captureLogger) logged(level, msg string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, e := range l.entries {
+		if e.level == level && e.msg == msg {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestSetLoggerCaptures(t *testing.T) {
+	capture := new(captureLogger)
+	SetLogger(capture)
+	defer SetLogger(logrus.StandardLogger())
+
+	var buf bytes.Buffer
+	if _, err := WriteMessage(&buf, &Ping{Height: 42}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadMessage(&buf, new(Ping)); err != nil {
+		t.Fatal(err)
+	}
+
+	p, _ := pipePeer(t)
+	p.Start()
+	p.Disconnect(errors.New("test reason"))
+
+	if !capture.logged("info", "Disconnect peer: test reason") {
+		t.Error("disconnect is not logged at info level")
+	}
+
+	header := Header{magic: consensus.MagicCode, Type: consensus.MsgTypePing, Len: 24}
+	if !capture.logged("debug", fmt.Sprint("got header: ", header)) {
+		t.Error("read header is not logged at debug level")
+	}
+
+	// nil logger discards messages
+	SetLogger(nil)
+	logger.Info("discarded")
+	if capture.logged("info", "discarded") {
+		t.Error("message logged after the logger was removed")
+	}
+}
+
+func TestEncodingLogsNoInfo(t *testing.T) {
+	capture := new(captureLogger)
+	SetLogger(capture)
+	defer SetLogger(logrus.StandardLogger())
+
+	for _, v := range messageVectors {
+		var buf bytes.Buffer
+		if _, err := WriteMessage(&buf, v.msg); err != nil {
+			t.Fatalf("%s: %v", v.name, err)
+		}
+		if _, err := ReadMessage(&buf, v.empty()); err != nil {
+			t.Fatalf("%s: %v", v.name, err)
+		}
+	}
+
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+
+	if len(capture.entries) == 0 {
+		t.Fatal("encoding logged nothing, the logger isn't used")
+	}
+
+	for _, e := range capture.entries {
+		if e.level != "debug" {
+			t.Errorf("encoding logged %q at %s level", e.msg, e.level)
+		}
+	}
+}
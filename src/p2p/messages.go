@@ -3,13 +3,47 @@ package p2p
 import (
 	"io"
 	"encoding/binary"
-	"github.com/sirupsen/logrus"
 	"consensus"
 	"bytes"
 	"net"
 	"errors"
+	"fmt"
+	"golang.org/x/crypto/blake2b"
+	"math/bits"
+	"math/rand"
 )
 
+const (
+	// maxPeerAddresses maximum number of peer addresses in PeerAddrs
+	maxPeerAddresses = 256
+	// maxHeaders maximum number of block headers in Headers
+	maxHeaders = 512
+	// maxInvItems maximum number of items in Inv
+	maxInvItems = 512
+	// maxLocatorHashes maximum number of hashes in GetHeaders locator
+	maxLocatorHashes = 32
+)
+
+var (
+	// ErrInvalidAddrFamily is returned when a net address flag is neither IPv4 nor IPv6
+	ErrInvalidAddrFamily = errors.New("invalid address family")
+	// ErrLengthMismatch is returned when a length inside message body exceeds the body
+	ErrLengthMismatch = errors.New("length exceeds message body")
+)
+
+// bodyRemaining returns number of unread body bytes if r knows it: readers
+// limited by header Len or in-memory bodies
+func bodyRemaining(r io.Reader) (uint64, bool) {
+	switch body := r.(type) {
+	case *io.LimitedReader:
+		return uint64(body.N), true
+	case interface{ Len() int }:
+		return uint64(body.Len()), true
+	}
+
+	return 0, false
+}
+
 // Header is header of any protocol message, used to identify incoming messages
 type Header struct {
 	// magic number
@@ -18,6 +52,8 @@ type Header struct {
 	Type uint8
 	// Len length of the message in bytes.
 	Len uint64
+	// Compressed body is compressed, sent as msgFlagCompressed bit of the type
+	Compressed bool
 }
 
 // Write writes header as binary data to writer
@@ -25,30 +61,65 @@ func (h *Header) Write(wr io.Writer) error {
 	if _, err := wr.Write(h.magic[:]); err != nil {
 		return err
 	}
-	if err := binary.Write(wr, binary.BigEndian, h.Type); err != nil {
+
+	return h.writeFrame(wr)
+}
+
+// writeFrame writes header type and length, without the magic code
+func (h *Header) writeFrame(wr io.Writer) error {
+	typ := h.Type
+	if h.Compressed {
+		typ |= msgFlagCompressed
+	}
+	if err := binary.Write(wr, binary.BigEndian, typ); err != nil {
 		return err
 	}
 
 	return binary.Write(wr, binary.BigEndian, h.Len)
 }
 
-// Read reads from reader & fill struct
+// Read reads from reader & fill struct. Returns io.EOF if r ends before the
+// header and io.ErrUnexpectedEOF if it ends within the header.
 func (h *Header) Read(r io.Reader) error {
 	if _, err := io.ReadFull(r, h.magic[:]); err != nil {
 		return err
 	}
 
-	logrus.Debug("got magic: ", h.magic[:])
+	logger.Debug("got magic: ", h.magic[:])
 
 	if !h.validateMagic() {
 		return errors.New("invalid magic code")
 	}
 
+	// connection closed after the magic cuts the header, unlike before it
+	if err := h.readFrame(r); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	return nil
+}
+
+// readFrame reads header type and length, without the magic code. Returns
+// io.EOF if r ends before the type and io.ErrUnexpectedEOF if it ends
+// within the length.
+func (h *Header) readFrame(r io.Reader) error {
 	if err := binary.Read(r, binary.BigEndian, &h.Type); err != nil {
 		return err
 	}
+	h.Compressed = h.Type&msgFlagCompressed != 0
+	h.Type &^= msgFlagCompressed
+
+	if err := binary.Read(r, binary.BigEndian, &h.Len); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
 
-	return binary.Read(r, binary.BigEndian, &h.Len)
+	return nil
 }
 
 // validateMagic verifies magic code
@@ -63,19 +134,25 @@ type Ping struct {
 	TotalDifficulty consensus.Difficulty
 	// total height
 	Height uint64
+	// random number identifying Ping, Pong echoes nonce of the Ping it answers
+	Nonce uint64
 }
 
 // Bytes implements Message interface
 func (p *Ping) Bytes() []byte {
-	logrus.Info("Ping/Pong struct to bytes")
+	logger.Debug("Ping/Pong struct to bytes")
 	buff := new(bytes.Buffer)
 
 	if err := binary.Write(buff, binary.BigEndian, uint64(p.TotalDifficulty)); err != nil {
-		logrus.Fatal(err)
+		panic(err)
 	}
 
 	if err := binary.Write(buff, binary.BigEndian, uint64(p.Height)); err != nil {
-		logrus.Fatal(err)
+		panic(err)
+	}
+
+	if err := binary.Write(buff, binary.BigEndian, p.Nonce); err != nil {
+		panic(err)
 	}
 
 	return buff.Bytes()
@@ -93,7 +170,19 @@ func (p *Ping) Read(r io.Reader) error {
 		return err
 	}
 
-	return binary.Read(r, binary.BigEndian, (*uint64)(&p.Height))
+	if err := binary.Read(r, binary.BigEndian, (*uint64)(&p.Height)); err != nil {
+		return err
+	}
+
+	return binary.Read(r, binary.BigEndian, &p.Nonce)
+}
+
+// PlausiblePing loosely checks that total difficulty of p could have been
+// accumulated at its height on network of params: every block above
+// genesis adds at least the minimum difficulty
+func PlausiblePing(p Ping, params consensus.NetworkParams) bool {
+	hi, lo := bits.Mul64(p.Height, params.MinimumDifficulty)
+	return hi == 0 && uint64(p.TotalDifficulty) >= lo
 }
 
 // Pong response same as Ping
@@ -114,11 +203,11 @@ type GetPeerAddrs struct {
 
 // Bytes implements Message interface
 func (p *GetPeerAddrs) Bytes() []byte {
-	logrus.Info("GetPeerAddrs struct to bytes")
+	logger.Debug("GetPeerAddrs struct to bytes")
 	buff := new(bytes.Buffer)
 
 	if err := binary.Write(buff, binary.BigEndian, uint32(p.Capabilities)); err != nil {
-		logrus.Fatal(err)
+		panic(err)
 	}
 
 	return buff.Bytes()
@@ -135,6 +224,20 @@ func (p *GetPeerAddrs) Read(r io.Reader) error {
 	return binary.Read(r, binary.BigEndian, (*uint32)(&p.Capabilities))
 }
 
+// Error codes sent in PeerError
+const (
+	// ErrCodeUnsupportedVersion peer protocol version is not supported
+	ErrCodeUnsupportedVersion = uint32(consensus.NetUnsupportedVersion)
+	// ErrCodeRateLimited peer sends too many messages
+	ErrCodeRateLimited uint32 = 101
+	// ErrCodeBadMessage peer sends malformed, oversized or unexpected message
+	ErrCodeBadMessage uint32 = 102
+	// ErrCodeShuttingDown node is shutting down
+	ErrCodeShuttingDown uint32 = 103
+	// ErrCodeWrongNetwork peer genesis block differs from ours
+	ErrCodeWrongNetwork uint32 = 104
+)
+
 // PeerError sending an error back (usually followed  by closing conn)
 type PeerError struct {
 	// error code
@@ -145,16 +248,16 @@ type PeerError struct {
 
 // Bytes implements Message interface
 func (p *PeerError) Bytes() []byte {
-	logrus.Info("GetPeerAddrs struct to bytes")
+	logger.Debug("PeerError struct to bytes")
 	buff := new(bytes.Buffer)
 
 	if err := binary.Write(buff, binary.BigEndian, uint32(p.Code)); err != nil {
-		logrus.Fatal(err)
+		panic(err)
 	}
 
 	// Write user agent [len][string]
 	if err := binary.Write(buff, binary.BigEndian, uint64(len(p.Message))); err != nil {
-		logrus.Fatal(err)
+		panic(err)
 	}
 	buff.WriteString(p.Message)
 	return buff.Bytes()
@@ -177,8 +280,13 @@ func (p *PeerError) Read(r io.Reader) error {
 		return err
 	}
 
-	logrus.Debug("messageLen: ", messageLen)
+	logger.Debug("messageLen: ", messageLen)
+
+	if remaining, ok := bodyRemaining(r); ok && messageLen > remaining {
+		return ErrLengthMismatch
+	}
 
+	// empty message is valid, reading no bytes succeeds
 	buff := make([]byte, messageLen)
 	if _, err := io.ReadFull(r, buff); err != nil {
 		return err
@@ -188,49 +296,180 @@ func (p *PeerError) Read(r io.Reader) error {
 	return nil
 }
 
-// PeerAddrs we know of that are fresh enough, in response to GetPeerAddrs
-type PeerAddrs struct {
-	peers []*net.TCPAddr
+// Reject codes sent in Reject
+const (
+	// RejectInvalid rejected item breaks consensus rules
+	RejectInvalid uint8 = 0x10
+	// RejectDuplicate rejected item is already known
+	RejectDuplicate uint8 = 0x12
+	// RejectNotFound requested block is not known
+	RejectNotFound uint8 = 0x13
+	// RejectLowFee rejected transaction fee is too low to be relayed
+	RejectLowFee uint8 = 0x42
+)
+
+// maxRejectReasonLen maximum length of Reject reason
+const maxRejectReasonLen = 256
+
+// RejectError is returned by gossip handler to reject received block or
+// transaction with code
+type RejectError struct {
+	Code   uint8
+	Reason string
+}
+
+// Error implements error interface
+func (e *RejectError) Error() string {
+	return e.Reason
+}
+
+// Reject tells peer its block or transaction was rejected. Unlike PeerError
+// the connection is kept.
+type Reject struct {
+	// type of the rejected message
+	MsgType uint8
+	// hash of the rejected block or transaction
+	Hash consensus.Hash
+	// reject code
+	Code uint8
+	// short human readable reason
+	Reason string
 }
 
 // Bytes implements Message interface
-func (p *PeerAddrs) Bytes() []byte {
-	logrus.Info("GetPeerAddrs struct to bytes")
+func (p *Reject) Bytes() []byte {
 	buff := new(bytes.Buffer)
 
-	if err := binary.Write(buff, binary.BigEndian, uint32(len(p.peers))); err != nil {
-		logrus.Fatal(err)
+	reason := p.Reason
+	if len(reason) > maxRejectReasonLen {
+		reason = reason[:maxRejectReasonLen]
 	}
 
-	for _, peerAddr := range p.peers {
-		// Write Sender addr
-		switch len(peerAddr.IP) {
-		case net.IPv4len:
-			{
-				if _, err := buff.Write([]byte{0}); err != nil {
-					logrus.Fatal(err)
-				}
-			}
-		case net.IPv6len:
-			{
-				if _, err := buff.Write([]byte{1}); err != nil {
-					logrus.Fatal(err)
-				}
-			}
-		default:
-			logrus.Fatal("invalid netaddr")
+	if err := binary.Write(buff, binary.BigEndian, p.MsgType); err != nil {
+		panic(err)
+	}
+
+	if _, err := buff.Write(p.Hash[:]); err != nil {
+		panic(err)
+	}
+
+	if err := binary.Write(buff, binary.BigEndian, p.Code); err != nil {
+		panic(err)
+	}
+
+	if err := binary.Write(buff, binary.BigEndian, uint16(len(reason))); err != nil {
+		panic(err)
+	}
+	buff.WriteString(reason)
+
+	return buff.Bytes()
+}
+
+// Type implements Message interface
+func (p *Reject) Type() uint8 {
+	return consensus.MsgTypeReject
+}
+
+// Read implements Message interface
+func (p *Reject) Read(r io.Reader) error {
+
+	if err := binary.Read(r, binary.BigEndian, &p.MsgType); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(r, p.Hash[:]); err != nil {
+		return err
+	}
+
+	if err := binary.Read(r, binary.BigEndian, &p.Code); err != nil {
+		return err
+	}
+
+	var reasonLen uint16
+	if err := binary.Read(r, binary.BigEndian, &reasonLen); err != nil {
+		return err
+	}
+
+	if reasonLen > maxRejectReasonLen {
+		return fmt.Errorf("too long reject reason: %d > %d", reasonLen, maxRejectReasonLen)
+	}
+
+	buff := make([]byte, reasonLen)
+	if _, err := io.ReadFull(r, buff); err != nil {
+		return err
+	}
+
+	p.Reason = string(buff)
+	return nil
+}
+
+// PeerAddrs we know of that are fresh enough, in response to GetPeerAddrs
+type PeerAddrs struct {
+	peers []*net.TCPAddr
+}
+
+// advertisedAddrs returns indexes of addrs to advertise, each taking extra
+// bytes besides the address. Link-local addresses are not advertised, IPv4
+// addresses go first as more of them fit the message.
+func advertisedAddrs(addrs []*net.TCPAddr, extra uint64) []int {
+	var ipv4, ipv6 []int
+	for i, peerAddr := range addrs {
+		if err := validateNetAddr(peerAddr); err != nil {
+			logger.Debug("skip peer addr: ", peerAddr, " ", err)
+			continue
 		}
 
-		if _, err := buff.Write(peerAddr.IP); err != nil {
-			logrus.Fatal(err)
+		if peerAddr.IP.To4() != nil {
+			ipv4 = append(ipv4, i)
+		} else {
+			ipv6 = append(ipv6, i)
 		}
+	}
 
-		binary.Write(buff, binary.BigEndian, uint16(peerAddr.Port))
+	// keep message under both count and size limits
+	size := uint64(4)
+	result := make([]int, 0, len(ipv4)+len(ipv6))
+	for _, i := range append(ipv4, ipv6...) {
+		addrSize := netAddrSize(addrs[i]) + extra
+		if len(result) == maxPeerAddresses || size+addrSize > consensus.MaxMsgLen {
+			break
+		}
+
+		size += addrSize
+		result = append(result, i)
 	}
 
+	return result
+}
+
+// Bytes implements Message interface
+func (p *PeerAddrs) Bytes() []byte {
+	logger.Debug("PeerAddrs struct to bytes")
+	buff := new(bytes.Buffer)
+
+	// writing to bytes.Buffer never fails
+	p.WriteTo(buff)
 	return buff.Bytes()
 }
 
+// WriteTo implements io.WriterTo interface
+func (p *PeerAddrs) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+
+	peers := advertisedAddrs(p.peers, 0)
+	if err := binary.Write(cw, binary.BigEndian, uint32(len(peers))); err != nil {
+		return int64(cw.n), err
+	}
+
+	for _, i := range peers {
+		if err := WriteNetAddr(cw, p.peers[i]); err != nil {
+			return int64(cw.n), err
+		}
+	}
+
+	return int64(cw.n), nil
+}
+
 // Type implements Message interface
 func (p *PeerAddrs) Type() uint8 {
 	return consensus.MsgTypePeerAddrs
@@ -240,42 +479,130 @@ func (p *PeerAddrs) Type() uint8 {
 func (p *PeerAddrs) Read(r io.Reader) error {
 
 	var peersCount uint32
-	var ipFlag int8
 
 	if err := binary.Read(r, binary.BigEndian, &peersCount); err != nil {
 		return err
 	}
 
+	if peersCount > maxPeerAddresses {
+		return fmt.Errorf("too many peer addresses: %d > %d", peersCount, maxPeerAddresses)
+	}
+
 	for i := uint32(0); i < peersCount; i++ {
-		if err := binary.Read(r, binary.BigEndian, &ipFlag); err != nil {
+		addr, err := ReadNetAddr(r)
+		if err != nil {
 			return err
 		}
 
-		var ipAddr []byte
-		var ipPort uint16
+		p.peers = append(p.peers, addr)
+	}
 
-		if ipFlag == 0 {
-			// for ipv4 addr
-			ipAddr = make([]byte, net.IPv4len)
-		} else {
-			// for ipv6 addr
-			ipAddr = make([]byte, net.IPv6len)
+	return nil
+}
+
+// MergePeerAddrs merges addresses collected from several peers, each
+// IP and port once, keeping at most maxPeerAddresses of them
+func MergePeerAddrs(lists ...PeerAddrs) PeerAddrs {
+	var merged PeerAddrs
+	seen := make(map[string]struct{})
+
+	for _, list := range lists {
+		for _, addr := range list.peers {
+			if len(merged.peers) == maxPeerAddresses {
+				return merged
+			}
+
+			key := addr.String()
+			if _, ok := seen[key]; ok {
+				continue
+			}
+
+			seen[key] = struct{}{}
+			merged.peers = append(merged.peers, addr)
 		}
+	}
 
-		if _, err := io.ReadFull(r, ipAddr); err != nil {
-			return err
+	return merged
+}
+
+// PeerAddr is peer address with capabilities the peer advertised
+type PeerAddr struct {
+	Addr         *net.TCPAddr
+	Capabilities consensus.Capabilities
+}
+
+// PeerAddrsV2 is PeerAddrs carrying capabilities of each peer, so the
+// capabilities filter of GetPeerAddrs is honored by the requester too. It's
+// sent to peers having CapPeerAddrsV2.
+type PeerAddrsV2 struct {
+	peers []PeerAddr
+}
+
+// Bytes implements Message interface
+func (p *PeerAddrsV2) Bytes() []byte {
+	buff := new(bytes.Buffer)
+
+	// writing to bytes.Buffer never fails
+	p.WriteTo(buff)
+	return buff.Bytes()
+}
+
+// WriteTo implements io.WriterTo interface
+func (p *PeerAddrsV2) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+
+	addrs := make([]*net.TCPAddr, len(p.peers))
+	for i := range p.peers {
+		addrs[i] = p.peers[i].Addr
+	}
+
+	peers := advertisedAddrs(addrs, 4)
+	if err := binary.Write(cw, binary.BigEndian, uint32(len(peers))); err != nil {
+		return int64(cw.n), err
+	}
+
+	for _, i := range peers {
+		if err := WriteNetAddr(cw, p.peers[i].Addr); err != nil {
+			return int64(cw.n), err
 		}
 
-		if err := binary.Read(r, binary.BigEndian, &ipPort); err != nil {
+		if err := binary.Write(cw, binary.BigEndian, uint32(p.peers[i].Capabilities)); err != nil {
+			return int64(cw.n), err
+		}
+	}
+
+	return int64(cw.n), nil
+}
+
+// Type implements Message interface
+func (p *PeerAddrsV2) Type() uint8 {
+	return consensus.MsgTypePeerAddrsV2
+}
+
+// Read implements Message interface
+func (p *PeerAddrsV2) Read(r io.Reader) error {
+
+	var peersCount uint32
+	if err := binary.Read(r, binary.BigEndian, &peersCount); err != nil {
+		return err
+	}
+
+	if peersCount > maxPeerAddresses {
+		return fmt.Errorf("too many peer addresses: %d > %d", peersCount, maxPeerAddresses)
+	}
+
+	for i := uint32(0); i < peersCount; i++ {
+		addr, err := ReadNetAddr(r)
+		if err != nil {
 			return err
 		}
 
-		addr := &net.TCPAddr{
-			IP: ipAddr,
-			Port: int(ipPort),
+		var caps uint32
+		if err := binary.Read(r, binary.BigEndian, &caps); err != nil {
+			return err
 		}
 
-		p.peers = append(p.peers, addr)
+		p.peers = append(p.peers, PeerAddr{Addr: addr, Capabilities: consensus.Capabilities(caps)})
 	}
 
 	return nil
@@ -283,12 +610,12 @@ func (p *PeerAddrs) Read(r io.Reader) error {
 
 // GetBlockHash is hash of block
 type GetBlockHash struct {
-	Hash consensus.BlockHash
+	Hash consensus.Hash
 }
 
 // Bytes implements Message interface
 func (h *GetBlockHash) Bytes() []byte {
-	return h.Hash[0:consensus.BlockHashSize]
+	return h.Hash[:]
 }
 
 // Type implements Message interface
@@ -299,9 +626,398 @@ func (h *GetBlockHash) Type() uint8 {
 // Read implements Message interface
 func (h *GetBlockHash) Read(r io.Reader) error {
 
-	hash := make([]byte, consensus.BlockHashSize)
-	_, err := io.ReadFull(r, hash)
+	_, err := io.ReadFull(r, h.Hash[:])
+	return err
+}
+
+// GetHeaders asks for block headers after the first hash of the locator
+// known by the remote peer
+type GetHeaders struct {
+	// hashes of known blocks, from the most recent one
+	Locator []consensus.Hash
+	// StopHash hash of the last header wanted, zero for a full batch
+	StopHash consensus.Hash
+}
+
+// Bytes implements Message interface, at most maxLocatorHashes of the
+// most recent locator hashes are written
+func (h *GetHeaders) Bytes() []byte {
+	buff := new(bytes.Buffer)
+
+	locator := h.Locator
+	if len(locator) > maxLocatorHashes {
+		locator = locator[:maxLocatorHashes]
+	}
+
+	if err := binary.Write(buff, binary.BigEndian, uint8(len(locator))); err != nil {
+		panic(err)
+	}
+
+	for _, hash := range locator {
+		buff.Write(hash[:])
+	}
+
+	buff.Write(h.StopHash[:])
+
+	return buff.Bytes()
+}
+
+// Type implements Message interface
+func (h *GetHeaders) Type() uint8 {
+	return consensus.MsgTypeGetHeaders
+}
+
+// Read implements Message interface
+func (h *GetHeaders) Read(r io.Reader) error {
+
+	var locatorLen uint8
+	if err := binary.Read(r, binary.BigEndian, &locatorLen); err != nil {
+		return err
+	}
+
+	if locatorLen > maxLocatorHashes {
+		return fmt.Errorf("too long locator: %d > %d", locatorLen, maxLocatorHashes)
+	}
+
+	h.Locator = make([]consensus.Hash, locatorLen)
+	for i := range h.Locator {
+		if _, err := io.ReadFull(r, h.Locator[i][:]); err != nil {
+			return err
+		}
+	}
 
-	h.Hash = hash
+	_, err := io.ReadFull(r, h.StopHash[:])
 	return err
-}
\ No newline at end of file
+}
+
+// truncateHeaders returns headers up to and including the one of stop
+// hash, all of them for zero stop hash or if none matches
+func truncateHeaders(headers []consensus.BlockHeader, stop consensus.Hash) []consensus.BlockHeader {
+	if stop == (consensus.Hash{}) {
+		return headers
+	}
+
+	for i := range headers {
+		if headers[i].Hash() == stop {
+			return headers[:i+1]
+		}
+	}
+
+	return headers
+}
+
+// Headers is a list of block headers in response to GetHeaders
+type Headers struct {
+	Headers []consensus.BlockHeader
+}
+
+// Bytes implements Message interface, at most maxHeaders of the first
+// headers are written
+func (h *Headers) Bytes() []byte {
+	buff := new(bytes.Buffer)
+
+	// writing to bytes.Buffer never fails
+	h.WriteTo(buff)
+	return buff.Bytes()
+}
+
+// WriteTo implements io.WriterTo interface
+func (h *Headers) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+
+	headers := h.Headers
+	if len(headers) > maxHeaders {
+		headers = headers[:maxHeaders]
+	}
+
+	if err := binary.Write(cw, binary.BigEndian, consensus.HeadersBodyVersion); err != nil {
+		return int64(cw.n), err
+	}
+
+	if err := binary.Write(cw, binary.BigEndian, uint16(len(headers))); err != nil {
+		return int64(cw.n), err
+	}
+
+	for i := range headers {
+		if err := headers[i].Write(cw); err != nil {
+			return int64(cw.n), err
+		}
+	}
+
+	return int64(cw.n), nil
+}
+
+// Type implements Message interface
+func (h *Headers) Type() uint8 {
+	return consensus.MsgTypeHeaders
+}
+
+// Read implements Message interface
+func (h *Headers) Read(r io.Reader) error {
+	if err := consensus.ReadBodyVersion(r, consensus.HeadersBodyVersion); err != nil {
+		return err
+	}
+
+	var headersLen uint16
+	if err := binary.Read(r, binary.BigEndian, &headersLen); err != nil {
+		return err
+	}
+
+	if headersLen > maxHeaders {
+		return fmt.Errorf("too many headers: %d > %d", headersLen, maxHeaders)
+	}
+
+	h.Headers = make([]consensus.BlockHeader, headersLen)
+	for i := range h.Headers {
+		if err := h.Headers[i].Read(r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetTip asks for the chain tip of the remote peer
+type GetTip struct{}
+
+// Bytes implements Message interface
+func (t *GetTip) Bytes() []byte {
+	return nil
+}
+
+// Type implements Message interface
+func (t *GetTip) Type() uint8 {
+	return consensus.MsgTypeGetTip
+}
+
+// Read implements Message interface
+func (t *GetTip) Read(r io.Reader) error {
+	return nil
+}
+
+// Tip is the chain tip in response to GetTip
+type Tip struct {
+	// hash of the tip block
+	Hash consensus.Hash
+	// height of the tip block
+	Height uint64
+	// total difficulty accumulated by the chain
+	TotalDifficulty consensus.Difficulty
+}
+
+// Bytes implements Message interface
+func (t *Tip) Bytes() []byte {
+	buff := new(bytes.Buffer)
+
+	if _, err := buff.Write(t.Hash[:]); err != nil {
+		panic(err)
+	}
+
+	if err := binary.Write(buff, binary.BigEndian, t.Height); err != nil {
+		panic(err)
+	}
+
+	if err := binary.Write(buff, binary.BigEndian, uint64(t.TotalDifficulty)); err != nil {
+		panic(err)
+	}
+
+	return buff.Bytes()
+}
+
+// Type implements Message interface
+func (t *Tip) Type() uint8 {
+	return consensus.MsgTypeTip
+}
+
+// Read implements Message interface
+func (t *Tip) Read(r io.Reader) error {
+
+	if _, err := io.ReadFull(r, t.Hash[:]); err != nil {
+		return err
+	}
+
+	if err := binary.Read(r, binary.BigEndian, &t.Height); err != nil {
+		return err
+	}
+
+	return binary.Read(r, binary.BigEndian, (*uint64)(&t.TotalDifficulty))
+}
+
+// Inventory item types
+const (
+	// InvBlock item is a block
+	InvBlock uint8 = 1
+	// InvTransaction item is a transaction
+	InvTransaction uint8 = 2
+)
+
+// InvItem is a block or transaction identified by hash
+type InvItem struct {
+	// InvBlock or InvTransaction
+	Type uint8
+	Hash consensus.Hash
+}
+
+// Inv announces blocks and transactions, the receiver requests the ones
+// it doesn't know
+type Inv struct {
+	Items []InvItem
+}
+
+// Bytes implements Message interface, at most maxInvItems of the first
+// items are written
+func (m *Inv) Bytes() []byte {
+	buff := new(bytes.Buffer)
+
+	items := m.Items
+	if len(items) > maxInvItems {
+		items = items[:maxInvItems]
+	}
+
+	if err := binary.Write(buff, binary.BigEndian, uint16(len(items))); err != nil {
+		panic(err)
+	}
+
+	for _, item := range items {
+		if err := binary.Write(buff, binary.BigEndian, item.Type); err != nil {
+			panic(err)
+		}
+
+		if _, err := buff.Write(item.Hash[:]); err != nil {
+			panic(err)
+		}
+	}
+
+	return buff.Bytes()
+}
+
+// Type implements Message interface
+func (m *Inv) Type() uint8 {
+	return consensus.MsgTypeInv
+}
+
+// Read implements Message interface
+func (m *Inv) Read(r io.Reader) error {
+
+	var itemsLen uint16
+	if err := binary.Read(r, binary.BigEndian, &itemsLen); err != nil {
+		return err
+	}
+
+	if itemsLen > maxInvItems {
+		return fmt.Errorf("too many inventory items: %d > %d", itemsLen, maxInvItems)
+	}
+
+	m.Items = make([]InvItem, itemsLen)
+	for i := range m.Items {
+		if err := binary.Read(r, binary.BigEndian, &m.Items[i].Type); err != nil {
+			return err
+		}
+
+		if _, err := io.ReadFull(r, m.Items[i].Hash[:]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// shortIDSize size of kernel short id in compact block
+const shortIDSize = 6
+
+// CompactBlock is a block header with short ids of its kernels. The
+// receiver rebuilds the block from the transactions in its pool, so it's
+// only sent to peers advertising CapCompactBlock.
+type CompactBlock struct {
+	Header consensus.BlockHeader
+	// nonce used to salt kernel short ids
+	Nonce uint64
+	// kernel short ids
+	KernelIDs [][shortIDSize]byte
+}
+
+// kernelShortID computes kernel short id salted with nonce
+func kernelShortID(kernel *consensus.TxKernel, nonce uint64) [shortIDSize]byte {
+	var salted [8 + consensus.BlockHashSize]byte
+	binary.BigEndian.PutUint64(salted[:8], nonce)
+	hash := kernel.Hash()
+	copy(salted[8:], hash[:])
+
+	var id [shortIDSize]byte
+	sum := blake2b.Sum256(salted[:])
+	copy(id[:], sum[:shortIDSize])
+	return id
+}
+
+// NewCompactBlock creates compact block from full block
+func NewCompactBlock(b *consensus.Block) *CompactBlock {
+	cb := &CompactBlock{
+		Header: b.Header,
+		Nonce:  rand.Uint64(),
+	}
+
+	cb.KernelIDs = make([][shortIDSize]byte, len(b.Kernels))
+	for i := range b.Kernels {
+		cb.KernelIDs[i] = kernelShortID(&b.Kernels[i], cb.Nonce)
+	}
+
+	return cb
+}
+
+// Bytes implements Message interface
+func (b *CompactBlock) Bytes() []byte {
+	buff := new(bytes.Buffer)
+
+	if err := b.Header.Write(buff); err != nil {
+		panic(err)
+	}
+
+	if err := binary.Write(buff, binary.BigEndian, b.Nonce); err != nil {
+		panic(err)
+	}
+
+	if err := binary.Write(buff, binary.BigEndian, uint64(len(b.KernelIDs))); err != nil {
+		panic(err)
+	}
+
+	for _, id := range b.KernelIDs {
+		buff.Write(id[:])
+	}
+
+	return buff.Bytes()
+}
+
+// Type implements Message interface
+func (b *CompactBlock) Type() uint8 {
+	return consensus.MsgTypeCompactBlock
+}
+
+// Read implements Message interface
+func (b *CompactBlock) Read(r io.Reader) error {
+
+	if err := b.Header.Read(r); err != nil {
+		return err
+	}
+
+	if err := binary.Read(r, binary.BigEndian, &b.Nonce); err != nil {
+		return err
+	}
+
+	var idsLen uint64
+	if err := binary.Read(r, binary.BigEndian, &idsLen); err != nil {
+		return err
+	}
+
+	if idsLen > uint64(consensus.MaxBlockWeight/consensus.BlockKernelWeight) {
+		return errors.New("too many kernel ids")
+	}
+
+	b.KernelIDs = make([][shortIDSize]byte, idsLen)
+	for i := range b.KernelIDs {
+		if _, err := io.ReadFull(r, b.KernelIDs[i][:]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,549 @@
+package p2p
+
+import (
+	"bytes"
+	"consensus"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"testing"
+)
+
+// genesisVector is the genesis hash used in handshake vectors
+var genesisVector = consensus.Hash{
+	0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11,
+	0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11,
+	0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11,
+	0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11,
+}
+
+// messageVectors pin wire encoding of messages to the serialization of
+// the Grin reference implementation, hex fields are listed in the order
+// they are written
+var messageVectors = []struct {
+	name string
+	msg  Message
+	// creates empty message the vector is read into
+	empty func() Message
+	hex   []string
+}{
+	{
+		name: "Ping",
+		msg: &Ping{
+			TotalDifficulty: 1000,
+			Height:          42,
+			Nonce:           0x0102030405060708,
+		},
+		empty: func() Message { return new(Ping) },
+		hex: []string{
+			"00000000000003e8", // total difficulty
+			"000000000000002a", // height
+			"0102030405060708", // nonce
+		},
+	},
+	{
+		name: "Pong",
+		msg: &Pong{Ping{
+			TotalDifficulty: 1000,
+			Height:          42,
+			Nonce:           0x0102030405060708,
+		}},
+		empty: func() Message { return new(Pong) },
+		hex: []string{
+			"00000000000003e8", // total difficulty
+			"000000000000002a", // height
+			"0102030405060708", // nonce
+		},
+	},
+	{
+		name:  "GetPeerAddrs",
+		msg:   &GetPeerAddrs{Capabilities: consensus.CapFullNode},
+		empty: func() Message { return new(GetPeerAddrs) },
+		hex: []string{
+			"00000007", // capabilities
+		},
+	},
+	{
+		name: "PeerAddrs",
+		msg: &PeerAddrs{peers: []*net.TCPAddr{
+			{IP: net.ParseIP("10.0.0.1"), Port: 3414},
+			{IP: net.ParseIP("2001:db8::1"), Port: 13414},
+		}},
+		empty: func() Message { return new(PeerAddrs) },
+		hex: []string{
+			"00000002",               // count
+			"00", "0a000001", "0d56", // IPv4 address, port
+			"01", "20010db8000000000000000000000001", "3466", // IPv6 address, port
+		},
+	},
+	{
+		name:  "PeerError",
+		msg:   &PeerError{Code: ErrCodeRateLimited, Message: "too many requests"},
+		empty: func() Message { return new(PeerError) },
+		hex: []string{
+			"00000065",                           // code
+			"0000000000000011",                   // message length
+			"746f6f206d616e79207265717565737473", // message
+		},
+	},
+	{
+		name: "Hand",
+		msg: &hand{
+			Version:         1,
+			Capabilities:    consensus.CapFullNode,
+			Nonce:           0x0102030405060708,
+			TotalDifficulty: 1,
+			Genesis:         genesisVector,
+			MaxMsgLen:       1 << 25,
+			SenderAddr:      &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 3414},
+			ReceiverAddr:    &net.TCPAddr{IP: net.ParseIP("5.6.7.8"), Port: 13414},
+			UserAgent:       "gringo",
+		},
+		empty: func() Message { return new(hand) },
+		hex: []string{
+			"00000001",               // version
+			"00000007",               // capabilities
+			"0102030405060708",       // nonce
+			"0000000000000001",       // total difficulty
+			strings.Repeat("11", 32), // genesis
+			"0000000002000000",       // max message length
+			"00", "01020304", "0d56", // sender address, port
+			"00", "05060708", "3466", // receiver address, port
+			"0000000000000006", // user agent length
+			"6772696e676f",     // user agent
+		},
+	},
+	{
+		name: "Shake",
+		msg: &shake{
+			Version:         1,
+			Capabilities:    consensus.CapFullNode,
+			Nonce:           0x0102030405060708,
+			TotalDifficulty: 1,
+			Genesis:         genesisVector,
+			MaxMsgLen:       1 << 25,
+			UserAgent:       "gringo",
+		},
+		empty: func() Message { return new(shake) },
+		hex: []string{
+			"00000001",               // version
+			"00000007",               // capabilities
+			"0102030405060708",       // nonce
+			"0000000000000001",       // total difficulty
+			strings.Repeat("11", 32), // genesis
+			"0000000002000000",       // max message length
+			"0000000000000006",       // user agent length
+			"6772696e676f",           // user agent
+		},
+	},
+}
+
+func TestMessageVectors(t *testing.T) {
+	for _, v := range messageVectors {
+		want, err := hex.DecodeString(strings.Join(v.hex, ""))
+		if err != nil {
+			t.Fatalf("%s: %v", v.name, err)
+		}
+
+		if got := v.msg.Bytes(); !bytes.Equal(got, want) {
+			t.Errorf("%s encoded as %x, want %x", v.name, got, want)
+		}
+
+		msg := v.empty()
+		r := bytes.NewReader(want)
+		if err := msg.Read(r); err != nil {
+			t.Errorf("%s: %v", v.name, err)
+			continue
+		}
+
+		if r.Len() != 0 {
+			t.Errorf("%s: %d bytes left unread", v.name, r.Len())
+		}
+
+		if got := msg.Bytes(); !bytes.Equal(got, want) {
+			t.Errorf("%s decoded and encoded back as %x, want %x", v.name, got, want)
+		}
+	}
+}
+
+func TestOversizedMessagesCapped(t *testing.T) {
+	getHeaders := &GetHeaders{Locator: make([]consensus.Hash, 300)}
+	headers := &Headers{Headers: make([]consensus.BlockHeader, maxHeaders+1)}
+	inv := &Inv{Items: make([]InvItem, maxInvItems+1)}
+
+	var readGetHeaders GetHeaders
+	if err := readGetHeaders.Read(bytes.NewReader(getHeaders.Bytes())); err != nil {
+		t.Errorf("GetHeaders: %v", err)
+	} else if len(readGetHeaders.Locator) != maxLocatorHashes {
+		t.Errorf("GetHeaders carries %d locator hashes, want %d", len(readGetHeaders.Locator), maxLocatorHashes)
+	}
+
+	var readHeaders Headers
+	if err := readHeaders.Read(bytes.NewReader(headers.Bytes())); err != nil {
+		t.Errorf("Headers: %v", err)
+	} else if len(readHeaders.Headers) != maxHeaders {
+		t.Errorf("Headers carries %d headers, want %d", len(readHeaders.Headers), maxHeaders)
+	}
+
+	var readInv Inv
+	if err := readInv.Read(bytes.NewReader(inv.Bytes())); err != nil {
+		t.Errorf("Inv: %v", err)
+	} else if len(readInv.Items) != maxInvItems {
+		t.Errorf("Inv carries %d items, want %d", len(readInv.Items), maxInvItems)
+	}
+}
+
+func TestPeerAddrsInvalidFamily(t *testing.T) {
+	for _, flag := range []string{"02", "ff"} {
+		data, err := hex.DecodeString("00000001" + flag + "0a000001" + "0d56")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var msg PeerAddrs
+		if err := msg.Read(bytes.NewReader(data)); err != ErrInvalidAddrFamily {
+			t.Errorf("address family %s: got %v, want %v", flag, err, ErrInvalidAddrFamily)
+		}
+	}
+}
+
+func TestOverCapCountsRejected(t *testing.T) {
+	// Headers body of no headers ends with the count, declare one more
+	// header than allowed without sending any
+	headers := (&Headers{}).Bytes()
+	binary.BigEndian.PutUint16(headers[len(headers)-2:], maxHeaders+1)
+
+	err := new(Headers).Read(bytes.NewReader(headers))
+	if err == nil || !strings.Contains(err.Error(), "too many headers") {
+		t.Errorf("Headers over the cap: got %v, want too many headers error", err)
+	}
+
+	locator := []byte{maxLocatorHashes + 1}
+	err = new(GetHeaders).Read(bytes.NewReader(locator))
+	if err == nil || !strings.Contains(err.Error(), "too long locator") {
+		t.Errorf("GetHeaders locator over the cap: got %v, want too long locator error", err)
+	}
+}
+
+func TestPeerAddrsManyIPv6(t *testing.T) {
+	var peers []*net.TCPAddr
+	for i := 0; i < 4*maxPeerAddresses; i++ {
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, net.ParseIP("2001:db8::"))
+		binary.BigEndian.PutUint32(ip[12:], uint32(i+1))
+		peers = append(peers, &net.TCPAddr{IP: ip, Port: 3414})
+	}
+	// IPv4 peers at the end of the list are preferred
+	ipv4 := &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 3414}
+	peers = append(peers, ipv4)
+
+	data := (&PeerAddrs{peers: peers}).Bytes()
+	if uint64(len(data)) > consensus.MaxMsgLen {
+		t.Fatalf("PeerAddrs of %d peers encoded as %d bytes, above %d", len(peers), len(data), consensus.MaxMsgLen)
+	}
+
+	var msg PeerAddrs
+	if err := msg.Read(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(msg.peers) != maxPeerAddresses {
+		t.Errorf("PeerAddrs carries %d peers, want %d", len(msg.peers), maxPeerAddresses)
+	}
+	if !msg.peers[0].IP.Equal(ipv4.IP) {
+		t.Errorf("first advertised peer %v, want IPv4 %v", msg.peers[0], ipv4)
+	}
+}
+
+func TestTipRoundTrip(t *testing.T) {
+	tip := &Tip{Hash: consensus.Hash{1, 2, 3}, Height: 42, TotalDifficulty: 1000}
+
+	var got Tip
+	r := bytes.NewReader(tip.Bytes())
+	if err := got.Read(r); err != nil {
+		t.Fatal(err)
+	}
+	if got != *tip || r.Len() != 0 {
+		t.Errorf("Tip read as %+v with %d bytes left, want %+v", got, r.Len(), tip)
+	}
+
+	var getTip GetTip
+	if err := getTip.Read(bytes.NewReader(getTip.Bytes())); err != nil {
+		t.Errorf("GetTip: %v", err)
+	}
+}
+
+func TestHeaderReadTruncated(t *testing.T) {
+	header := Header{magic: consensus.MagicCode, Type: consensus.MsgTypePing, Len: 24}
+	buff := new(bytes.Buffer)
+	if err := header.Write(buff); err != nil {
+		t.Fatal(err)
+	}
+	data := buff.Bytes()
+	magicLen := len(consensus.MagicCode)
+
+	tests := []struct {
+		name string
+		n    int
+		err  error
+	}{
+		{"before header", 0, io.EOF},
+		{"within magic", 1, io.ErrUnexpectedEOF},
+		{"after magic", magicLen, io.ErrUnexpectedEOF},
+		{"after type", magicLen + 1, io.ErrUnexpectedEOF},
+		{"within length", len(data) - 1, io.ErrUnexpectedEOF},
+		{"whole header", len(data), nil},
+	}
+
+	for _, tt := range tests {
+		var h Header
+		if err := h.Read(bytes.NewReader(data[:tt.n])); err != tt.err {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestRejectRoundTrip(t *testing.T) {
+	msg := &Reject{MsgType: consensus.MsgTypeTransaction, Hash: consensus.Hash{1}, Code: RejectLowFee, Reason: "fee too low"}
+
+	var got Reject
+	r := bytes.NewReader(msg.Bytes())
+	if err := got.Read(r); err != nil {
+		t.Fatal(err)
+	}
+	if got != *msg || r.Len() != 0 {
+		t.Errorf("Reject read as %+v with %d bytes left, want %+v", got, r.Len(), msg)
+	}
+
+	long := &Reject{Reason: strings.Repeat("x", maxRejectReasonLen+1)}
+	if err := got.Read(bytes.NewReader(long.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Reason) != maxRejectReasonLen {
+		t.Errorf("long reason sent as %d bytes, want %d", len(got.Reason), maxRejectReasonLen)
+	}
+}
+
+func TestInvRoundTrip(t *testing.T) {
+	msg := &Inv{Items: []InvItem{
+		{Type: InvBlock, Hash: consensus.Hash{1}},
+		{Type: InvTransaction, Hash: consensus.Hash{2}},
+	}}
+
+	var got Inv
+	r := bytes.NewReader(msg.Bytes())
+	if err := got.Read(r); err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Len() != 0 || len(got.Items) != len(msg.Items) {
+		t.Fatalf("Inv read as %+v with %d bytes left, want %+v", got, r.Len(), msg)
+	}
+	for i := range msg.Items {
+		if got.Items[i] != msg.Items[i] {
+			t.Errorf("item %d read as %+v, want %+v", i, got.Items[i], msg.Items[i])
+		}
+	}
+}
+
+func TestLengthExceedsBody(t *testing.T) {
+	userAgentOffset := func(body []byte) int { return len(body) - 8 - len(userAgent) }
+	shakeBody := (&shake{Version: consensus.ProtocolVersion, UserAgent: userAgent}).Bytes()
+	addr := &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 3414}
+	handBody := (&hand{
+		Version:      consensus.ProtocolVersion,
+		SenderAddr:   addr,
+		ReceiverAddr: addr,
+		UserAgent:    userAgent,
+	}).Bytes()
+
+	tests := []struct {
+		name   string
+		body   []byte
+		offset int
+		msg    Message
+	}{
+		// message length follows the 4 bytes error code
+		{"PeerError", (&PeerError{Code: ErrCodeBadMessage, Message: "bad"}).Bytes(), 4, new(PeerError)},
+		{"hand", handBody, userAgentOffset(handBody), new(hand)},
+		{"shake", shakeBody, userAgentOffset(shakeBody), new(shake)},
+	}
+
+	for _, tt := range tests {
+		// length claims one byte more than the header Len leaves
+		body := append([]byte(nil), tt.body...)
+		length := binary.BigEndian.Uint64(body[tt.offset:])
+		binary.BigEndian.PutUint64(body[tt.offset:], length+1)
+
+		r := &io.LimitedReader{R: bytes.NewReader(body), N: int64(len(body))}
+		if err := tt.msg.Read(r); err != ErrLengthMismatch {
+			t.Errorf("%s: got %v, want %v", tt.name, err, ErrLengthMismatch)
+		}
+	}
+}
+
+func TestGetHeadersRoundTrip(t *testing.T) {
+	tests := []*GetHeaders{
+		{Locator: []consensus.Hash{{1}, {2}}, StopHash: consensus.Hash{3}},
+		{Locator: []consensus.Hash{{1}}},
+		{Locator: []consensus.Hash{}, StopHash: consensus.Hash{3}},
+	}
+
+	for _, msg := range tests {
+		var got GetHeaders
+		r := bytes.NewReader(msg.Bytes())
+		if err := got.Read(r); err != nil {
+			t.Fatal(err)
+		}
+		if got.StopHash != msg.StopHash || len(got.Locator) != len(msg.Locator) || r.Len() != 0 {
+			t.Errorf("GetHeaders read as %+v with %d bytes left, want %+v", got, r.Len(), msg)
+			continue
+		}
+		for i := range msg.Locator {
+			if got.Locator[i] != msg.Locator[i] {
+				t.Errorf("locator hash %d read as %x, want %x", i, got.Locator[i], msg.Locator[i])
+			}
+		}
+	}
+}
+
+func TestUnknownBodyVersion(t *testing.T) {
+	block := largeBlock(2)
+	msgs := []struct {
+		msg   Message
+		empty Message
+	}{
+		{block, new(consensus.Block)},
+		{&consensus.Transaction{Kernels: block.Kernels}, new(consensus.Transaction)},
+		{&Headers{Headers: []consensus.BlockHeader{block.Header}}, new(Headers)},
+	}
+
+	for _, m := range msgs {
+		body := m.msg.Bytes()
+		if err := m.empty.Read(bytes.NewReader(body)); err != nil {
+			t.Fatalf("%T: %v", m.msg, err)
+		}
+
+		// body version is the leading byte
+		body[0]++
+		if err := m.empty.Read(bytes.NewReader(body)); err != consensus.ErrUnknownBodyVersion {
+			t.Errorf("%T of version %d: got %v, want %v", m.msg, body[0], err, consensus.ErrUnknownBodyVersion)
+		}
+	}
+}
+
+func TestPeerAddrsV2RoundTrip(t *testing.T) {
+	msg := &PeerAddrsV2{peers: []PeerAddr{
+		{Addr: &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 3414}, Capabilities: consensus.CapFullNode},
+		{Addr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 13414}, Capabilities: consensus.CapPeerList | consensus.CapCompression},
+		{Addr: &net.TCPAddr{IP: net.IPv4(5, 6, 7, 8), Port: 3414}, Capabilities: consensus.CapUnknown},
+	}}
+
+	var got PeerAddrsV2
+	r := bytes.NewReader(msg.Bytes())
+	if err := got.Read(r); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.peers) != len(msg.peers) || r.Len() != 0 {
+		t.Fatalf("read %d peers with %d bytes left, want %d", len(got.peers), r.Len(), len(msg.peers))
+	}
+
+	// IPv4 addresses are advertised first
+	want := []PeerAddr{msg.peers[0], msg.peers[2], msg.peers[1]}
+	for i := range want {
+		if got.peers[i].Addr.String() != want[i].Addr.String() || got.peers[i].Capabilities != want[i].Capabilities {
+			t.Errorf("peer %d read as %v %v, want %v %v", i,
+				got.peers[i].Addr, got.peers[i].Capabilities, want[i].Addr, want[i].Capabilities)
+		}
+	}
+}
+
+func TestMergePeerAddrs(t *testing.T) {
+	a := mustAddr(t, "1.2.3.4:3414")
+	b := mustAddr(t, "1.2.3.4:3415")
+	c := mustAddr(t, "[2001:db8::1]:3414")
+	// the same address parsed again, and in 16 bytes form
+	dupA := &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4).To16(), Port: 3414}
+
+	merged := MergePeerAddrs(
+		PeerAddrs{peers: []*net.TCPAddr{a, b}},
+		PeerAddrs{peers: []*net.TCPAddr{mustAddr(t, "1.2.3.4:3414"), c, b}},
+		PeerAddrs{peers: []*net.TCPAddr{dupA}},
+		PeerAddrs{},
+	)
+	want := []*net.TCPAddr{a, b, c}
+	if len(merged.peers) != len(want) {
+		t.Fatalf("merged %v, want %v", merged.peers, want)
+	}
+	for i := range want {
+		if merged.peers[i].String() != want[i].String() {
+			t.Errorf("merged address %d is %v, want %v", i, merged.peers[i], want[i])
+		}
+	}
+
+	// overlapping full lists are capped, the first one is kept whole
+	first := fullPeerAddrs(1)
+	merged = MergePeerAddrs(*first, *fullPeerAddrs(2), *first)
+	if len(merged.peers) != maxPeerAddresses {
+		t.Fatalf("merged %d addresses, want %d", len(merged.peers), maxPeerAddresses)
+	}
+	for i := range first.peers {
+		if merged.peers[i].String() != first.peers[i].String() {
+			t.Fatalf("merged address %d is %v, want %v", i, merged.peers[i], first.peers[i])
+		}
+	}
+}
+
+func TestPeerErrorEmptyMessage(t *testing.T) {
+	msg := &PeerError{Code: ErrCodeShuttingDown}
+	if body := msg.Bytes(); len(body) != 12 {
+		t.Fatalf("empty PeerError body of %d bytes, want code and zero length only", len(body))
+	}
+
+	// message followed by another one must leave it intact
+	stream := bytes.NewReader(encodeMessages(t, msg, &Ping{Nonce: 1}))
+	got := PeerError{Message: "stale"}
+	if _, err := ReadMessage(stream, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Code != msg.Code || got.Message != "" {
+		t.Errorf("PeerError read as %+v, want %+v", got, msg)
+	}
+
+	var ping Ping
+	if _, err := ReadMessage(stream, &ping); err != nil || ping.Nonce != 1 {
+		t.Errorf("message after empty PeerError read as %+v, %v", ping, err)
+	}
+}
+
+func TestPlausiblePing(t *testing.T) {
+	params := consensus.MainnetParams
+	minimum := consensus.Difficulty(params.MinimumDifficulty)
+
+	plausible := []Ping{
+		{TotalDifficulty: 0, Height: 0},
+		{TotalDifficulty: 100 * minimum, Height: 100},
+		{TotalDifficulty: math.MaxUint64, Height: 1000},
+	}
+	for _, p := range plausible {
+		if !PlausiblePing(p, params) {
+			t.Errorf("Ping of difficulty %d at height %d not plausible", p.TotalDifficulty, p.Height)
+		}
+	}
+
+	implausible := []Ping{
+		// tiny difficulty at enormous height
+		{TotalDifficulty: 1, Height: 1 << 40},
+		{TotalDifficulty: 100*minimum - 1, Height: 100},
+		// height times minimum difficulty overflows
+		{TotalDifficulty: math.MaxUint64, Height: math.MaxUint64/params.MinimumDifficulty + 1},
+	}
+	for _, p := range implausible {
+		if PlausiblePing(p, params) {
+			t.Errorf("Ping of difficulty %d at height %d plausible", p.TotalDifficulty, p.Height)
+		}
+	}
+}
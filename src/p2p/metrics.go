@@ -0,0 +1,95 @@
+package p2p
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Direction of a message or connection relative to the local node
+type Direction uint8
+
+const (
+	// Inbound message received from (or connection initiated by) the remote peer
+	Inbound Direction = iota
+	// Outbound message sent to (or connection initiated by) the local node
+	Outbound
+)
+
+// MessageCounter receives a notification for every message passing through
+// WriteMessage/ReadMessage and the peer read loop.
+type MessageCounter interface {
+	// Inc counts one message of type typ in the given direction
+	Inc(typ uint8, direction Direction)
+}
+
+// messageCounter is the counter used by the package
+var messageCounter atomic.Pointer[MessageCounter]
+
+func init() {
+	SetMessageCounter(NewMemoryCounter())
+}
+
+// SetMessageCounter replaces the message counter used by the package,
+// safe for concurrent use with running peers. Passing nil disables counting.
+func SetMessageCounter(c MessageCounter) {
+	messageCounter.Store(&c)
+}
+
+// countMessage notifies current message counter if any
+func countMessage(typ uint8, direction Direction) {
+	if c := *messageCounter.Load(); c != nil {
+		c.Inc(typ, direction)
+	}
+}
+
+// MemoryCounter is the default in-memory MessageCounter
+type MemoryCounter struct {
+	sync.Mutex
+
+	counts [2]map[uint8]uint64
+}
+
+// NewMemoryCounter creates empty in-memory counter
+func NewMemoryCounter() *MemoryCounter {
+	c := new(MemoryCounter)
+	c.counts[Inbound] = make(map[uint8]uint64)
+	c.counts[Outbound] = make(map[uint8]uint64)
+
+	return c
+}
+
+// Inc implements MessageCounter interface
+func (c *MemoryCounter) Inc(typ uint8, direction Direction) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.counts[direction][typ]++
+}
+
+// Snapshot returns the number of messages seen per type in both directions
+func (c *MemoryCounter) Snapshot() map[uint8]uint64 {
+	c.Lock()
+	defer c.Unlock()
+
+	snapshot := make(map[uint8]uint64)
+	for _, counts := range c.counts {
+		for typ, n := range counts {
+			snapshot[typ] += n
+		}
+	}
+
+	return snapshot
+}
+
+// SnapshotDirection returns the number of messages seen per type in one direction
+func (c *MemoryCounter) SnapshotDirection(direction Direction) map[uint8]uint64 {
+	c.Lock()
+	defer c.Unlock()
+
+	snapshot := make(map[uint8]uint64, len(c.counts[direction]))
+	for typ, n := range c.counts[direction] {
+		snapshot[typ] = n
+	}
+
+	return snapshot
+}
@@ -0,0 +1,63 @@
+package p2p
+
+import (
+	"bytes"
+	"consensus"
+	"sync"
+	"testing"
+)
+
+func TestMessageCounts(t *testing.T) {
+	counter := NewMemoryCounter()
+	SetMessageCounter(counter)
+	defer SetMessageCounter(NewMemoryCounter())
+
+	buff := new(bytes.Buffer)
+	msgs := []Message{new(Ping), new(Ping), new(Ping), new(GetPeerAddrs)}
+	for _, msg := range msgs {
+		if _, err := WriteMessage(buff, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, msg := range msgs {
+		if _, err := ReadMessage(buff, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[uint8]uint64{consensus.MsgTypePing: 3, consensus.MsgTypeGetPeerAddrs: 1}
+	for _, direction := range []Direction{Inbound, Outbound} {
+		counts := counter.SnapshotDirection(direction)
+		for typ, n := range want {
+			if counts[typ] != n {
+				t.Errorf("direction %d: %d messages of type %d, want %d", direction, counts[typ], typ, n)
+			}
+		}
+	}
+
+	if n := counter.Snapshot()[consensus.MsgTypePing]; n != 6 {
+		t.Errorf("%d Pings counted in both directions, want 6", n)
+	}
+}
+
+func TestSetMessageCounterConcurrent(t *testing.T) {
+	defer SetMessageCounter(NewMemoryCounter())
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			countMessage(consensus.MsgTypePing, Inbound)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			SetMessageCounter(NewMemoryCounter())
+			SetMessageCounter(nil)
+		}
+	}()
+	wg.Wait()
+}
@@ -0,0 +1,94 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+// ErrUnroutableAddr is returned for addresses which can't be used between peers
+var ErrUnroutableAddr = errors.New("unroutable address")
+
+// validateNetAddr checks addr may be advertised to other peers. Link-local
+// addresses (and IPv6 zones) are only meaningful on the local link.
+func validateNetAddr(addr *net.TCPAddr) error {
+	if addr.Zone != "" || addr.IP.IsLinkLocalUnicast() {
+		return ErrUnroutableAddr
+	}
+
+	if addr.IP.To16() == nil {
+		return ErrInvalidAddrFamily
+	}
+
+	return nil
+}
+
+// netAddrSize returns size of addr written by WriteNetAddr
+func netAddrSize(addr *net.TCPAddr) uint64 {
+	if addr.IP.To4() != nil {
+		return 1 + net.IPv4len + 2
+	}
+
+	return 1 + net.IPv6len + 2
+}
+
+// WriteNetAddr writes address as [family flag][ip][port], flag is 0 for
+// IPv4 and 1 for IPv6.
+func WriteNetAddr(w io.Writer, addr *net.TCPAddr) error {
+	if err := validateNetAddr(addr); err != nil {
+		return err
+	}
+
+	var flag byte
+	ip := addr.IP.To4()
+	if ip == nil {
+		flag = 1
+		ip = addr.IP.To16()
+	}
+
+	if _, err := w.Write([]byte{flag}); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(ip); err != nil {
+		return err
+	}
+
+	return binary.Write(w, binary.BigEndian, uint16(addr.Port))
+}
+
+// ReadNetAddr reads address written by WriteNetAddr
+func ReadNetAddr(r io.Reader) (*net.TCPAddr, error) {
+	var ipFlag int8
+	var ipAddr []byte
+	var ipPort uint16
+
+	if err := binary.Read(r, binary.BigEndian, &ipFlag); err != nil {
+		return nil, err
+	}
+
+	switch ipFlag {
+	case 0:
+		// for ipv4 addr
+		ipAddr = make([]byte, net.IPv4len)
+	case 1:
+		// for ipv6 addr
+		ipAddr = make([]byte, net.IPv6len)
+	default:
+		return nil, ErrInvalidAddrFamily
+	}
+
+	if _, err := io.ReadFull(r, ipAddr); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Read(r, binary.BigEndian, &ipPort); err != nil {
+		return nil, err
+	}
+
+	return &net.TCPAddr{
+		IP:   ipAddr,
+		Port: int(ipPort),
+	}, nil
+}
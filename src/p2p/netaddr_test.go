@@ -0,0 +1,37 @@
+package p2p
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestWriteNetAddrLinkLocal(t *testing.T) {
+	addrs := []*net.TCPAddr{
+		{IP: net.ParseIP("fe80::1"), Port: 3414},
+		{IP: net.ParseIP("fe80::1"), Port: 3414, Zone: "eth0"},
+		{IP: net.ParseIP("169.254.0.1"), Port: 3414},
+	}
+
+	for _, addr := range addrs {
+		buff := new(bytes.Buffer)
+		if err := WriteNetAddr(buff, addr); err != ErrUnroutableAddr {
+			t.Errorf("%s: got %v, want %v", addr, err, ErrUnroutableAddr)
+		}
+
+		if buff.Len() != 0 {
+			t.Errorf("%s: %d bytes written", addr, buff.Len())
+		}
+	}
+
+	// link-local addresses are left out of PeerAddrs
+	msg := &PeerAddrs{peers: append(addrs, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 3414})}
+	var read PeerAddrs
+	if err := read.Read(bytes.NewReader(msg.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(read.peers) != 1 || !read.peers[0].IP.Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("PeerAddrs carries %v", read.peers)
+	}
+}
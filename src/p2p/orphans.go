@@ -0,0 +1,103 @@
+package p2p
+
+import (
+	"consensus"
+	"container/list"
+	"sync"
+)
+
+// defaultMaxOrphans default maximum number of blocks in orphan pool
+const defaultMaxOrphans = 100
+
+// OrphanPool holds blocks received before their parent, until the parent
+// arrives. When full the oldest orphans are evicted.
+type OrphanPool struct {
+	sync.Mutex
+
+	max int
+	// orphan blocks by hash, values are elements of order
+	blocks map[consensus.Hash]*list.Element
+	// hashes of orphan blocks by previous block hash
+	children map[consensus.Hash][]consensus.Hash
+	// orphan blocks from the oldest one
+	order *list.List
+}
+
+// NewOrphanPool creates orphan pool holding at most max blocks
+func NewOrphanPool(max int) *OrphanPool {
+	return &OrphanPool{
+		max:      max,
+		blocks:   make(map[consensus.Hash]*list.Element),
+		children: make(map[consensus.Hash][]consensus.Hash),
+		order:    list.New(),
+	}
+}
+
+// Len returns number of orphan blocks
+func (o *OrphanPool) Len() int {
+	o.Lock()
+	defer o.Unlock()
+
+	return o.order.Len()
+}
+
+// Add adds orphan block, evicting the oldest one if the pool is full
+func (o *OrphanPool) Add(b *consensus.Block) {
+	o.Lock()
+	defer o.Unlock()
+
+	hash := b.Header.Hash()
+	if _, ok := o.blocks[hash]; ok {
+		return
+	}
+
+	if o.order.Len() >= o.max {
+		oldest := o.order.Front().Value.(*consensus.Block)
+		o.remove(oldest.Header.Hash(), oldest.Header.Previous)
+	}
+
+	o.blocks[hash] = o.order.PushBack(b)
+	o.children[b.Header.Previous] = append(o.children[b.Header.Previous], hash)
+}
+
+// remove removes orphan block, must be called with lock held
+func (o *OrphanPool) remove(hash, previous consensus.Hash) {
+	if elem, ok := o.blocks[hash]; ok {
+		o.order.Remove(elem)
+		delete(o.blocks, hash)
+	}
+
+	siblings := o.children[previous]
+	for i := range siblings {
+		if siblings[i] == hash {
+			siblings = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+
+	if len(siblings) == 0 {
+		delete(o.children, previous)
+	} else {
+		o.children[previous] = siblings
+	}
+}
+
+// TakeChildren removes and returns orphan blocks whose parent is parentHash
+func (o *OrphanPool) TakeChildren(parentHash consensus.Hash) []*consensus.Block {
+	o.Lock()
+	defer o.Unlock()
+
+	hashes := o.children[parentHash]
+	delete(o.children, parentHash)
+
+	blocks := make([]*consensus.Block, 0, len(hashes))
+	for _, hash := range hashes {
+		elem := o.blocks[hash]
+		blocks = append(blocks, elem.Value.(*consensus.Block))
+
+		o.order.Remove(elem)
+		delete(o.blocks, hash)
+	}
+
+	return blocks
+}
@@ -0,0 +1,71 @@
+package p2p
+
+import (
+	"consensus"
+	"testing"
+)
+
+// childBlock returns block at height following parent
+func childBlock(parent consensus.Hash, height uint64) *consensus.Block {
+	b := new(consensus.Block)
+	b.Header.Previous = parent
+	b.Header.Height = height
+	return b
+}
+
+func TestOrphanTakenWithParent(t *testing.T) {
+	pool := NewOrphanPool(10)
+
+	parent := childBlock(consensus.Hash{1}, 1)
+	child := childBlock(parent.Header.Hash(), 2)
+	grandchild := childBlock(child.Header.Hash(), 3)
+
+	pool.Add(grandchild)
+	pool.Add(child)
+	// added twice, kept once
+	pool.Add(child)
+	if n := pool.Len(); n != 2 {
+		t.Fatalf("pool holds %d orphans, want 2", n)
+	}
+
+	if blocks := pool.TakeChildren(consensus.Hash{1}); len(blocks) != 0 {
+		t.Errorf("%d orphans taken before their parent arrived", len(blocks))
+	}
+
+	blocks := pool.TakeChildren(parent.Header.Hash())
+	if len(blocks) != 1 || blocks[0] != child {
+		t.Fatalf("orphans of arrived parent %v, want the child", blocks)
+	}
+
+	blocks = pool.TakeChildren(child.Header.Hash())
+	if len(blocks) != 1 || blocks[0] != grandchild {
+		t.Fatalf("orphans of connected child %v, want the grandchild", blocks)
+	}
+
+	if n := pool.Len(); n != 0 {
+		t.Errorf("pool holds %d orphans once all were taken", n)
+	}
+	if blocks := pool.TakeChildren(parent.Header.Hash()); len(blocks) != 0 {
+		t.Errorf("orphan taken twice")
+	}
+}
+
+func TestOrphanPoolEvictsOldest(t *testing.T) {
+	pool := NewOrphanPool(2)
+
+	oldest := childBlock(consensus.Hash{1}, 1)
+	pool.Add(oldest)
+	pool.Add(childBlock(consensus.Hash{2}, 1))
+	pool.Add(childBlock(consensus.Hash{3}, 1))
+
+	if n := pool.Len(); n != 2 {
+		t.Errorf("full pool holds %d orphans, want 2", n)
+	}
+
+	if blocks := pool.TakeChildren(consensus.Hash{1}); len(blocks) != 0 {
+		t.Error("oldest orphan wasn't evicted")
+	}
+	if blocks := pool.TakeChildren(consensus.Hash{3}); len(blocks) != 1 {
+		t.Error("newest orphan was evicted")
+	}
+}
@@ -0,0 +1,118 @@
+package p2p
+
+import (
+	"consensus"
+	"net"
+	"testing"
+	"time"
+)
+
+// NewTestPair connects two started peers over net.Pipe, each with its own
+// in-memory peer store. a dialed b, both are closed on test cleanup.
+func NewTestPair(t *testing.T) (a, b *Peer) {
+	t.Helper()
+	aConn, bConn := net.Pipe()
+
+	type accepted struct {
+		p   *Peer
+		err error
+	}
+	done := make(chan accepted, 1)
+	go func() {
+		// b is another node, it can't present our nonce
+		p, err := acceptPeer(bConn, ^localNonce)
+		done <- accepted{p, err}
+	}()
+
+	a, err := NewPeerConn(aConn)
+	if err != nil {
+		aConn.Close()
+		bConn.Close()
+		t.Fatal(err)
+	}
+
+	acc := <-done
+	if acc.err != nil {
+		aConn.Close()
+		bConn.Close()
+		t.Fatal(acc.err)
+	}
+	b = acc.p
+
+	for _, p := range []*Peer{a, b} {
+		p.SetPeerStore(NewPeerStore())
+		p.Start()
+	}
+
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+
+	return a, b
+}
+
+// eventually fails the test unless cond holds within a second
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s didn't happen", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPairPingAndPeerExchange(t *testing.T) {
+	a, b := NewTestPair(t)
+
+	known := []*net.TCPAddr{mustAddr(t, "1.2.3.4:3414"), mustAddr(t, "5.6.7.8:3414")}
+	for _, addr := range known {
+		b.peerStore.AddPeer(addr, consensus.CapFullNode)
+	}
+
+	if err := a.SendPing(); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "Pong from b", func() bool { return a.Info().RTT > 0 })
+
+	genesis := consensus.DefaultNetwork().Genesis
+	if td := a.RemoteTotalDifficulty(); td != genesis.TotalDifficulty {
+		t.Errorf("b responded with total difficulty %d, want %d", td, genesis.TotalDifficulty)
+	}
+
+	a.SendPeerRequest(consensus.CapFullNode)
+	eventually(t, "peer exchange", func() bool {
+		return len(a.peerStore.Peers(consensus.CapUnknown, maxPeerAddresses)) == len(known)
+	})
+
+	got := make(map[string]bool)
+	for _, addr := range a.peerStore.Peers(consensus.CapUnknown, maxPeerAddresses) {
+		got[addr.String()] = true
+	}
+	for _, addr := range known {
+		if !got[addr.String()] {
+			t.Errorf("a didn't learn %v from b", addr)
+		}
+	}
+}
+
+func TestPeerExchangeFilter(t *testing.T) {
+	a, b := NewTestPair(t)
+
+	full := mustAddr(t, "1.2.3.4:3414")
+	b.peerStore.AddPeer(full, consensus.CapFullNode)
+	b.peerStore.AddPeer(mustAddr(t, "5.6.7.8:3414"), consensus.CapPeerList)
+
+	// a takes PeerAddrsV2, so b answers with capabilities
+	a.SendPeerRequest(consensus.CapFullHist)
+	eventually(t, "peer exchange", func() bool {
+		return len(a.peerStore.Peers(consensus.CapUnknown, maxPeerAddresses)) > 0
+	})
+
+	peers := a.peerStore.PeerAddrs(consensus.CapUnknown, maxPeerAddresses)
+	if len(peers) != 1 || peers[0].Addr.String() != full.String() || peers[0].Capabilities != consensus.CapFullNode {
+		t.Errorf("a learned %v, want %v with capabilities %v", peers, full, consensus.CapFullNode)
+	}
+}
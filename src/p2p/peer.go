@@ -3,12 +3,57 @@ package p2p
 import (
 	"net"
 	"consensus"
-	"github.com/sirupsen/logrus"
+	"context"
 	"bufio"
 	"io"
+	"io/ioutil"
+	"math/rand"
 	"errors"
 	"sync"
 	"sync/atomic"
+	"time"
+)
+
+const (
+	// peerMessageRate is the number of messages per second a peer may send
+	// on a network of mainnet block time
+	peerMessageRate = 100
+	// peerMessageBurst is the number of messages a peer may send at once,
+	// per peerMessageRate messages per second
+	peerMessageBurst = 500
+	// minMessageRate is the lowest default message rate of slow networks
+	minMessageRate = 10
+	// peerRateCooldown is how long reading from a peer exceeding message rate is paused
+	peerRateCooldown = 5 * time.Second
+	// closeReasonTimeout is how long we try to send close reason before closing
+	closeReasonTimeout = 5 * time.Second
+	// sendTimeout is how long Send waits for the peer to take a message
+	sendTimeout = 10 * time.Second
+	// defaultIdleTimeout is how long a peer may stay silent before disconnect
+	defaultIdleTimeout = 10 * time.Minute
+	// addrAcceptWindow is the time window peer addresses accepted from a peer are counted in
+	addrAcceptWindow = 10 * time.Minute
+	// addrAcceptMax is the maximum number of addresses accepted from a peer per window
+	addrAcceptMax = maxPeerAddresses
+	// defaultDialTimeout is how long we wait for TCP connection to a peer
+	defaultDialTimeout = 10 * time.Second
+	// defaultHandshakeTimeout is how long we wait for the handshake to complete
+	defaultHandshakeTimeout = 10 * time.Second
+	// stalledHeartbeats is the number of stale heartbeats after which peer is stalled
+	stalledHeartbeats = 10
+)
+
+var (
+	// ErrPeerDisconnected is returned when sending to disconnected peer
+	ErrPeerDisconnected = errors.New("peer disconnected")
+	// ErrSendTimeout is returned when peer doesn't take a message in sendTimeout
+	ErrSendTimeout = errors.New("send to peer timed out")
+	// ErrIdleTimeout is returned when peer sends nothing within idle timeout
+	ErrIdleTimeout = errors.New("peer idle timeout")
+	// ErrPeerStalled is returned when peer total difficulty doesn't grow along ours
+	ErrPeerStalled = errors.New("peer stalled")
+	// ErrImplausiblePing is returned when peer total difficulty is too low for its height
+	ErrImplausiblePing = errors.New("implausible peer height and total difficulty")
 )
 
 // Peer is a participant of p2p network
@@ -18,6 +63,20 @@ type Peer struct {
 	// The following fields are only meant to be used *atomically*
 	bytesReceived uint64
 	bytesSent     uint64
+	// unix time in nanoseconds of the last received message
+	lastReceived int64
+	// round trip time in nanoseconds measured by the last Ping/Pong
+	rtt int64
+	// number of Pongs not answering our Ping
+	unsolicitedPongs uint64
+	// number of consecutive heartbeats the peer total difficulty didn't
+	// grow while ours did
+	staleHeartbeats uint32
+	// number of peer addresses ignored over addrAcceptMax
+	droppedAddrs uint64
+	// sequence numbers of the last message sent and received
+	sentSeq     uint64
+	receivedSeq uint64
 
 	quit      chan struct{}
 	wg        sync.WaitGroup
@@ -25,13 +84,90 @@ type Peer struct {
 	// Queue for sending message
 	sendQueue chan Message
 
+	// serializes writes to conn
+	writeMu sync.Mutex
+
 	// disconnect flag
 	disconnect int32
 
+	// limits rate of received messages
+	msgLimiter *tokenBucket
+	// PeerError was sent for exceeding the rate, used by read handler only
+	rateLimitNotified bool
+	// how long reading is paused once the rate is exceeded
+	rateCooldown time.Duration
+
+	// connection is closed if no message is received within idle timeout
+	idleTimeout time.Duration
+
+	// debug log every message with its sequence number
+	logSequence bool
+
+	// maximum message length negotiated in handshake, both ways
+	maxMsgLen uint64
+
+	// connection is closed after that many stale heartbeats, zero never
+	stallLimit uint32
+	// total difficulties at the last heartbeat, used by read handler only
+	lastRemoteDifficulty consensus.Difficulty
+	lastLocalDifficulty  consensus.Difficulty
+
+	// receives chain state, headers and blocks from the peer
+	syncManager *SyncManager
+
+	// tells time of received messages, pings and the address accept window
+	clock consensus.Clock
+
+	// known peers exchanged with the peer
+	peerStore *PeerStore
+	// start of the current address accept window, used by read handler only
+	addrWindowStart time.Time
+	// addresses accepted in the current window
+	addrAccepted int
+
+	// receives blocks and transactions from the peer
+	gossipHandler func(Gossip) error
+
+	// serves blocks requested by the peer
+	blockCache *BlockCache
+
+	// serves headers requested by the peer
+	headerSource HeaderSource
+
+	// guards filter
+	filterMu sync.RWMutex
+	// transactions known by the peer, not relayed to it
+	filter *BloomFilter
+
+	// requests waiting for response
+	requests *pendingRequests
+	// how long requests wait for response
+	requestTimeout time.Duration
+
+	// guards Ping waiting for Pong
+	pingMu sync.Mutex
+	// nonce of the Ping waiting for Pong, zero if none
+	pingNonce uint64
+	// time the Ping waiting for Pong was sent
+	pingSent time.Time
+
 	hand hand
 
-	// Info connected peer
-	Info struct {
+	// guards info updated by read handler
+	infoMu sync.RWMutex
+
+	// connection direction
+	direction Direction
+
+	// identifies remote node
+	id PeerID
+
+	// address the remote node listens on: remote IP with the port
+	// advertised in hand for inbound peers, the dialed address for outbound
+	listenAddr *net.TCPAddr
+
+	// info connected peer, guarded by infoMu once the peer is started
+	info struct {
 		// protocol version of the sender
 		Version uint32
 		// capabilities of the sender
@@ -46,63 +182,225 @@ type Peer struct {
 	}
 }
 
+// newPeer creates peer over established connection
+func newPeer(conn net.Conn) *Peer {
+	p := new(Peer)
+	p.conn = conn
+	p.quit = make(chan struct{})
+	p.sendQueue = make(chan Message)
+	rate := DefaultMessageRate(*consensus.DefaultNetwork())
+	p.msgLimiter = newTokenBucket(rate, rate*peerMessageBurst/peerMessageRate)
+	p.rateCooldown = peerRateCooldown
+	p.requests = newPendingRequests()
+	p.requestTimeout = requestTimeout
+	p.idleTimeout = defaultIdleTimeout
+	p.maxMsgLen = consensus.MaxMsgLen
+	p.clock = consensus.RealClock
+	p.lastReceived = p.clock.Now().UnixNano()
+
+	return p
+}
+
+// DefaultMessageRate returns number of messages per second a peer may send
+// on network of params. Traffic grows with the number of blocks, so the rate
+// allowed at mainnet block time is scaled by how much faster blocks come.
+func DefaultMessageRate(params consensus.NetworkParams) int {
+	if params.BlockTimeSec == 0 {
+		return peerMessageRate
+	}
+
+	rate := peerMessageRate * consensus.BlockTimeSec / params.BlockTimeSec
+	if rate < minMessageRate {
+		return minMessageRate
+	}
+
+	return int(rate)
+}
+
 // NewPeer connects to peer
 func NewPeer(addr string) (*Peer, error) {
+	return DialPeer(addr, defaultDialTimeout, defaultHandshakeTimeout, 0)
+}
 
-	logrus.Info("start new peer")
-	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+// DialPeer connects to peer at addr parsed by ParsePeerAddr, failing if
+// the connection is not established in dialTimeout or the handshake is not
+// completed in handshakeTimeout. Zero timeout means no timeout. listenPort
+// is advertised in hand for the peer to connect back, zero advertises the
+// local port of the connection.
+func DialPeer(addr string, dialTimeout, handshakeTimeout time.Duration, listenPort uint16) (*Peer, error) {
+
+	logger.Info("start new peer")
+	raddr, err := ParsePeerAddr(addr)
 	if err != nil {
 		return nil, err
 	}
 
-	conn, err := net.DialTCP("tcp", nil, tcpAddr)
+	conn, err := net.DialTimeout("tcp", raddr.String(), dialTimeout)
 	if err != nil {
 		return nil, err
 	}
 
-	logrus.Info("peer connected")
-	shake, err := shakeByHand(conn)
+	logger.Info("peer connected")
+	setHandshakeDeadline(conn, handshakeTimeout)
+	p, err := newPeerConn(conn, listenPort)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
+	conn.SetDeadline(time.Time{})
 
-	p := new(Peer)
-	p.conn = conn
-	p.quit = make(chan struct{})
-	p.sendQueue = make(chan Message)
+	return p, nil
+}
+
+// setHandshakeDeadline limits handshake over conn to timeout, zero means no limit
+func setHandshakeDeadline(conn net.Conn, timeout time.Duration) {
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+}
+
+// NewPeerConn creates peer over established outbound connection
+func NewPeerConn(conn net.Conn) (*Peer, error) {
+	return newPeerConn(conn, 0)
+}
+
+// newPeerConn creates peer over established outbound connection
+// advertising listenPort in hand
+func newPeerConn(conn net.Conn, listenPort uint16) (*Peer, error) {
+
+	shake, err := shakeByHand(conn, listenPort)
+	if err != nil {
+		return nil, err
+	}
 
-	p.Info.Version = shake.Version
-	p.Info.Capabilities = shake.Capabilities
-	p.Info.TotalDifficulty = shake.TotalDifficulty
-	p.Info.UserAgent = shake.UserAgent
+	p := newPeer(conn)
+	p.direction = Outbound
+	p.id = newPeerID(shake.Nonce, shake.UserAgent)
+	p.maxMsgLen = negotiateMaxMsgLen(shake.MaxMsgLen)
+	p.listenAddr = tcpAddr(conn.RemoteAddr())
+
+	p.info.Version = shake.Version
+	p.info.Capabilities = shake.Capabilities
+	p.info.TotalDifficulty = shake.TotalDifficulty
+	p.info.UserAgent = shake.UserAgent
 
 	return p, nil
 }
 
 // AcceptNewPeer creates peer accepting listening server conn
 func AcceptNewPeer(conn net.Conn) (*Peer, error) {
+	return acceptPeer(conn, localNonce)
+}
+
+// acceptPeer creates peer accepting conn, presenting nonce in shake
+func acceptPeer(conn net.Conn, nonce uint64) (*Peer, error) {
 
-	logrus.Info("accept new peer")
-	hand, err := handByShake(conn)
+	logger.Info("accept new peer")
+	hand, err := handByShake(conn, nonce)
 	if err != nil {
 		return nil, err
 	}
 
-	p := new(Peer)
-	p.conn = conn
-	p.quit = make(chan struct{})
-	p.sendQueue = make(chan Message)
+	p := newPeer(conn)
+	p.direction = Inbound
+	p.id = newPeerID(hand.Nonce, hand.UserAgent)
+	p.maxMsgLen = negotiateMaxMsgLen(hand.MaxMsgLen)
+
+	// the connection comes from an ephemeral port, the peer listens on
+	// the port it advertised
+	remote := tcpAddr(conn.RemoteAddr())
+	p.listenAddr = &net.TCPAddr{IP: remote.IP, Port: hand.SenderAddr.Port, Zone: remote.Zone}
 
-	p.Info.Version = hand.Version
-	p.Info.Capabilities = hand.Capabilities
-	p.Info.TotalDifficulty = hand.TotalDifficulty
-	p.Info.UserAgent = hand.UserAgent
+	p.info.Version = hand.Version
+	p.info.Capabilities = hand.Capabilities
+	p.info.TotalDifficulty = hand.TotalDifficulty
+	p.info.UserAgent = hand.UserAgent
 
 	return p, nil
 }
 
+// SetRateLimit limits peer connection bandwidth to readBps and writeBps
+// bytes per second. It must be called before Start.
+func (p *Peer) SetRateLimit(readBps, writeBps int) {
+	p.conn = NewLimitedConn(p.conn, readBps, writeBps)
+}
+
+// SetRateCooldown sets how long reading from the peer is paused once it
+// exceeds message rate. It must be called before Start.
+func (p *Peer) SetRateCooldown(d time.Duration) {
+	p.rateCooldown = d
+}
+
+// SetRequestTimeout sets how long requests to the peer wait for the
+// response. It must be called before Start.
+func (p *Peer) SetRequestTimeout(d time.Duration) {
+	p.requestTimeout = d
+}
+
+// SetIdleTimeout sets how long the peer may send nothing before it's
+// disconnected, zero disables the timeout. It must be called before Start.
+func (p *Peer) SetIdleTimeout(d time.Duration) {
+	p.idleTimeout = d
+}
+
+// SetClock sets clock telling time of received messages, pings and the
+// address accept window. It must be called before Start.
+func (p *Peer) SetClock(c consensus.Clock) {
+	p.clock = c
+	p.lastReceived = c.Now().UnixNano()
+}
+
+// SetSequenceLogging enables debug log of every message sent and received
+// with its sequence number on the connection, to correlate logs of both
+// peers. It must be called before Start.
+func (p *Peer) SetSequenceLogging(enabled bool) {
+	p.logSequence = enabled
+}
+
+// Sequence returns sequence numbers of the last message sent to and
+// received from the peer, counted from 1
+func (p *Peer) Sequence() (sent, received uint64) {
+	return atomic.LoadUint64(&p.sentSeq), atomic.LoadUint64(&p.receivedSeq)
+}
+
+// SetSyncManager sets sync manager notified about chain state, headers and
+// blocks received from the peer. It must be called before Start.
+func (p *Peer) SetSyncManager(m *SyncManager) {
+	p.syncManager = m
+}
+
+// SetPeerStore sets store used to answer and to save peer addresses
+// exchanged with the peer. It must be called before Start.
+func (p *Peer) SetPeerStore(s *PeerStore) {
+	p.peerStore = s
+}
+
+// SetGossipHandler sets handler receiving blocks and transactions from the
+// peer, tagged with the peer as source. Error returned by the handler is
+// sent to the peer as Reject, with code of RejectError or RejectInvalid.
+// It must be called before Start.
+func (p *Peer) SetGossipHandler(h func(Gossip) error) {
+	p.gossipHandler = h
+}
+
+// SetBlockCache sets cache serving blocks requested by the peer. It must
+// be called before Start.
+func (p *Peer) SetBlockCache(c *BlockCache) {
+	p.blockCache = c
+}
+
+// SetHeaderSource sets source of headers requested by the peer. It must
+// be called before Start.
+func (p *Peer) SetHeaderSource(src HeaderSource) {
+	p.headerSource = src
+}
+
 // Start starts loop listening, write handler and so on
-func (p Peer) Start() {
+func (p *Peer) Start() {
+	if p.syncManager != nil {
+		p.syncManager.AddPeer(p)
+	}
+
 	p.wg.Add(2)
 	go p.writeHandler()
 	go p.readHandler()
@@ -112,18 +410,39 @@ func (p Peer) Start() {
 // queue, and writing them out to the wire.
 //
 // NOTE: This method MUST be run as a goroutine.
-func (p Peer) writeHandler() {
+func (p *Peer) writeHandler() {
 	var exitError error
+	enc := NewEncoder(p.conn)
+	enc.SetCompression(p.PeerCapabilities()&consensus.CapCompression != 0)
+	enc.SetMaxMessageLen(p.maxMsgLen)
 
 out:
 	for {
 		select {
 		case msg := <-p.sendQueue:
-			var written uint64
-			if written, exitError = WriteMessage(p.conn, msg); exitError != nil {
+			written := enc.Written()
+			p.writeMu.Lock()
+			if exitError = enc.Encode(msg); exitError == nil {
+				exitError = enc.Flush()
+			}
+			p.writeMu.Unlock()
+			atomic.AddUint64(&p.bytesSent, enc.Written()-written)
+			if exitError == ErrMessageTooBig {
+				// nothing is written, the remote would reject it
+				logger.Warn("skip message above peer limit, type: ", msg.Type())
+				exitError = nil
+				continue
+			}
+			if exitError != nil {
+				// e.g. broken pipe when remote closed the connection
+				logger.Info("cannot write to peer: ", exitError)
 				break out
 			}
-			atomic.AddUint64(&p.bytesSent, written)
+
+			seq := atomic.AddUint64(&p.sentSeq, 1)
+			if p.logSequence {
+				logger.Debug("sent message #", seq, " type: ", msg.Type())
+			}
 		case <-p.quit:
 			exitError = errors.New("peer exiting")
 			break out
@@ -135,10 +454,13 @@ out:
 }
 
 // queueMessage places msg to send queue
-func (p Peer) queueMessage(msg Message) {
+func (p *Peer) queueMessage(msg Message) error {
 	select {
-	case <-p.quit: logrus.Info("cannot send message, peer is shutting down")
+	case <-p.quit:
+		logger.Info("cannot send message, peer is shutting down")
+		return ErrPeerDisconnected
 	case p.sendQueue <- msg:
+		return nil
 	}
 }
 
@@ -146,133 +468,836 @@ func (p Peer) queueMessage(msg Message) {
 // properly dispatching the handling of the message to the proper subsystem.
 //
 // NOTE: This method MUST be run as a goroutine.
-func (p Peer) readHandler() {
+func (p *Peer) readHandler() {
 	var exitError error
+	var exitCode uint32
 	input := bufio.NewReader(p.conn)
 	header := new(Header)
 
-out:
 	for atomic.LoadInt32(&p.disconnect) == 0 {
-		if exitError := header.Read(input); exitError != nil {
+		// slow down peer exceeding message rate
+		if !p.msgLimiter.allow() {
+			p.throttle()
+		}
+
+		// close silent connection
+		if p.idleTimeout > 0 {
+			p.conn.SetReadDeadline(time.Now().Add(p.idleTimeout))
+		}
+
+		if exitError = header.Read(input); exitError != nil {
+			if ne, ok := exitError.(net.Error); ok && ne.Timeout() {
+				exitError = ErrIdleTimeout
+			}
+
+			// a peer closing connection between messages is a normal disconnect
+			if exitError == io.ErrUnexpectedEOF {
+				logger.Info("peer closed connection within message header")
+			} else if !isConnError(exitError) && exitError != ErrIdleTimeout {
+				logger.Warn("invalid message header from peer: ", exitError)
+				exitCode = ErrCodeBadMessage
+			}
 			break
 		}
-		logrus.Debug("received header: ", header)
+		logger.Debug("received header: ", header)
+		atomic.StoreInt64(&p.lastReceived, p.clock.Now().UnixNano())
+
+		seq := atomic.AddUint64(&p.receivedSeq, 1)
+		if p.logSequence {
+			logger.Debug("received message #", seq, " type: ", header.Type)
+		}
 
-		if header.Len > consensus.MaxMsgLen {
-			exitError = errors.New("too big message size")
+		if header.Len > p.maxMsgLen {
+			exitError = ErrMessageTooBig
+			exitCode = ErrCodeBadMessage
 			break
 		}
 
+		countMessage(header.Type, Inbound)
+
 		// limit read
-		rl := io.LimitReader(input, int64(header.Len))
+		rl := &io.LimitedReader{R: input, N: int64(header.Len)}
 
-		switch header.Type {
-		case consensus.MsgTypePing:
-			// update peer info & send Pong
-			var msg Ping
-			if exitError = msg.Read(rl); exitError != nil {
-				break out
+		var body io.Reader = rl
+		if header.Compressed {
+			if body, exitError = decompressBody(rl, p.maxMsgLen); exitError != nil {
+				if rl.N == 0 || !isConnError(exitError) {
+					logger.Warn("invalid compressed message from peer: ", exitError)
+					exitCode = ErrCodeBadMessage
+				}
+				break
 			}
+		}
 
-			// update info
-			p.Info.TotalDifficulty = msg.TotalDifficulty
-			p.Info.Height = msg.Height
-
-			logrus.Debug("received Ping: ", msg)
-			// send Pong
-			// TODO: send actual blockchain state
-			var resp Pong
-			resp.TotalDifficulty = consensus.Difficulty(1)
-			resp.Height = 1
-			p.queueMessage(&resp)
+		if exitError = p.handleMessage(header.Type, body); exitError != nil {
+			if exitError == ErrPeerStalled {
+				logger.Info("disconnect stalled peer")
+				break
+			}
 
-		case consensus.MsgTypePong:
-			// update peer info
-			var msg Pong
-			if exitError = msg.Read(rl); exitError != nil {
-				break out
+			// body is cut by closed connection unless whole declared length was read
+			if rl.N == 0 || !isConnError(exitError) {
+				logger.Warn("invalid message from peer: ", exitError)
+				exitCode = ErrCodeBadMessage
 			}
+			break
+		}
 
-			// update info
-			p.Info.TotalDifficulty = msg.TotalDifficulty
-			p.Info.Height = msg.Height
+		// skip unread part of message body
+		if _, exitError = io.Copy(ioutil.Discard, rl); exitError != nil {
+			break
+		}
 
-			logrus.Debug("received Pong: ", msg)
+		// update recv bytes counter
+		atomic.AddUint64(&p.bytesReceived, header.Len + consensus.HeaderLen)
+	}
 
-		case consensus.MsgTypeGetPeerAddrs:
-			var msg GetPeerAddrs
-			if exitError = msg.Read(rl); exitError != nil {
-				break out
+	p.wg.Done()
+	if exitCode != 0 {
+		p.CloseWithReason(exitCode, exitError.Error())
+	} else {
+		p.Disconnect(exitError)
+	}
+}
+
+// SetStallLimit sets number of stale heartbeats after which the peer is
+// disconnected, zero keeps stalled peer connected. It must be called before
+// Start.
+func (p *Peer) SetStallLimit(n int) {
+	p.stallLimit = uint32(n)
+}
+
+// checkStalled counts heartbeats the peer advertises no more total
+// difficulty than before while our chain grows past it. A peer advertising
+// more resets the count. Returns ErrPeerStalled once stall limit is reached.
+func (p *Peer) checkStalled(remote consensus.Difficulty) error {
+	if p.syncManager == nil {
+		return nil
+	}
+
+	local := p.syncManager.Tip().TotalDifficulty
+	switch {
+	case remote > p.lastRemoteDifficulty:
+		atomic.StoreUint32(&p.staleHeartbeats, 0)
+	case local > p.lastLocalDifficulty && local > remote:
+		atomic.AddUint32(&p.staleHeartbeats, 1)
+	}
+
+	p.lastRemoteDifficulty = remote
+	p.lastLocalDifficulty = local
+
+	if p.stallLimit > 0 && atomic.LoadUint32(&p.staleHeartbeats) >= p.stallLimit {
+		return ErrPeerStalled
+	}
+
+	return nil
+}
+
+// IsStalled checks whether peer total difficulty didn't grow over the last
+// stalledHeartbeats heartbeats while ours did, the peer may be stuck or on
+// a dead fork
+func (p *Peer) IsStalled() bool {
+	return atomic.LoadUint32(&p.staleHeartbeats) >= stalledHeartbeats
+}
+
+// LastReceived returns time the last message was received from the peer
+func (p *Peer) LastReceived() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&p.lastReceived))
+}
+
+// isConnError checks whether err comes from the connection (closed by the
+// peer or broken) rather than from message content
+func isConnError(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF || errors.Is(err, net.ErrClosed) {
+		return true
+	}
+
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// handleMessage reads message body of type typ from rl and dispatches it
+func (p *Peer) handleMessage(typ uint8, rl io.Reader) error {
+	switch typ {
+	case consensus.MsgTypePing:
+		// update peer info & send Pong
+		var msg Ping
+		if err := msg.Read(rl); err != nil {
+			return err
+		}
+
+		if !PlausiblePing(msg, *consensus.DefaultNetwork()) {
+			return ErrImplausiblePing
+		}
+
+		// update info
+		p.updateRemoteState(msg.TotalDifficulty, msg.Height)
+		if err := p.checkStalled(msg.TotalDifficulty); err != nil {
+			return err
+		}
+
+		logger.Debug("received Ping: ", msg)
+		if p.syncManager != nil {
+			p.syncManager.OnPing(p, &msg)
+		}
+
+		// send Pong
+		// TODO: send actual blockchain state
+		// genesis state until then, a plausible one
+		var resp Pong
+		resp.TotalDifficulty = consensus.DefaultNetwork().Genesis.TotalDifficulty
+		resp.Height = 0
+		resp.Nonce = msg.Nonce
+		p.queueMessage(&resp)
+
+	case consensus.MsgTypePong:
+		// update peer info
+		var msg Pong
+		if err := msg.Read(rl); err != nil {
+			return err
+		}
+
+		// drop Pong not answering our Ping
+		sent, ok := p.takePing(msg.Nonce)
+		if !ok {
+			atomic.AddUint64(&p.unsolicitedPongs, 1)
+			logger.Debug("ignore unsolicited Pong: ", msg)
+			return nil
+		}
+
+		if !PlausiblePing(msg.Ping, *consensus.DefaultNetwork()) {
+			return ErrImplausiblePing
+		}
+
+		// update info
+		p.updateRemoteState(msg.TotalDifficulty, msg.Height)
+		if err := p.checkStalled(msg.TotalDifficulty); err != nil {
+			return err
+		}
+		atomic.StoreInt64(&p.rtt, int64(p.clock.Now().Sub(sent)))
+
+		logger.Debug("received Pong: ", msg)
+
+	case consensus.MsgTypeGetPeerAddrs:
+		var msg GetPeerAddrs
+		if err := msg.Read(rl); err != nil {
+			return err
+		}
+		logger.Debug("received msgTypeGetPeerAddrs")
+
+		// Send answer, with capabilities of the peers if remote takes them
+		if p.PeerCapabilities()&consensus.CapPeerAddrsV2 != 0 {
+			var resp PeerAddrsV2
+			if p.peerStore != nil {
+				resp.peers = p.peerStore.PeerAddrs(msg.Capabilities, maxPeerAddresses)
+			}
+			p.queueMessage(&resp)
+			break
+		}
+
+		var resp PeerAddrs
+		if p.peerStore != nil {
+			resp.peers = p.peerStore.Peers(msg.Capabilities, maxPeerAddresses)
+		}
+		p.queueMessage(&resp)
+
+	case consensus.MsgTypePeerAddrs:
+		var msg PeerAddrs
+		if err := msg.Read(rl); err != nil {
+			return err
+		}
+		logger.Debug("received msgTypePeerAddrs")
+		if p.requests.deliver(requestKey{typ: consensus.MsgTypePeerAddrs}, &msg) {
+			break
+		}
+		if p.peerStore != nil {
+			peers := make([]PeerAddr, len(msg.peers))
+			for i, addr := range msg.peers {
+				peers[i] = PeerAddr{Addr: addr, Capabilities: consensus.CapUnknown}
 			}
-			logrus.Info("received msgTypeGetPeerAddrs")
+			p.acceptPeerAddrs(peers)
+		}
 
-			// Send answer
-			var resp PeerAddrs
+	case consensus.MsgTypePeerAddrsV2:
+		var msg PeerAddrsV2
+		if err := msg.Read(rl); err != nil {
+			return err
+		}
+		logger.Debug("received msgTypePeerAddrsV2")
+		if p.requests.deliver(requestKey{typ: consensus.MsgTypePeerAddrsV2}, &msg) {
+			break
+		}
+		if p.peerStore != nil {
+			p.acceptPeerAddrs(msg.peers)
+		}
+
+	case consensus.MsgTypeGetHeaders:
+		var msg GetHeaders
+		if err := msg.Read(rl); err != nil {
+			return err
+		}
+		logger.Debug("received msgTypeGetHeaders")
+		if p.headerSource == nil {
+			break
+		}
+		// headers above the highest block shared with the peer, none if
+		// there's no such block as the peer couldn't connect them
+		var headers []consensus.BlockHeader
+		if height, ok := FindForkPoint(msg.Locator, p.headerSource.BlockHeight); ok {
+			headers = p.headerSource.HeadersFrom(height+1, maxHeaders)
+		}
+		p.queueMessage(&Headers{Headers: truncateHeaders(headers, msg.StopHash)})
+	case consensus.MsgTypeHeaders:
+		var msg Headers
+		if err := msg.Read(rl); err != nil {
+			return err
+		}
+		logger.Debug("received msgTypeHeaders")
+		if p.requests.deliver(requestKey{typ: consensus.MsgTypeHeaders}, &msg) {
+			break
+		}
+		if p.syncManager != nil {
+			p.syncManager.OnHeaders(p, msg.Headers)
+		}
+	case consensus.MsgTypeGetBlock:
+		var msg GetBlockHash
+		if err := msg.Read(rl); err != nil {
+			return err
+		}
+		logger.Debug("received msgTypeGetBlock")
+		if p.blockCache != nil {
+			if data, ok := p.blockCache.Get(msg.Hash); ok {
+				resp := rawBlock(data)
+				p.queueMessage(&resp)
+				break
+			}
+		}
+		// tell the peer instead of letting its request time out
+		p.reject(consensus.MsgTypeGetBlock, msg.Hash, &RejectError{Code: RejectNotFound, Reason: ErrBlockNotFound.Error()})
+	case consensus.MsgTypeBlock:
+		var msg consensus.Block
+		if err := msg.Read(rl); err != nil {
+			return err
+		}
+		logger.Debug("received msgTypeBlock")
+		if p.requests.deliver(requestKey{typ: consensus.MsgTypeBlock, id: msg.Header.Hash()}, &msg) {
+			break
+		}
+		if p.syncManager != nil {
+			p.syncManager.OnBlock(p, &msg)
+		}
+		if p.gossipHandler != nil {
+			if err := p.gossipHandler(Gossip{Msg: &msg, Source: p}); err != nil {
+				p.reject(consensus.MsgTypeBlock, msg.Header.Hash(), err)
+			}
+		}
+	case consensus.MsgTypeCompactBlock:
+		var msg CompactBlock
+		if err := msg.Read(rl); err != nil {
+			return err
+		}
+		logger.Debug("received msgTypeCompactBlock")
+	case consensus.MsgTypeGetTip:
+		logger.Debug("received msgTypeGetTip")
+		if p.syncManager != nil {
+			resp := p.syncManager.Tip()
 			p.queueMessage(&resp)
+		}
+	case consensus.MsgTypeTip:
+		var msg Tip
+		if err := msg.Read(rl); err != nil {
+			return err
+		}
+		logger.Debug("received msgTypeTip")
+		p.requests.deliver(requestKey{typ: consensus.MsgTypeTip}, &msg)
+	case consensus.MsgTypeSetFilter:
+		var msg SetFilter
+		if err := msg.Read(rl); err != nil {
+			return err
+		}
+		logger.Debug("received msgTypeSetFilter")
+		p.filterMu.Lock()
+		if len(msg.Filter.bits) == 0 {
+			p.filter = nil
+		} else {
+			p.filter = &msg.Filter
+		}
+		p.filterMu.Unlock()
+	case consensus.MsgTypeTransaction:
+		var msg consensus.Transaction
+		if err := msg.Read(rl); err != nil {
+			return err
+		}
+		logger.Debug("received msgTypeTransaction")
+		if p.gossipHandler != nil {
+			if err := p.gossipHandler(Gossip{Msg: &msg, Source: p}); err != nil {
+				p.reject(consensus.MsgTypeTransaction, msg.Hash(), err)
+			}
+		}
+	case consensus.MsgTypeInv:
+		var msg Inv
+		if err := msg.Read(rl); err != nil {
+			return err
+		}
+		logger.Debug("received msgTypeInv")
+		if p.syncManager == nil {
+			break
+		}
+		for _, item := range msg.Items {
+			if item.Type == InvBlock && !p.syncManager.HasBlock(item.Hash) {
+				p.GetBlock(item.Hash)
+			}
+		}
+	case consensus.MsgTypeReject:
+		var msg Reject
+		if err := msg.Read(rl); err != nil {
+			return err
+		}
+		logger.Info("peer rejected ", msg.Hash, ": ", msg.Reason)
+		if msg.MsgType == consensus.MsgTypeGetBlock {
+			p.requests.deliver(requestKey{typ: consensus.MsgTypeBlock, id: msg.Hash}, &msg)
+		}
 
-		case consensus.MsgTypePeerAddrs:
-			var msg PeerAddrs
-			if exitError = msg.Read(rl); exitError != nil {
-				break out
+	case consensus.MsgTypeGetUTXOSet:
+		var msg GetUTXOSet
+		if err := msg.Read(rl); err != nil {
+			return err
+		}
+		logger.Debug("received msgTypeGetUTXOSet")
+	case consensus.MsgTypeUTXOSetChunk:
+		var msg UTXOSetChunk
+		if err := msg.Read(rl); err != nil {
+			return err
+		}
+		logger.Debug("received msgTypeUTXOSetChunk")
+	default:
+		return errors.New("receive unexpected message (type) from peer")
+	}
+
+	return nil
+}
+
+// throttle pauses reading from peer exceeding message rate for the rate
+// cooldown, the peer is notified the first time only
+func (p *Peer) throttle() {
+	logger.Info("peer exceeds message rate, pause reading")
+
+	if !p.rateLimitNotified {
+		p.rateLimitNotified = true
+
+		var msg PeerError
+		msg.Code = ErrCodeRateLimited
+		msg.Message = "too many requests"
+		p.queueMessage(&msg)
+	}
+
+	select {
+	case <-time.After(p.rateCooldown):
+	case <-p.quit:
+	}
+}
+
+// acceptPeerAddrs adds unsolicited addresses to peer store, up to
+// addrAcceptMax per addrAcceptWindow so the peer can't flood the store
+func (p *Peer) acceptPeerAddrs(addrs []PeerAddr) {
+	if now := p.clock.Now(); now.Sub(p.addrWindowStart) > addrAcceptWindow {
+		p.addrWindowStart = now
+		p.addrAccepted = 0
+	}
+
+	for _, addr := range addrs {
+		if p.addrAccepted >= addrAcceptMax {
+			atomic.AddUint64(&p.droppedAddrs, 1)
+			continue
+		}
+
+		// addresses without capabilities (PeerAddrs v1) don't overwrite
+		// what we know, only new ones are counted
+		if addr.Capabilities == consensus.CapUnknown {
+			if p.peerStore.AddPeerAddr(addr.Addr) {
+				p.addrAccepted++
 			}
-			logrus.Info("received msgTypePeerAddrs")
-		case consensus.MsgTypeGetHeaders:
-			logrus.Info("received msgTypeGetHeaders")
-		case consensus.MsgTypeHeaders:
-			logrus.Info("received msgTypeHeaders")
-		case consensus.MsgTypeGetBlock:
-			logrus.Info("received msgTypeGetBlock")
-		case consensus.MsgTypeBlock:
-			logrus.Info("received msgTypeBlock")
-		case consensus.MsgTypeTransaction:
-			logrus.Info("received msgTypeTransaction")
-
-		default:
-			exitError = errors.New("receive unexpected message (type) from peer")
-			break out
+			continue
 		}
 
-		// update recv bytes counter
-		atomic.AddUint64(&p.bytesReceived, header.Len + consensus.HeaderLen)
+		p.peerStore.AddPeer(addr.Addr, addr.Capabilities)
+		p.addrAccepted++
 	}
+}
 
-	p.wg.Done()
-	p.Disconnect(exitError)
+// DroppedAddrs returns number of peer addresses from the peer ignored over
+// the accept limit
+func (p *Peer) DroppedAddrs() uint64 {
+	return atomic.LoadUint64(&p.droppedAddrs)
+}
+
+// takePing returns send time of the Ping with nonce waiting for Pong and
+// stops waiting for it
+func (p *Peer) takePing(nonce uint64) (time.Time, bool) {
+	p.pingMu.Lock()
+	defer p.pingMu.Unlock()
+
+	if p.pingNonce == 0 || p.pingNonce != nonce {
+		return time.Time{}, false
+	}
+
+	p.pingNonce = 0
+	return p.pingSent, true
+}
+
+// UnsolicitedPongs returns number of ignored Pongs not answering our Ping
+func (p *Peer) UnsolicitedPongs() uint64 {
+	return atomic.LoadUint64(&p.unsolicitedPongs)
+}
+
+// reject sends Reject of block or transaction hash for reason err
+func (p *Peer) reject(typ uint8, hash consensus.Hash, err error) {
+	msg := Reject{
+		MsgType: typ,
+		Hash:    hash,
+		Code:    RejectInvalid,
+		Reason:  err.Error(),
+	}
+
+	var rejectErr *RejectError
+	if errors.As(err, &rejectErr) {
+		msg.Code = rejectErr.Code
+		msg.Reason = rejectErr.Reason
+	}
+
+	logger.Debug("reject ", hash, ": ", err)
+	p.queueMessage(&msg)
+}
+
+// updateRemoteState stores latest remote chain state advertised by Ping/Pong
+func (p *Peer) updateRemoteState(totalDifficulty consensus.Difficulty, height uint64) {
+	p.infoMu.Lock()
+	defer p.infoMu.Unlock()
+
+	p.info.TotalDifficulty = totalDifficulty
+	p.info.Height = height
+}
+
+// Addr returns remote address of the peer connection
+func (p *Peer) Addr() *net.TCPAddr {
+	return tcpAddr(p.conn.RemoteAddr())
+}
+
+// ListenAddr returns address the remote node accepts connections on
+func (p *Peer) ListenAddr() *net.TCPAddr {
+	return p.listenAddr
+}
+
+// MaxMessageLen returns maximum message length negotiated with the peer
+func (p *Peer) MaxMessageLen() uint64 {
+	return p.maxMsgLen
+}
+
+// PeerID returns identifier of the remote node
+func (p *Peer) PeerID() PeerID {
+	return p.id
+}
+
+// PeerCapabilities returns capabilities advertised by the peer in handshake
+func (p *Peer) PeerCapabilities() consensus.Capabilities {
+	p.infoMu.RLock()
+	defer p.infoMu.RUnlock()
+
+	return p.info.Capabilities
+}
+
+// RemoteHeight returns the latest height advertised by the peer
+func (p *Peer) RemoteHeight() uint64 {
+	p.infoMu.RLock()
+	defer p.infoMu.RUnlock()
+
+	return p.info.Height
+}
+
+// RemoteTotalDifficulty returns the latest total difficulty advertised by the peer
+func (p *Peer) RemoteTotalDifficulty() consensus.Difficulty {
+	p.infoMu.RLock()
+	defer p.infoMu.RUnlock()
+
+	return p.info.TotalDifficulty
+}
+
+// PeerInfo is a snapshot of connected peer state
+type PeerInfo struct {
+	// remote address of the connection
+	Addr *net.TCPAddr
+	// address the peer accepts connections on
+	ListenAddr *net.TCPAddr
+	// name of version of the peer software
+	UserAgent string
+	// protocol version of the peer
+	Version uint32
+	// capabilities advertised by the peer
+	Capabilities consensus.Capabilities
+	// latest height advertised by the peer
+	Height uint64
+	// latest total difficulty advertised by the peer
+	TotalDifficulty consensus.Difficulty
+	// round trip time measured by the last Ping/Pong, zero if unknown
+	RTT time.Duration
+	// bytes sent to the peer
+	BytesSent uint64
+	// bytes received from the peer
+	BytesReceived uint64
+	// who initiated the connection
+	Direction Direction
 }
 
-// Disconnect closes peer connection
-func (p Peer) Disconnect(reason error) {
+// Info returns snapshot of the peer state
+func (p *Peer) Info() PeerInfo {
+	p.infoMu.RLock()
+	defer p.infoMu.RUnlock()
+
+	return PeerInfo{
+		Addr:            p.Addr(),
+		ListenAddr:      p.listenAddr,
+		UserAgent:       p.info.UserAgent,
+		Version:         p.info.Version,
+		Capabilities:    p.info.Capabilities,
+		Height:          p.info.Height,
+		TotalDifficulty: p.info.TotalDifficulty,
+		RTT:             time.Duration(atomic.LoadInt64(&p.rtt)),
+		BytesSent:       atomic.LoadUint64(&p.bytesSent),
+		BytesReceived:   atomic.LoadUint64(&p.bytesReceived),
+		Direction:       p.direction,
+	}
+}
+
+// CloseWithReason sends PeerError with code and message to the peer
+// and closes connection
+func (p *Peer) CloseWithReason(code uint32, msg string) {
+	if atomic.LoadInt32(&p.disconnect) != 0 {
+		return
+	}
+
+	p.writeMu.Lock()
+	sendPeerError(p.conn, code, msg)
+	p.writeMu.Unlock()
+
+	p.Disconnect(errors.New(msg))
+}
+
+// Disconnect closes peer connection. It returns once the read and write
+// handlers exit, a pending message read is aborted rather than waited for.
+func (p *Peer) Disconnect(reason error) {
 	if !atomic.CompareAndSwapInt32(&p.disconnect, 0, 1) {
 		return
 	}
 
-	logrus.Info("Disconnect peer: ", reason)
+	logger.Info("Disconnect peer: ", reason)
 
 	close(p.quit)
+	// expired deadline unblocks pending read even if closing the conn
+	// doesn't, read handler checks disconnect flag before it's reset
+	p.conn.SetReadDeadline(time.Now())
 	p.conn.Close()
 	p.wg.Wait()
+
+	if p.syncManager != nil {
+		p.syncManager.RemovePeer(p)
+	}
 }
 
 // WaitForDisconnect waits until the peer has disconnected.
-func (p Peer) WaitForDisconnect() {
+func (p *Peer) WaitForDisconnect() {
 	<-p.quit
 }
 
-// SendPing sends Ping request to peer
-func (p Peer) SendPing() {
+// Send queues message to send to peer, fails if the peer is disconnected or
+// doesn't take the message in sendTimeout. Transactions in the peer filter
+// are skipped.
+func (p *Peer) Send(msg Message) error {
+	if tx, ok := msg.(*consensus.Transaction); ok && p.knowsTransaction(tx) {
+		return nil
+	}
+
+	timer := time.NewTimer(sendTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-p.quit:
+		return ErrPeerDisconnected
+	case p.sendQueue <- msg:
+		return nil
+	case <-timer.C:
+		return ErrSendTimeout
+	}
+}
+
+// Close closes connection with peer
+func (p *Peer) Close() {
+	p.Disconnect(errors.New("closed by local node"))
+}
+
+// request sends msg and waits for the response identified by key
+func (p *Peer) request(msg Message, key requestKey) (Message, error) {
+	return p.requestContext(context.Background(), msg, key)
+}
+
+// requestContext sends msg and waits for the response identified by key
+// until ctx is done
+func (p *Peer) requestContext(ctx context.Context, msg Message, key requestKey) (Message, error) {
+	ch, err := p.requests.register(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.queueMessage(msg); err != nil {
+		p.requests.cancel(key)
+		return nil, err
+	}
+
+	return p.requests.wait(ctx, key, ch, p.requestTimeout, p.quit)
+}
+
+// RequestTimeouts returns number of requests to the peer which timed out
+func (p *Peer) RequestTimeouts() uint64 {
+	return p.requests.TimedOut()
+}
+
+// SendPing sends Ping request to peer, returns ErrPeerDisconnected if the
+// peer connection is closed
+func (p *Peer) SendPing() error {
+	// TODO: send actual blockchain state, genesis state until then
 	var request Ping
-	request.TotalDifficulty = consensus.Difficulty(1)
-	request.Height = 1
+	request.TotalDifficulty = consensus.DefaultNetwork().Genesis.TotalDifficulty
+	request.Height = 0
+	// zero nonce means no Ping is waiting for Pong
+	for request.Nonce == 0 {
+		request.Nonce = rand.Uint64()
+	}
 
-	p.queueMessage(&request)
+	p.pingMu.Lock()
+	p.pingNonce = request.Nonce
+	p.pingSent = p.clock.Now()
+	p.pingMu.Unlock()
+
+	return p.queueMessage(&request)
+}
+
+// SendTipRequest asks peer for its chain tip and waits for the response
+func (p *Peer) SendTipRequest() (*Tip, error) {
+	resp, err := p.request(new(GetTip), requestKey{typ: consensus.MsgTypeTip})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.(*Tip), nil
 }
 
 // GetBlock block request by hash
-func (p Peer) GetBlock(hash consensus.BlockHash) {
+func (p *Peer) GetBlock(hash consensus.Hash) {
 	var request GetBlockHash
 	request.Hash = hash
 
-	logrus.Info("request block by hash")
-	logrus.Debug("block hash: ", hash)
+	logger.Debug("request block by hash")
+	logger.Debug("block hash: ", hash)
 	p.queueMessage(&request)
-}
\ No newline at end of file
+}
+
+// SendHeaderRequest requests headers following the first known locator hash
+// and waits for them
+func (p *Peer) SendHeaderRequest(locator []consensus.Hash) ([]*consensus.BlockHeader, error) {
+	var request GetHeaders
+	request.Locator = locator
+
+	logger.Debug("request headers")
+	resp, err := p.request(&request, requestKey{typ: consensus.MsgTypeHeaders})
+	if err != nil {
+		return nil, err
+	}
+
+	// count is checked against maxHeaders by Headers.Read
+	msg := resp.(*Headers)
+	headers := make([]*consensus.BlockHeader, len(msg.Headers))
+	for i := range msg.Headers {
+		headers[i] = &msg.Headers[i]
+	}
+
+	return headers, nil
+}
+
+// SendBlockRequest requests block by hash and waits for it. Once ctx is
+// done the request is dropped and ctx error returned.
+func (p *Peer) SendBlockRequest(ctx context.Context, hash consensus.Hash) (*consensus.Block, error) {
+	var request GetBlockHash
+	request.Hash = hash
+
+	logger.Debug("request block by hash: ", hash)
+	resp, err := p.requestContext(ctx, &request, requestKey{typ: consensus.MsgTypeBlock, id: hash})
+	if err != nil {
+		return nil, err
+	}
+
+	if reject, ok := resp.(*Reject); ok {
+		return nil, &RejectError{Code: reject.Code, Reason: reject.Reason}
+	}
+
+	return resp.(*consensus.Block), nil
+}
+
+// SendPeerRequest requests addresses of peers having capabilities caps
+func (p *Peer) SendPeerRequest(caps consensus.Capabilities) {
+	var request GetPeerAddrs
+	request.Capabilities = caps
+
+	logger.Debug("request peer addrs")
+	p.queueMessage(&request)
+}
+
+// SendBlock sends block to peer, as compact block if the peer can rebuild it
+func (p *Peer) SendBlock(b *consensus.Block) {
+	if p.PeerCapabilities()&consensus.CapCompactBlock != 0 {
+		logger.Debug("send compact block")
+		p.queueMessage(NewCompactBlock(b))
+		return
+	}
+
+	logger.Debug("send full block")
+	p.queueMessage(b)
+}
+
+// AnnounceBlock announces block hash to peer, which requests the block if
+// it doesn't know it
+func (p *Peer) AnnounceBlock(hash consensus.Hash) error {
+	var msg Inv
+	msg.Items = []InvItem{{Type: InvBlock, Hash: hash}}
+
+	logger.Debug("announce block")
+	return p.queueMessage(&msg)
+}
+
+// SendTransaction sends transaction to peer
+func (p *Peer) SendTransaction(tx *consensus.Transaction) {
+	if p.knowsTransaction(tx) {
+		logger.Debug("skip transaction known by peer")
+		return
+	}
+
+	logger.Debug("send transaction")
+	p.queueMessage(tx)
+}
+
+// knowsTransaction checks whether transaction may be in the peer filter
+func (p *Peer) knowsTransaction(tx *consensus.Transaction) bool {
+	p.filterMu.RLock()
+	defer p.filterMu.RUnlock()
+
+	return p.filter != nil && p.filter.MayContain(tx.Hash())
+}
+
+// SendFilter sends filter of transactions known by us, so the peer doesn't
+// relay them to us. Nil filter clears it.
+func (p *Peer) SendFilter(f *BloomFilter) error {
+	var request SetFilter
+	if f != nil {
+		request.Filter = *f
+	}
+
+	return p.queueMessage(&request)
+}
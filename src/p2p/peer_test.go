@@ -0,0 +1,1011 @@
+package p2p
+
+import (
+	"consensus"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// pipePeer creates peer over one end of a pipe, not started yet, and
+// returns the other end
+func pipePeer(t *testing.T) (*Peer, net.Conn) {
+	local, remote := net.Pipe()
+	p := newPeer(local)
+	t.Cleanup(func() {
+		remote.Close()
+		p.Close()
+	})
+
+	return p, remote
+}
+
+func TestDefaultMessageRate(t *testing.T) {
+	mainnet := DefaultMessageRate(consensus.MainnetParams)
+	testnet := DefaultMessageRate(consensus.TestnetParams)
+
+	if testnet <= mainnet {
+		t.Errorf("testnet with faster blocks allows %d messages per second, mainnet %d", testnet, mainnet)
+	}
+
+	slow := consensus.MainnetParams
+	slow.BlockTimeSec *= 1000
+	if rate := DefaultMessageRate(slow); rate != minMessageRate {
+		t.Errorf("slow network allows %d messages per second, want %d", rate, minMessageRate)
+	}
+}
+
+func TestThrottleNotifiesOnce(t *testing.T) {
+	p := newPeer(nil)
+	p.sendQueue = make(chan Message, 2)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.throttle()
+		p.throttle()
+	}()
+
+	msg := <-p.sendQueue
+	if perr, ok := msg.(*PeerError); !ok || perr.Code != ErrCodeRateLimited {
+		t.Fatalf("throttled peer was sent %v", msg)
+	}
+
+	// end the cooldown
+	close(p.quit)
+	<-done
+
+	if n := len(p.sendQueue); n != 0 {
+		t.Errorf("throttled peer was sent %d more messages", n)
+	}
+}
+
+func TestThrottleCooldown(t *testing.T) {
+	const cooldown = 100 * time.Millisecond
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	p := newPeer(local)
+	// two messages at once, the third one exceeds the rate
+	p.msgLimiter = newTokenBucket(1, 2)
+	p.SetRateCooldown(cooldown)
+	p.Start()
+	defer p.Close()
+
+	go func() {
+		for nonce := uint64(1); nonce <= 3; nonce++ {
+			if _, err := WriteMessage(remote, &Ping{Nonce: nonce}); err != nil {
+				return
+			}
+		}
+	}()
+
+	dec := NewDecoder(remote)
+	var throttled time.Time
+	for _, want := range []uint8{consensus.MsgTypePong, consensus.MsgTypePong, consensus.MsgTypeError, consensus.MsgTypePong} {
+		msg, err := dec.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.Type() != want {
+			t.Fatalf("received message of type %d, want %d", msg.Type(), want)
+		}
+
+		if perr, ok := msg.(*PeerError); ok {
+			if perr.Code != ErrCodeRateLimited {
+				t.Errorf("PeerError code %d, want %d", perr.Code, ErrCodeRateLimited)
+			}
+			throttled = time.Now()
+		}
+	}
+
+	// the last Ping is read after the cooldown only
+	if d := time.Since(throttled); d < cooldown*3/4 {
+		t.Errorf("reading resumed %v after throttling, want cooldown %v", d, cooldown)
+	}
+}
+
+func TestPeerInfo(t *testing.T) {
+	a, b := NewTestPair(t)
+
+	// a measures RTT with its Ping, then b advertises its chain
+	if err := a.SendPing(); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "Pong from b", func() bool { return a.Info().RTT > 0 })
+
+	if err := b.Send(&Ping{TotalDifficulty: 1000, Height: 42, Nonce: 1}); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "Ping from b", func() bool { return a.Info().Height == 42 })
+
+	info := a.Info()
+	if info.UserAgent != userAgent || info.Version != consensus.ProtocolVersion ||
+		info.Capabilities != localCapabilities || info.Direction != Outbound {
+		t.Errorf("info %+v doesn't match handshake", info)
+	}
+
+	if info.TotalDifficulty != 1000 {
+		t.Errorf("info total difficulty %d, want 1000", info.TotalDifficulty)
+	}
+
+	if info.BytesSent == 0 || info.BytesReceived == 0 {
+		t.Errorf("info counts %d bytes sent and %d received", info.BytesSent, info.BytesReceived)
+	}
+
+	if dir := b.Info().Direction; dir != Inbound {
+		t.Errorf("dialed peer direction %v, want %v", dir, Inbound)
+	}
+}
+
+func TestRemoteStateFromPing(t *testing.T) {
+	p, remote := pipePeer(t)
+	p.Start()
+
+	if _, err := WriteMessage(remote, &Ping{TotalDifficulty: 1000, Height: 42}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pong is sent once the Ping is handled
+	if _, err := ReadMessage(remote, new(Pong)); err != nil {
+		t.Fatal(err)
+	}
+
+	if h, td := p.RemoteHeight(), p.RemoteTotalDifficulty(); h != 42 || td != 1000 {
+		t.Errorf("remote height %d and total difficulty %d, want 42 and 1000", h, td)
+	}
+}
+
+func TestCloseReasonOnProtocolViolation(t *testing.T) {
+	p, remote := pipePeer(t)
+	p.Start()
+
+	// total difficulty too low for the height
+	if _, err := WriteMessage(remote, &Ping{TotalDifficulty: 1, Height: 1000}); err != nil {
+		t.Fatal(err)
+	}
+
+	var perr PeerError
+	if _, err := ReadMessage(remote, &perr); err != nil {
+		t.Fatal(err)
+	}
+
+	if perr.Code != ErrCodeBadMessage || perr.Message != ErrImplausiblePing.Error() {
+		t.Errorf("remote read PeerError %d %q, want %d %q", perr.Code, perr.Message, ErrCodeBadMessage, ErrImplausiblePing)
+	}
+
+	p.WaitForDisconnect()
+}
+
+func TestSendBlockByCapabilities(t *testing.T) {
+	b := &consensus.Block{}
+	b.Header.Height = 7
+
+	tests := []struct {
+		caps consensus.Capabilities
+		want uint8
+	}{
+		{consensus.CapFullNode, consensus.MsgTypeBlock},
+		{consensus.CapFullNode | consensus.CapCompactBlock, consensus.MsgTypeCompactBlock},
+	}
+
+	for _, tt := range tests {
+		p, remote := pipePeer(t)
+		p.info.Capabilities = tt.caps
+		p.Start()
+
+		p.SendBlock(b)
+		msg, err := NewDecoder(remote).Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.Type() != tt.want {
+			t.Errorf("peer with capabilities %b sent message of type %d, want %d", tt.caps, msg.Type(), tt.want)
+		}
+	}
+}
+
+// writeCountingConn counts writes attempted on the connection
+type writeCountingConn struct {
+	net.Conn
+	writes int32
+}
+
+func (c *writeCountingConn) Write(b []byte) (int, error) {
+	atomic.AddInt32(&c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+func TestCleanRemoteClose(t *testing.T) {
+	capture := new(captureLogger)
+	SetLogger(capture)
+	defer SetLogger(logrus.StandardLogger())
+
+	local, remote := net.Pipe()
+	conn := &writeCountingConn{Conn: local}
+	p := newPeer(conn)
+	p.Start()
+
+	remote.Close()
+	p.WaitForDisconnect()
+	// wait for the handlers to exit
+	p.wg.Wait()
+
+	if n := atomic.LoadInt32(&conn.writes); n != 0 {
+		t.Errorf("%d writes attempted to closed connection", n)
+	}
+
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+	for _, e := range capture.entries {
+		if e.level == "warn" || e.level == "error" {
+			t.Errorf("clean close logged %q at %s level", e.msg, e.level)
+		}
+	}
+}
+
+func TestRequestToDisconnectedPeer(t *testing.T) {
+	p, _ := pipePeer(t)
+	p.Close()
+
+	key := requestKey{typ: consensus.MsgTypeTip}
+	if _, err := p.request(new(GetTip), key); err != ErrPeerDisconnected {
+		t.Errorf("request to disconnected peer: got %v, want %v", err, ErrPeerDisconnected)
+	}
+
+	p.requests.Lock()
+	defer p.requests.Unlock()
+	if n := len(p.requests.requests); n != 0 {
+		t.Errorf("%d requests left pending", n)
+	}
+}
+
+func TestIdleTimeoutDisconnects(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+
+	p, remote := pipePeer(t)
+	p.SetIdleTimeout(timeout)
+	p.Start()
+	start := time.Now()
+
+	// messages keep the peer connected past the timeout
+	dec := NewDecoder(remote)
+	for i := 0; i < 3; i++ {
+		time.Sleep(timeout / 2)
+		if _, err := WriteMessage(remote, &Ping{Nonce: uint64(i + 1)}); err != nil {
+			t.Fatalf("peer disconnected while active: %v", err)
+		}
+		if _, err := dec.Next(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case <-p.quit:
+		t.Fatalf("active peer disconnected after %v", time.Since(start))
+	default:
+	}
+
+	silent := time.Now()
+	select {
+	case <-p.quit:
+	case <-time.After(10 * timeout):
+		t.Fatal("silent peer wasn't disconnected")
+	}
+
+	if d := time.Since(silent); d < timeout*3/4 {
+		t.Errorf("silent peer disconnected after %v, want timeout %v", d, timeout)
+	}
+}
+
+func TestUnsolicitedPongIgnored(t *testing.T) {
+	p, remote := pipePeer(t)
+	p.Start()
+
+	// Pong answering no Ping, even an implausible one, is dropped
+	for _, pong := range []*Pong{
+		{Ping{TotalDifficulty: 1000, Height: 42, Nonce: 1}},
+		{Ping{TotalDifficulty: 1, Height: 1000, Nonce: 2}},
+	} {
+		if _, err := WriteMessage(remote, pong); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eventually(t, "Pongs counted", func() bool { return p.UnsolicitedPongs() == 2 })
+
+	if h, td := p.RemoteHeight(), p.RemoteTotalDifficulty(); h != 0 || td != 0 {
+		t.Errorf("unsolicited Pong set remote height %d and total difficulty %d", h, td)
+	}
+
+	// the peer is still connected and answers Ping
+	if _, err := WriteMessage(remote, &Ping{Nonce: 3}); err != nil {
+		t.Fatal(err)
+	}
+	var pong Pong
+	if _, err := ReadMessage(remote, &pong); err != nil || pong.Nonce != 3 {
+		t.Errorf("Ping after unsolicited Pongs answered with %+v, %v", pong, err)
+	}
+}
+
+// brokenWriteConn fails writes as if the remote closed its read side
+type brokenWriteConn struct {
+	net.Conn
+}
+
+func (c brokenWriteConn) Write(b []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func TestSendPingOnBrokenConn(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	// reading the remote still blocks, only writing fails
+	p := newPeer(brokenWriteConn{local})
+	p.Start()
+
+	if err := p.SendPing(); err != nil {
+		t.Fatalf("first Ping is queued before the write fails, got %v", err)
+	}
+
+	select {
+	case <-p.quit:
+	case <-time.After(time.Second):
+		t.Fatal("peer failing to write wasn't disconnected")
+	}
+	// handlers exit and the connection is closed
+	p.wg.Wait()
+	if _, err := local.Read(make([]byte, 1)); err != io.ErrClosedPipe {
+		t.Errorf("read from peer connection after disconnect: got %v, want %v", err, io.ErrClosedPipe)
+	}
+
+	if err := p.SendPing(); err != ErrPeerDisconnected {
+		t.Errorf("Ping after failed write: got %v, want %v", err, ErrPeerDisconnected)
+	}
+}
+
+// tipResult is the result of SendTipRequest
+type tipResult struct {
+	tip *Tip
+	err error
+}
+
+// requestTip calls SendTipRequest in the background
+func requestTip(p *Peer) chan tipResult {
+	done := make(chan tipResult, 1)
+	go func() {
+		tip, err := p.SendTipRequest()
+		done <- tipResult{tip, err}
+	}()
+	return done
+}
+
+func TestTipRequest(t *testing.T) {
+	p, remote := pipePeer(t)
+	p.Start()
+	dec := NewDecoder(remote)
+
+	// Tip nobody asked for isn't taken as response to a later request,
+	// Pong tells it was handled
+	if _, err := WriteMessages(remote, []Message{&Tip{Height: 1}, &Ping{Nonce: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dec.Next(); err != nil {
+		t.Fatal(err)
+	}
+
+	done := requestTip(p)
+	if msg, err := dec.Next(); err != nil || msg.Type() != consensus.MsgTypeGetTip {
+		t.Fatalf("remote received %v, %v, want GetTip", msg, err)
+	}
+
+	want := &Tip{Hash: consensus.Hash{1}, Height: 42, TotalDifficulty: 1000}
+	if _, err := WriteMessage(remote, want); err != nil {
+		t.Fatal(err)
+	}
+
+	res := <-done
+	if res.err != nil || *res.tip != *want {
+		t.Errorf("tip request returned %+v, %v, want %+v", res.tip, res.err, want)
+	}
+}
+
+func TestTipRequestTimeout(t *testing.T) {
+	p, remote := pipePeer(t)
+	p.SetRequestTimeout(50 * time.Millisecond)
+	p.Start()
+	dec := NewDecoder(remote)
+
+	done := requestTip(p)
+	if _, err := dec.Next(); err != nil {
+		t.Fatal(err)
+	}
+
+	res := <-done
+	if res.err != ErrRequestTimeout {
+		t.Errorf("unanswered tip request returned %v, want %v", res.err, ErrRequestTimeout)
+	}
+	if n := p.RequestTimeouts(); n != 1 {
+		t.Errorf("%d requests timed out, want 1", n)
+	}
+
+	// late response is dropped, the next request gets its own
+	if _, err := WriteMessages(remote, []Message{&Tip{Height: 1}, &Ping{Nonce: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dec.Next(); err != nil {
+		t.Fatal(err)
+	}
+
+	done = requestTip(p)
+	if _, err := dec.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := WriteMessage(remote, &Tip{Height: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	if res := <-done; res.err != nil || res.tip.Height != 2 {
+		t.Errorf("tip request after late response returned %+v, %v, want height 2", res.tip, res.err)
+	}
+}
+
+func TestSendHeaderRequest(t *testing.T) {
+	p, remote := pipePeer(t)
+	p.Start()
+
+	locator := []consensus.Hash{{3}, {2}, {1}}
+	type result struct {
+		headers []*consensus.BlockHeader
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		headers, err := p.SendHeaderRequest(locator)
+		done <- result{headers, err}
+	}()
+
+	msg, err := NewDecoder(remote).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, ok := msg.(*GetHeaders)
+	if !ok || len(req.Locator) != len(locator) || req.Locator[0] != locator[0] {
+		t.Fatalf("responder received %T %v, want GetHeaders with the locator", msg, msg)
+	}
+
+	resp := &Headers{Headers: make([]consensus.BlockHeader, 3)}
+	for i := range resp.Headers {
+		resp.Headers[i].Height = uint64(4 + i)
+		resp.Headers[i].Timestamp = uint64(1e9 + i)
+	}
+	if _, err := WriteMessage(remote, resp); err != nil {
+		t.Fatal(err)
+	}
+
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if len(res.headers) != len(resp.Headers) {
+		t.Fatalf("received %d headers, want %d", len(res.headers), len(resp.Headers))
+	}
+	for i, h := range res.headers {
+		if h.Hash() != resp.Headers[i].Hash() {
+			t.Errorf("header %d received as %+v, want %+v", i, h, resp.Headers[i])
+		}
+	}
+}
+
+func TestRejectedTransaction(t *testing.T) {
+	p, remote := pipePeer(t)
+
+	lowFee := &RejectError{Code: RejectLowFee, Reason: "fee too low"}
+	p.SetGossipHandler(func(g Gossip) error {
+		if g.Msg.(*consensus.Transaction).Kernels[0].Fee < 8 {
+			return lowFee
+		}
+		return errors.New("invalid transaction")
+	})
+	p.Start()
+
+	tests := []struct {
+		fee    uint64
+		code   uint8
+		reason string
+	}{
+		{1, RejectLowFee, lowFee.Reason},
+		{8, RejectInvalid, "invalid transaction"},
+	}
+
+	dec := NewDecoder(remote)
+	for _, tt := range tests {
+		tx := &consensus.Transaction{Kernels: []consensus.TxKernel{{Fee: tt.fee}}}
+		if _, err := WriteMessage(remote, tx); err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err := dec.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		reject, ok := msg.(*Reject)
+		if !ok {
+			t.Fatalf("rejected transaction answered with %T", msg)
+		}
+
+		want := Reject{MsgType: consensus.MsgTypeTransaction, Hash: tx.Hash(), Code: tt.code, Reason: tt.reason}
+		if *reject != want {
+			t.Errorf("transaction rejected with %+v, want %+v", *reject, want)
+		}
+	}
+
+	// the peer stays connected
+	if _, err := WriteMessage(remote, &Ping{Nonce: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := dec.Next(); err != nil || msg.Type() != consensus.MsgTypePong {
+		t.Errorf("Ping after rejections answered with %v, %v", msg, err)
+	}
+}
+
+// knownBlocksChain knows only the listed blocks
+type knownBlocksChain struct {
+	*syncChain
+	known map[consensus.Hash]bool
+}
+
+func (c *knownBlocksChain) HasBlock(hash consensus.Hash) bool {
+	return c.known[hash]
+}
+
+func TestInvRequestsUnknownBlock(t *testing.T) {
+	known, unknown := consensus.Hash{1}, consensus.Hash{2}
+	chain := &knownBlocksChain{
+		syncChain: &syncChain{genesis: powParams.Genesis},
+		known:     map[consensus.Hash]bool{known: true},
+	}
+
+	p, remote := pipePeer(t)
+	p.SetSyncManager(NewSyncManager(chain))
+	p.Start()
+
+	inv := &Inv{Items: []InvItem{
+		{Type: InvBlock, Hash: known},
+		{Type: InvTransaction, Hash: consensus.Hash{3}},
+		{Type: InvBlock, Hash: unknown},
+	}}
+	if _, err := WriteMessages(remote, []Message{inv, &Ping{Nonce: 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the unknown block is requested before Pong answers the Ping
+	dec := NewDecoder(remote)
+	msg, err := dec.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req, ok := msg.(*GetBlockHash); !ok || req.Hash != unknown {
+		t.Fatalf("Inv answered with %T %v, want GetBlock of the unknown block", msg, msg)
+	}
+
+	if msg, err := dec.Next(); err != nil || msg.Type() != consensus.MsgTypePong {
+		t.Errorf("received %v, %v, want Pong", msg, err)
+	}
+}
+
+// fullPeerAddrs returns PeerAddrs of maxPeerAddresses distinct addresses
+// starting at 10.<first>.0.0
+func fullPeerAddrs(first byte) *PeerAddrs {
+	msg := new(PeerAddrs)
+	for i := 0; i < maxPeerAddresses; i++ {
+		ip := net.IPv4(10, first, byte(i>>8), byte(i))
+		msg.peers = append(msg.peers, &net.TCPAddr{IP: ip, Port: 3414})
+	}
+
+	return msg
+}
+
+// sendAndSync writes msgs followed by Ping to the peer and waits for Pong,
+// so the peer handled msgs on return
+func sendAndSync(t *testing.T, remote net.Conn, msgs ...Message) {
+	t.Helper()
+	msgs = append(msgs, &Ping{Nonce: 1})
+	if _, err := WriteMessages(remote, msgs); err != nil {
+		t.Fatal(err)
+	}
+
+	dec := NewDecoder(remote)
+	for {
+		msg, err := dec.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type() == consensus.MsgTypePong {
+			return
+		}
+	}
+}
+
+func TestPeerAddrsFloodCapped(t *testing.T) {
+	p, remote := pipePeer(t)
+	store := NewPeerStore()
+	p.SetPeerStore(store)
+	p.Start()
+
+	sendAndSync(t, remote, fullPeerAddrs(1), fullPeerAddrs(2))
+
+	if n := len(store.Peers(consensus.CapUnknown, 4*maxPeerAddresses)); n != addrAcceptMax {
+		t.Errorf("store took %d addresses, want %d", n, addrAcceptMax)
+	}
+	if dropped := atomic.LoadUint64(&p.droppedAddrs); dropped != 2*maxPeerAddresses-addrAcceptMax {
+		t.Errorf("%d addresses dropped, want %d", dropped, 2*maxPeerAddresses-addrAcceptMax)
+	}
+}
+
+func TestPeerAddrsWindowClock(t *testing.T) {
+	clock := consensus.NewMockClock(time.Now())
+	p, remote := pipePeer(t)
+	store := NewPeerStore()
+	store.SetClock(clock)
+	p.SetPeerStore(store)
+	p.SetClock(clock)
+	p.Start()
+
+	sendAndSync(t, remote, fullPeerAddrs(1))
+	clock.Advance(addrAcceptWindow + time.Second)
+	sendAndSync(t, remote, fullPeerAddrs(2))
+
+	if n := len(store.Peers(consensus.CapUnknown, 4*maxPeerAddresses)); n != 2*maxPeerAddresses {
+		t.Errorf("store took %d addresses over two windows, want %d", n, 2*maxPeerAddresses)
+	}
+}
+
+func TestPeerAddrsV1KeepsKnownPeer(t *testing.T) {
+	clock := consensus.NewMockClock(time.Now())
+	p, remote := pipePeer(t)
+	store := NewPeerStore()
+	store.SetClock(clock)
+	p.SetPeerStore(store)
+	p.Start()
+
+	known := mustAddr(t, "1.2.3.4:3414")
+	store.AddPeer(known, consensus.CapFullNode)
+	seen := clock.Now()
+	clock.Advance(time.Hour)
+
+	sendAndSync(t, remote, &PeerAddrs{peers: []*net.TCPAddr{known, mustAddr(t, "5.6.7.8:3414")}})
+
+	store.RLock()
+	rec := *store.peers[known.String()]
+	n := len(store.peers)
+	store.RUnlock()
+
+	if n != 2 {
+		t.Errorf("store has %d addresses, want 2", n)
+	}
+	if rec.Capabilities != consensus.CapFullNode {
+		t.Errorf("known peer capabilities %v, want %v", rec.Capabilities, consensus.CapFullNode)
+	}
+	if !rec.LastSeen.Equal(seen) {
+		t.Errorf("known peer last seen %v, want %v", rec.LastSeen, seen)
+	}
+}
+
+// headerChain serves headers of a linear chain
+type headerChain []consensus.BlockHeader
+
+// newHeaderChain returns chain of n headers starting at genesis
+func newHeaderChain(n int) headerChain {
+	chain := make(headerChain, n)
+	for i := range chain {
+		chain[i].Height = uint64(i)
+		if i > 0 {
+			chain[i].Previous = chain[i-1].Hash()
+		}
+	}
+
+	return chain
+}
+
+func (c headerChain) BlockHeight(hash consensus.Hash) (uint64, bool) {
+	for i := range c {
+		if c[i].Hash() == hash {
+			return uint64(i), true
+		}
+	}
+	return 0, false
+}
+
+func (c headerChain) HeadersFrom(height uint64, max int) []consensus.BlockHeader {
+	if height >= uint64(len(c)) {
+		return nil
+	}
+	headers := c[height:]
+	if len(headers) > max {
+		headers = headers[:max]
+	}
+	return headers
+}
+
+func TestGetHeadersStopHash(t *testing.T) {
+	chain := newHeaderChain(10)
+	p, remote := pipePeer(t)
+	p.SetHeaderSource(chain)
+	p.Start()
+
+	tests := []struct {
+		stop consensus.Hash
+		// heights of the returned headers
+		first, last uint64
+	}{
+		{chain[4].Hash(), 2, 4},
+		{consensus.Hash{}, 2, 9},
+		// unknown stop hash is ignored
+		{consensus.Hash{1}, 2, 9},
+	}
+
+	dec := NewDecoder(remote)
+	for _, tt := range tests {
+		req := &GetHeaders{Locator: []consensus.Hash{chain[1].Hash(), chain[0].Hash()}, StopHash: tt.stop}
+		if _, err := WriteMessage(remote, req); err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err := dec.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, ok := msg.(*Headers)
+		if !ok {
+			t.Fatalf("GetHeaders answered with %T", msg)
+		}
+		headers := resp.Headers
+		if n := uint64(len(headers)); n != tt.last-tt.first+1 || headers[0].Height != tt.first || headers[n-1].Height != tt.last {
+			t.Errorf("stop hash %x: got %d headers, want heights %d to %d", tt.stop, n, tt.first, tt.last)
+		}
+	}
+}
+
+func TestCancelBlockRequest(t *testing.T) {
+	block := largeBlock(1)
+	hash := block.Header.Hash()
+
+	p, remote := pipePeer(t)
+	p.SetRequestTimeout(50 * time.Millisecond)
+	p.Start()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.SendBlockRequest(ctx, hash)
+		done <- err
+	}()
+
+	dec := NewDecoder(remote)
+	if msg, err := dec.Next(); err != nil || msg.Type() != consensus.MsgTypeGetBlock {
+		t.Fatalf("received %v, %v, want GetBlock", msg, err)
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("cancelled request returned %v, want %v", err, context.Canceled)
+	}
+
+	p.requests.Lock()
+	pending := len(p.requests.requests)
+	p.requests.Unlock()
+	if pending != 0 {
+		t.Fatalf("%d requests pending after cancel", pending)
+	}
+
+	// late block isn't kept for the next request of the same block
+	sendAndSync(t, remote, block)
+	go func() {
+		_, err := p.SendBlockRequest(context.Background(), hash)
+		done <- err
+	}()
+	if msg, err := dec.Next(); err != nil || msg.Type() != consensus.MsgTypeGetBlock {
+		t.Fatalf("received %v, %v, want GetBlock", msg, err)
+	}
+	if err := <-done; err != ErrRequestTimeout {
+		t.Errorf("next request returned %v, want %v", err, ErrRequestTimeout)
+	}
+}
+
+func TestPeerClock(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	clock := consensus.NewMockClock(start)
+	p, remote := pipePeer(t)
+	p.SetClock(clock)
+	p.Start()
+
+	if got := p.LastReceived(); !got.Equal(start) {
+		t.Errorf("last received %v before any message, want %v", got, start)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- p.SendPing() }()
+	var ping Ping
+	if _, err := ReadMessage(remote, &ping); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(time.Second)
+	if _, err := WriteMessage(remote, &Pong{ping}); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "Pong handled", func() bool { return p.Info().RTT > 0 })
+
+	if rtt := p.Info().RTT; rtt != time.Second {
+		t.Errorf("round trip time %v, want %v of the mock clock", rtt, time.Second)
+	}
+	if got := p.LastReceived(); !got.Equal(start.Add(time.Second)) {
+		t.Errorf("last received %v, want %v", got, start.Add(time.Second))
+	}
+}
+
+// growingChain is a chain gaining total difficulty on every Tip
+type growingChain struct {
+	*syncChain
+	difficulty uint64
+}
+
+func (c *growingChain) TotalDifficulty() consensus.Difficulty {
+	return consensus.Difficulty(atomic.AddUint64(&c.difficulty, 10))
+}
+
+// pingStalled sends n Pings advertising total difficulty of td(i) to the
+// peer, each answered by Pong, stops at the first error
+func pingStalled(remote net.Conn, n int, td func(i int) consensus.Difficulty) error {
+	for i := 0; i < n; i++ {
+		if _, err := WriteMessage(remote, &Ping{TotalDifficulty: td(i), Nonce: 1}); err != nil {
+			return err
+		}
+		if _, err := ReadMessage(remote, new(Pong)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestStalledPeer(t *testing.T) {
+	newStallPeer := func(limit int) (*Peer, net.Conn) {
+		p, remote := pipePeer(t)
+		p.SetSyncManager(NewSyncManager(&growingChain{syncChain: &syncChain{}, difficulty: 100}))
+		p.SetStallLimit(limit)
+		p.Start()
+		return p, remote
+	}
+	same := func(int) consensus.Difficulty { return 5 }
+
+	// the first Ping sets the difficulty the next ones are compared to
+	p, remote := newStallPeer(0)
+	if err := pingStalled(remote, stalledHeartbeats, same); err != nil {
+		t.Fatal(err)
+	}
+	if p.IsStalled() {
+		t.Fatalf("peer stalled after %d heartbeats", stalledHeartbeats-1)
+	}
+	if err := pingStalled(remote, 1, same); err != nil {
+		t.Fatal(err)
+	}
+	if !p.IsStalled() {
+		t.Fatalf("peer repeating the same difficulty not stalled after %d heartbeats", stalledHeartbeats)
+	}
+
+	// advertising more difficulty resets the count
+	if err := pingStalled(remote, 1, func(int) consensus.Difficulty { return 6 }); err != nil {
+		t.Fatal(err)
+	}
+	if p.IsStalled() {
+		t.Error("peer still stalled after its difficulty grew")
+	}
+
+	// stall limit disconnects, the limit-th Ping isn't answered
+	const limit = 3
+	p, remote = newStallPeer(limit)
+	if err := pingStalled(remote, limit, same); err != nil {
+		t.Fatal(err)
+	}
+	if err := pingStalled(remote, 1, same); err == nil {
+		t.Fatal("stalled peer not disconnected at stall limit")
+	}
+	eventually(t, "stalled peer closed", func() bool { return atomic.LoadInt32(&p.disconnect) != 0 })
+}
+
+func TestSequenceNumbers(t *testing.T) {
+	capture := new(captureLogger)
+	SetLogger(capture)
+	defer SetLogger(logrus.StandardLogger())
+
+	p, remote := pipePeer(t)
+	p.SetSequenceLogging(true)
+	p.Start()
+
+	sendAndSync(t, remote)
+	eventually(t, "Pong counted", func() bool { sent, _ := p.Sequence(); return sent > 0 })
+	sent0, received0 := p.Sequence()
+
+	for i := uint64(1); i <= 3; i++ {
+		sendAndSync(t, remote)
+		eventually(t, "Pong counted", func() bool { sent, _ := p.Sequence(); return sent == sent0+i })
+		if _, received := p.Sequence(); received != received0+i {
+			t.Errorf("after %d more Pings received sequence is %d, want %d", i, received, received0+i)
+		}
+	}
+
+	sent, received := p.Sequence()
+	if !capture.logged("debug", fmt.Sprint("received message #", received, " type: ", consensus.MsgTypePing)) {
+		t.Errorf("received message #%d not logged", received)
+	}
+	if !capture.logged("debug", fmt.Sprint("sent message #", sent, " type: ", consensus.MsgTypePong)) {
+		t.Errorf("sent message #%d not logged", sent)
+	}
+}
+
+func TestImplausiblePingDisconnects(t *testing.T) {
+	p, remote := pipePeer(t)
+	p.Start()
+	// the peer error sent before closing must not block on the pipe
+	go io.Copy(ioutil.Discard, remote)
+
+	if _, err := WriteMessage(remote, &Ping{TotalDifficulty: 1, Height: 1 << 40}); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "peer sending implausible Ping closed", func() bool { return atomic.LoadInt32(&p.disconnect) != 0 })
+}
+
+// unclosableConn ignores Close, like a conn whose pending read the OS
+// doesn't abort on close. It counts started reads.
+type unclosableConn struct {
+	net.Conn
+	reads int32
+}
+
+func (c *unclosableConn) Read(b []byte) (int, error) {
+	atomic.AddInt32(&c.reads, 1)
+	return c.Conn.Read(b)
+}
+
+func (c *unclosableConn) Close() error { return nil }
+
+func TestCloseAbortsBlockingRead(t *testing.T) {
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+
+	conn := &unclosableConn{Conn: local}
+	p := newPeer(conn)
+	p.Start()
+	// nothing is sent, the read blocks
+	eventually(t, "read started", func() bool { return atomic.LoadInt32(&conn.reads) > 0 })
+
+	done := make(chan struct{})
+	go func() {
+		p.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Close didn't return during blocking read")
+	}
+}
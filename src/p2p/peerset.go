@@ -0,0 +1,155 @@
+package p2p
+
+import (
+	"context"
+	"sync"
+)
+
+// Gossip is a block or transaction received from a peer, tagged with its
+// source so it's not relayed back to it
+type Gossip struct {
+	// received block or transaction
+	Msg Message
+	// peer the message comes from
+	Source Protocol
+}
+
+// PeerSet is a set of connected peers
+type PeerSet struct {
+	sync.RWMutex
+
+	peers map[Protocol]struct{}
+}
+
+// NewPeerSet creates empty peer set
+func NewPeerSet() *PeerSet {
+	return &PeerSet{
+		peers: make(map[Protocol]struct{}),
+	}
+}
+
+// Add adds peer to the set, returns false if the set already has a peer
+// with the same PeerID
+func (ps *PeerSet) Add(p Protocol) bool {
+	ps.Lock()
+	defer ps.Unlock()
+
+	id := p.PeerID()
+	for peer := range ps.peers {
+		if peer.PeerID() == id {
+			return false
+		}
+	}
+
+	ps.peers[p] = struct{}{}
+	return true
+}
+
+// Remove removes peer from the set
+func (ps *PeerSet) Remove(p Protocol) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	delete(ps.peers, p)
+}
+
+// Len returns number of peers in the set
+func (ps *PeerSet) Len() int {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	return len(ps.peers)
+}
+
+// broadcastWorkers is the maximum number of concurrent sends of a broadcast
+const broadcastWorkers = 16
+
+// Broadcast sends msg concurrently to every peer of the set but except, which
+// may be nil. Peers failing to take the message are removed from the set and
+// closed, their errors are returned.
+func (ps *PeerSet) Broadcast(msg Message, except Protocol) map[Protocol]error {
+	ps.RLock()
+	peers := make([]Protocol, 0, len(ps.peers))
+	for p := range ps.peers {
+		if p != except {
+			peers = append(peers, p)
+		}
+	}
+	ps.RUnlock()
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		errs   = make(map[Protocol]error)
+		worker = make(chan struct{}, broadcastWorkers)
+	)
+
+	for _, p := range peers {
+		wg.Add(1)
+		worker <- struct{}{}
+		go func(p Protocol) {
+			defer func() {
+				<-worker
+				wg.Done()
+			}()
+
+			if err := p.Send(msg); err != nil {
+				mu.Lock()
+				errs[p] = err
+				mu.Unlock()
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	for p, err := range errs {
+		logger.Info("drop peer failed to broadcast: ", err)
+		ps.Remove(p)
+		go p.Close()
+	}
+
+	return errs
+}
+
+// Relay broadcasts gossip to every peer but its source
+func (ps *PeerSet) Relay(g Gossip) {
+	ps.Broadcast(g.Msg, g.Source)
+}
+
+// Shutdown tells every peer the node is shutting down and closes them,
+// waiting until their connections are cleaned up. Peers still closing when
+// ctx expires are closed without waiting and ctx error is returned.
+func (ps *PeerSet) Shutdown(ctx context.Context) error {
+	ps.Lock()
+	peers := make([]Protocol, 0, len(ps.peers))
+	for p := range ps.peers {
+		peers = append(peers, p)
+	}
+	ps.peers = make(map[Protocol]struct{})
+	ps.Unlock()
+
+	var wg sync.WaitGroup
+	for _, p := range peers {
+		wg.Add(1)
+		go func(p Protocol) {
+			defer wg.Done()
+			p.CloseWithReason(ErrCodeShuttingDown, "shutting down")
+		}(p)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		for _, p := range peers {
+			go p.Close()
+		}
+		return ctx.Err()
+	}
+}
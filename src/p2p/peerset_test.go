@@ -0,0 +1,166 @@
+package p2p
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePeer records messages sent to it, other Protocol methods panic
+type fakePeer struct {
+	Protocol
+
+	id PeerID
+	// error returned by Send
+	sendErr error
+
+	mu     sync.Mutex
+	sent   []Message
+	closed bool
+}
+
+func (p *fakePeer) PeerID() PeerID { return p.id }
+
+func (p *fakePeer) Send(msg Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.sendErr != nil {
+		return p.sendErr
+	}
+	p.sent = append(p.sent, msg)
+	return nil
+}
+
+func (p *fakePeer) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+}
+
+func (p *fakePeer) CloseWithReason(code uint32, msg string) { p.Close() }
+
+// received returns messages sent to the peer
+func (p *fakePeer) received() []Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Message(nil), p.sent...)
+}
+
+func TestRelaySkipsSource(t *testing.T) {
+	ps := NewPeerSet()
+	peers := []*fakePeer{{id: PeerID{1}}, {id: PeerID{2}}, {id: PeerID{3}}}
+	for _, p := range peers {
+		ps.Add(p)
+	}
+
+	msg := &Ping{Nonce: 1}
+	ps.Relay(Gossip{Msg: msg, Source: peers[0]})
+
+	if n := len(peers[0].received()); n != 0 {
+		t.Errorf("source peer was sent %d messages", n)
+	}
+
+	for _, p := range peers[1:] {
+		if got := p.received(); len(got) != 1 || got[0] != msg {
+			t.Errorf("peer %x was sent %v, want the relayed message", p.id, got)
+		}
+	}
+}
+
+func TestBroadcastFailingPeer(t *testing.T) {
+	ps := NewPeerSet()
+	failing := &fakePeer{id: PeerID{1}, sendErr: ErrPeerDisconnected}
+	peers := []*fakePeer{failing, {id: PeerID{2}}, {id: PeerID{3}}}
+	for _, p := range peers {
+		ps.Add(p)
+	}
+
+	msg := &Ping{Nonce: 1}
+	errs := ps.Broadcast(msg, nil)
+	if len(errs) != 1 || errs[failing] != ErrPeerDisconnected {
+		t.Errorf("broadcast errors %v, want %v of the failing peer", errs, ErrPeerDisconnected)
+	}
+
+	for _, p := range peers[1:] {
+		if got := p.received(); len(got) != 1 || got[0] != msg {
+			t.Errorf("peer %x was sent %v, want the broadcast message", p.id, got)
+		}
+	}
+
+	if n := ps.Len(); n != 2 {
+		t.Errorf("%d peers left in the set, want 2", n)
+	}
+
+	// failing peer is closed in the background
+	eventually(t, "failing peer closed", func() bool {
+		failing.mu.Lock()
+		defer failing.mu.Unlock()
+		return failing.closed
+	})
+}
+
+// isClosed tells whether the peer was closed
+func (p *fakePeer) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+// hangingPeer never finishes closing with reason, like a peer whose writer
+// is stuck
+type hangingPeer struct {
+	*fakePeer
+	release chan struct{}
+}
+
+func (p *hangingPeer) CloseWithReason(code uint32, msg string) { <-p.release }
+
+func TestShutdownClosesAll(t *testing.T) {
+	ps := NewPeerSet()
+	peers := []*fakePeer{{id: PeerID{1}}, {id: PeerID{2}}}
+	for _, p := range peers {
+		ps.Add(p)
+	}
+
+	if err := ps.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range peers {
+		if !p.isClosed() {
+			t.Errorf("peer %x not closed", p.id)
+		}
+	}
+	if n := ps.Len(); n != 0 {
+		t.Errorf("%d peers left in the set", n)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	ps := NewPeerSet()
+	closing := &fakePeer{id: PeerID{1}}
+	hanging := &hangingPeer{&fakePeer{id: PeerID{2}}, make(chan struct{})}
+	defer close(hanging.release)
+	ps.Add(closing)
+	ps.Add(hanging)
+
+	const deadline = 50 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
+	defer cancel()
+
+	start := time.Now()
+	if err := ps.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > deadline+time.Second {
+		t.Errorf("Shutdown returned after %v, deadline %v", elapsed, deadline)
+	}
+
+	if !closing.isClosed() {
+		t.Error("peer closing in time not closed")
+	}
+	// connection of the stuck peer is closed without waiting
+	eventually(t, "hanging peer closed", hanging.isClosed)
+}
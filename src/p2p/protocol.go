@@ -1,54 +1,170 @@
 package p2p
 
 import (
+	"cmp"
 	"io"
+	"io/ioutil"
 	"consensus"
+	"context"
 	"bufio"
-	"github.com/sirupsen/logrus"
 	"errors"
+	"net"
+	"sort"
+	"time"
 )
 
 const (
 	// userAgent is name of version of the software
 	userAgent       = "gringo v0.0.1"
+	// maxWriteBuffer is the upper limit of WriteMessage buffer size
+	maxWriteBuffer = 64 * 1024
 )
 
+// ErrMessageTooBig is returned when message header declares length above MaxMsgLen
+var ErrMessageTooBig = errors.New("too big message size")
+
 // Message defines methods for WriteMessage/ReadMessage functions
 type Message interface {
 	// Read reads from reader and fit self struct
 	Read(r io.Reader) error
 
-	// Bytes returns binary data of body message
+	// Bytes returns binary data of body message. It must be byte-stable
+	// across calls, data kept in maps is written in sortedKeys order.
 	Bytes() []byte
 
 	// Type says whats the message type should use in header
 	Type() uint8
 }
 
-// WriteMessage writes to wr (net.conn) protocol message
+// sortedKeys returns keys of m in ascending order, map iteration order is
+// random so Bytes must never range over a map directly
+func sortedKeys[K cmp.Ordered, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	return keys
+}
+
+// writeBufferSize returns buffer size fitting n bytes of message bodies
+// with count headers, but not above maxWriteBuffer
+func writeBufferSize(n, count int) int {
+	size := n + count*int(consensus.HeaderLen)
+	if size > maxWriteBuffer {
+		return maxWriteBuffer
+	}
+
+	return size
+}
+
+// WriteMessage writes to wr (net.conn) protocol message. Returns the
+// number of bytes actually written to w, also on error.
 func WriteMessage(w io.Writer, msg Message) (uint64, error) {
 	data := msg.Bytes()
 
+	// use the buffered writer sized for the message, count bytes passed
+	// through to w
+	cw := &countingWriter{w: w}
+	wr := bufio.NewWriterSize(cw, writeBufferSize(len(data), 1))
+
+	if err := writeMessage(wr, msg.Type(), data); err != nil {
+		return cw.n, err
+	}
+
+	if err := wr.Flush(); err != nil {
+		return cw.n, err
+	}
+
+	countMessage(msg.Type(), Outbound)
+	return cw.n, nil
+}
+
+// WriteMessages writes to wr (net.conn) several protocol messages at once,
+// each message keeps its own header so remote reads them one by one.
+// Returns the number of bytes actually written to w, also on error.
+func WriteMessages(w io.Writer, msgs []Message) (uint64, error) {
+	bodies := make([][]byte, len(msgs))
+	var size int
+	for i, msg := range msgs {
+		bodies[i] = msg.Bytes()
+		size += len(bodies[i])
+	}
+
+	// use the buffered writer sized for the messages, count bytes passed
+	// through to w
+	cw := &countingWriter{w: w}
+	wr := bufio.NewWriterSize(cw, writeBufferSize(size, len(msgs)))
+
+	for i, msg := range msgs {
+		if err := writeMessage(wr, msg.Type(), bodies[i]); err != nil {
+			return cw.n, err
+		}
+	}
+
+	if err := wr.Flush(); err != nil {
+		return cw.n, err
+	}
+
+	for _, msg := range msgs {
+		countMessage(msg.Type(), Outbound)
+	}
+	return cw.n, nil
+}
+
+// writeMessage writes header and body data of message type typ to buffered
+// writer without flushing. Once it fails the buffered writer must not be reused.
+func writeMessage(wr *bufio.Writer, typ uint8, data []byte) error {
 	header := Header{
 		magic: consensus.MagicCode,
-		Type:  msg.Type(),
+		Type:  typ,
 		Len:   uint64(len(data)),
 	}
 
-	// use the buffered writer
-	wr := bufio.NewWriter(w)
 	if err := header.Write(wr); err != nil {
-		return 0, err
+		return err
 	}
 
-	if n, err := wr.Write(data); err != nil {
-		return uint64(n) + consensus.HeaderLen, err
-	} else {
-		return uint64(n) + consensus.HeaderLen, wr.Flush()
+	_, err := wr.Write(data)
+	return err
+}
+
+// countingWriter counts bytes written to the underlying writer
+type countingWriter struct {
+	w io.Writer
+	n uint64
+}
+
+// Write implements io.Writer interface
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += uint64(n)
+	return n, err
+}
+
+// SerializedLen returns the on-wire size of message with its header.
+// Messages implementing io.WriterTo are counted as written to discard,
+// so large bodies aren't materialized.
+func SerializedLen(msg Message) uint64 {
+	wt, ok := msg.(io.WriterTo)
+	if !ok {
+		return consensus.HeaderLen + uint64(len(msg.Bytes()))
 	}
+
+	cw := &countingWriter{w: ioutil.Discard}
+	if _, err := wt.WriteTo(cw); err != nil {
+		// writing to discard never fails
+		panic(err)
+	}
+
+	return consensus.HeaderLen + cw.n
 }
 
-// ReadMessage reads from r (net.conn) protocol message
+// ReadMessage reads from r (net.conn) protocol message. It blocks until the
+// message is read, to abort it from another goroutine close r. Closing
+// net.Conn unblocks the read, for conns which may not do it promptly set a
+// past read deadline before closing, as Peer does on Disconnect.
 func ReadMessage(r io.Reader, msg Message) (uint64, error) {
 	var header Header
 
@@ -57,18 +173,53 @@ func ReadMessage(r io.Reader, msg Message) (uint64, error) {
 	if err := header.Read(rh); err != nil {
 		return 0, err
 	}
-	logrus.Debug("got header: ", header)
+	logger.Debug("got header: ", header)
 
 	if header.Type != msg.Type() {
 		return uint64(consensus.HeaderLen), errors.New("receive unexpected message type")
 	}
 
 	if header.Len > consensus.MaxMsgLen {
-		return uint64(consensus.HeaderLen), errors.New("too big message size")
+		return uint64(consensus.HeaderLen), ErrMessageTooBig
 	}
 
+	countMessage(header.Type, Inbound)
+
+	n := uint64(consensus.HeaderLen) + uint64(header.Len)
 	rb := io.LimitReader(r, int64(header.Len))
-	return uint64(consensus.HeaderLen) + uint64(header.Len), msg.Read(rb)
+	if header.Compressed {
+		var err error
+		if rb, err = decompressBody(rb, consensus.MaxMsgLen); err != nil {
+			return n, err
+		}
+	}
+
+	return n, msg.Read(rb)
+}
+
+// readConnMessage reads protocol message from conn. A message declaring
+// length above MaxMsgLen can't be skipped to resync the stream, so the peer
+// is sent PeerError and the connection is closed.
+func readConnMessage(conn net.Conn, msg Message) (uint64, error) {
+	n, err := ReadMessage(conn, msg)
+	if err == ErrMessageTooBig {
+		sendPeerError(conn, ErrCodeBadMessage, err.Error())
+		conn.Close()
+	}
+
+	return n, err
+}
+
+// sendPeerError writes PeerError to conn, waiting for at most closeReasonTimeout
+func sendPeerError(conn net.Conn, code uint32, msg string) {
+	var peerError PeerError
+	peerError.Code = code
+	peerError.Message = msg
+
+	conn.SetWriteDeadline(time.Now().Add(closeReasonTimeout))
+	if _, err := WriteMessage(conn, &peerError); err != nil {
+		logger.Debug("cannot send peer error: ", err)
+	}
 }
 
 // Protocol defines grin-node network communicates
@@ -77,15 +228,31 @@ type Protocol interface {
 	// TransmittedBytes() uint64
 
 	// SendPing sends a Ping message to the remote peer. Will panic if handle has never
-	// been called on this protocol.
-	SendPing()
+	// been called on this protocol. Fails with ErrPeerDisconnected once the
+	// connection is closed.
+	SendPing() error
+
+	// PeerID returns identifier of the remote node derived from handshake
+	PeerID() PeerID
+
+	// Send queues any message to the remote peer
+	Send(msg Message) error
 
 	// SendBlock sends a block to our remote peer
-	SendBlock()
-	SendTransaction()
-	SendHeaderRequest()
-	SendBlockRequest()
-	SendPeerRequest()
+	SendBlock(b *consensus.Block)
+	AnnounceBlock(hash consensus.Hash) error
+	SendTransaction(tx *consensus.Transaction)
+	SendHeaderRequest(locator []consensus.Hash) ([]*consensus.BlockHeader, error)
+	SendBlockRequest(ctx context.Context, hash consensus.Hash) (*consensus.Block, error)
+	SendPeerRequest(caps consensus.Capabilities)
+	SendTipRequest() (*Tip, error)
+	SendFilter(f *BloomFilter) error
+
+	// IsStalled checks whether the remote peer chain stopped growing along ours
+	IsStalled() bool
+
+	// CloseWithReason sends PeerError to the remote peer and closes the connection
+	CloseWithReason(code uint32, msg string)
 
 	// Close the connection to the remote peer
 	Close()
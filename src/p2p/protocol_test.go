@@ -0,0 +1,291 @@
+package p2p
+
+import (
+	"bytes"
+	"consensus"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWriteMessagesFramed(t *testing.T) {
+	buff := new(bytes.Buffer)
+	msgs := []Message{
+		&Ping{TotalDifficulty: 10, Height: 1, Nonce: 1},
+		&Ping{TotalDifficulty: 20, Height: 2, Nonce: 2},
+	}
+
+	n, err := WriteMessages(buff, msgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != uint64(buff.Len()) {
+		t.Errorf("%d bytes reported, %d written", n, buff.Len())
+	}
+
+	for i, want := range msgs {
+		var got Ping
+		if _, err := ReadMessage(buff, &got); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+
+		if got != *want.(*Ping) {
+			t.Errorf("message %d read as %+v, want %+v", i, got, want)
+		}
+	}
+
+	if buff.Len() != 0 {
+		t.Errorf("%d bytes left after both messages", buff.Len())
+	}
+}
+
+func TestOversizedHeaderClosesConn(t *testing.T) {
+	oversized := Header{magic: consensus.MagicCode, Type: consensus.MsgTypePing, Len: consensus.MaxMsgLen + 1}
+
+	// handshake reads with readConnMessage, started peer in its read loop
+	readers := map[string]func(net.Conn){
+		"readConnMessage": func(conn net.Conn) {
+			if _, err := readConnMessage(conn, new(Ping)); err != ErrMessageTooBig {
+				t.Errorf("readConnMessage: got %v, want %v", err, ErrMessageTooBig)
+			}
+		},
+		"peer": func(conn net.Conn) {
+			newPeer(conn).Start()
+		},
+	}
+
+	for name, read := range readers {
+		local, remote := net.Pipe()
+		go read(local)
+
+		go oversized.Write(remote)
+
+		var perr PeerError
+		if _, err := ReadMessage(remote, &perr); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if perr.Code != ErrCodeBadMessage {
+			t.Errorf("%s: PeerError code %d, want %d", name, perr.Code, ErrCodeBadMessage)
+		}
+
+		// nothing follows but the close
+		if _, err := remote.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("%s: read after PeerError: got %v, want %v", name, err, io.EOF)
+		}
+		remote.Close()
+	}
+}
+
+// failingWriter accepts n bytes, then fails
+type failingWriter struct {
+	n   int
+	buf bytes.Buffer
+}
+
+var errWriterFailed = errors.New("writer failed")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		w.buf.Write(p[:w.n])
+		n := w.n
+		w.n = 0
+		return n, errWriterFailed
+	}
+
+	w.n -= len(p)
+	return w.buf.Write(p)
+}
+
+func TestWriteMessageShortWrite(t *testing.T) {
+	ping := &Ping{TotalDifficulty: 10, Height: 1, Nonce: 1}
+	// body larger than the write buffer is written in several writes
+	large := &PeerError{Code: ErrCodeBadMessage, Message: strings.Repeat("x", 3*maxWriteBuffer)}
+
+	tests := []struct {
+		msg Message
+		n   int
+	}{
+		{ping, 0},
+		{ping, 5},
+		{ping, int(consensus.HeaderLen)},
+		{ping, int(consensus.HeaderLen) + 3},
+		{large, maxWriteBuffer - 1},
+		{large, maxWriteBuffer + 10},
+	}
+
+	for _, tt := range tests {
+		w := &failingWriter{n: tt.n}
+		n, err := WriteMessage(w, tt.msg)
+		if err != errWriterFailed {
+			t.Errorf("writer failing after %d bytes: got %v, want %v", tt.n, err, errWriterFailed)
+		}
+
+		if n != uint64(tt.n) || w.buf.Len() != tt.n {
+			t.Errorf("writer failing after %d bytes: %d bytes reported, %d written", tt.n, n, w.buf.Len())
+		}
+	}
+}
+
+func BenchmarkWriteMessage(b *testing.B) {
+	block := new(consensus.Block)
+	for i := 0; i < 1000; i++ {
+		block.Outputs = append(block.Outputs, consensus.Output{})
+		block.Kernels = append(block.Kernels, consensus.TxKernel{Fee: uint64(i)})
+	}
+
+	msgs := []struct {
+		name string
+		msg  Message
+	}{
+		{"Ping", &Ping{TotalDifficulty: 1000, Height: 42, Nonce: 1}},
+		{"Block", block},
+	}
+
+	for _, m := range msgs {
+		b.Run(m.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(SerializedLen(m.msg)))
+			for i := 0; i < b.N; i++ {
+				if _, err := WriteMessage(ioutil.Discard, m.msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestSwitchNetworkWhileEncoding(t *testing.T) {
+	defer consensus.SetDefaultNetwork(&consensus.MainnetParams)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			consensus.SetDefaultNetwork(&consensus.TestnetParams)
+			consensus.SetDefaultNetwork(&consensus.MainnetParams)
+		}
+	}()
+
+	genesis := map[consensus.Hash]bool{
+		consensus.MainnetParams.GenesisHash(): true,
+		consensus.TestnetParams.GenesisHash(): true,
+	}
+
+	buff := new(bytes.Buffer)
+	for i := 0; i < 200; i++ {
+		params := consensus.DefaultNetwork()
+		msg := &shake{
+			Version:         consensus.ProtocolVersion,
+			Nonce:           uint64(i + 1),
+			TotalDifficulty: params.Genesis.TotalDifficulty,
+			Genesis:         params.GenesisHash(),
+			UserAgent:       userAgent,
+		}
+		if _, err := WriteMessage(buff, msg); err != nil {
+			t.Fatal(err)
+		}
+
+		var got shake
+		if _, err := ReadMessage(buff, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !genesis[got.Genesis] {
+			t.Fatalf("shake carries genesis %v of no network", got.Genesis)
+		}
+
+		if _, err := ParsePeerAddr("1.2.3.4"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	close(done)
+	wg.Wait()
+}
+
+func TestSerializedLen(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 3414}
+	block := largeBlock(100)
+	raw := rawBlock(block.Bytes())
+	tx := &consensus.Transaction{Kernels: []consensus.TxKernel{{Fee: 8}}}
+
+	msgs := []Message{
+		&Ping{TotalDifficulty: 1000, Height: 42, Nonce: 1},
+		&Pong{Ping{TotalDifficulty: 1000, Height: 42, Nonce: 1}},
+		&GetPeerAddrs{Capabilities: consensus.CapFullNode},
+		&PeerAddrs{peers: []*net.TCPAddr{addr, {IP: net.ParseIP("2001:db8::1"), Port: 3414}}},
+		&PeerAddrsV2{peers: []PeerAddr{{Addr: addr, Capabilities: consensus.CapFullNode}}},
+		&PeerError{Code: ErrCodeBadMessage, Message: "bad"},
+		&Reject{MsgType: consensus.MsgTypeTransaction, Hash: consensus.Hash{1}, Code: RejectInvalid, Reason: "invalid"},
+		&GetBlockHash{Hash: consensus.Hash{1}},
+		&GetHeaders{Locator: []consensus.Hash{{1}, {2}}, StopHash: consensus.Hash{3}},
+		&Headers{Headers: []consensus.BlockHeader{block.Header, block.Header}},
+		&GetTip{},
+		&Tip{Hash: consensus.Hash{1}, Height: 42, TotalDifficulty: 1000},
+		&Inv{Items: []InvItem{{Type: InvBlock, Hash: consensus.Hash{1}}}},
+		&CompactBlock{Header: block.Header, Nonce: 1, KernelIDs: make([][shortIDSize]byte, 3)},
+		&SetFilter{Filter: *NewBloomFilter(64, 3)},
+		&GetUTXOSet{StartIndex: 10, MaxChunks: 2},
+		&UTXOSetChunk{StartIndex: 10, Commits: make([]consensus.Commitment, 3), Proof: make([]consensus.Hash, 2)},
+		&hand{Version: consensus.ProtocolVersion, SenderAddr: addr, ReceiverAddr: addr, UserAgent: userAgent},
+		&shake{Version: consensus.ProtocolVersion, UserAgent: userAgent},
+		block,
+		&raw,
+		tx,
+	}
+
+	for _, msg := range msgs {
+		buff := new(bytes.Buffer)
+		n, err := WriteMessage(buff, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if size := SerializedLen(msg); size != n || size != uint64(buff.Len()) {
+			t.Errorf("%T: serialized length %d, %d bytes written", msg, size, buff.Len())
+		}
+	}
+}
+
+// peerAddrsFromMap builds PeerAddrs of peers kept in a map by address
+// string, as a message built from map data would
+func peerAddrsFromMap(t *testing.T) *PeerAddrs {
+	t.Helper()
+	byAddr := make(map[string]*net.TCPAddr)
+	for i := 1; i <= 32; i++ {
+		addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 3414}
+		byAddr[addr.String()] = addr
+	}
+
+	msg := new(PeerAddrs)
+	for _, k := range sortedKeys(byAddr) {
+		msg.peers = append(msg.peers, byAddr[k])
+	}
+	return msg
+}
+
+func TestMapDataByteStable(t *testing.T) {
+	keys := sortedKeys(map[uint8]bool{3: true, 1: true, 2: false})
+	if len(keys) != 3 || keys[0] != 1 || keys[1] != 2 || keys[2] != 3 {
+		t.Errorf("sortedKeys returned %v, want [1 2 3]", keys)
+	}
+
+	want := peerAddrsFromMap(t).Bytes()
+	// every map is iterated in another random order
+	for i := 0; i < 20; i++ {
+		if got := peerAddrsFromMap(t).Bytes(); !bytes.Equal(got, want) {
+			t.Fatalf("PeerAddrs built from map encoded as %x, want %x", got, want)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package p2p
+
+import (
+	"bufio"
+	"bytes"
+	"consensus"
+	"io"
+)
+
+// ReplayDecoder reads protocol messages from captured traffic, e.g. a log
+// or pcap dump. Unlike Decoder it survives malformed messages: after a
+// parse error the next call skips to the following magic code, so a
+// corrupted message doesn't misalign the rest of the stream.
+type ReplayDecoder struct {
+	r *bufio.Reader
+
+	// bytes of the last malformed message but its first one, scanned for
+	// the magic code before the rest of the stream
+	pending []byte
+	// next message must be searched for by the magic code
+	resync bool
+}
+
+// NewReplayDecoder creates replay decoder reading from r
+func NewReplayDecoder(r io.Reader) *ReplayDecoder {
+	return &ReplayDecoder{
+		r: bufio.NewReader(r),
+	}
+}
+
+// read reads len(p) bytes, pending ones first. Returns number of bytes read.
+func (d *ReplayDecoder) read(p []byte) (int, error) {
+	n := copy(p, d.pending)
+	d.pending = d.pending[n:]
+	if n == len(p) {
+		return n, nil
+	}
+
+	m, err := io.ReadFull(d.r, p[n:])
+	return n + m, err
+}
+
+// readByte reads one byte, pending ones first
+func (d *ReplayDecoder) readByte() (byte, error) {
+	if len(d.pending) > 0 {
+		b := d.pending[0]
+		d.pending = d.pending[1:]
+		return b, nil
+	}
+
+	return d.r.ReadByte()
+}
+
+// skipToMagic discards bytes up to the next magic code, which is left to
+// be read as start of the next message
+func (d *ReplayDecoder) skipToMagic() error {
+	var prev byte
+	for {
+		b, err := d.readByte()
+		if err != nil {
+			return err
+		}
+
+		if prev == consensus.MagicCode[0] && b == consensus.MagicCode[1] {
+			d.pending = append(consensus.MagicCode[:], d.pending...)
+			return nil
+		}
+		prev = b
+	}
+}
+
+// fail marks frame of the current message malformed, the stream is
+// searched for the next magic code starting from the second byte of frame
+func (d *ReplayDecoder) fail(frame []byte) {
+	d.pending = append(append([]byte(nil), frame[1:]...), d.pending...)
+	d.resync = true
+}
+
+// Next reads the next message. It returns io.EOF at the end of the stream,
+// other errors report a malformed message which is skipped by the next call.
+func (d *ReplayDecoder) Next() (Message, error) {
+	if d.resync {
+		if err := d.skipToMagic(); err != nil {
+			return nil, err
+		}
+		d.resync = false
+	}
+
+	frame := make([]byte, consensus.HeaderLen)
+	if n, err := d.read(frame); err != nil {
+		if n == 0 {
+			return nil, io.EOF
+		}
+		d.fail(frame[:n])
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	var header Header
+	if err := header.Read(bytes.NewReader(frame)); err != nil {
+		d.fail(frame)
+		return nil, err
+	}
+
+	if header.Len > consensus.MaxMsgLen {
+		d.fail(frame)
+		return nil, ErrMessageTooBig
+	}
+
+	msg, err := newMessage(header.Type)
+	if err != nil {
+		d.fail(frame)
+		return nil, err
+	}
+
+	frame = append(frame, make([]byte, header.Len)...)
+	body := frame[consensus.HeaderLen:]
+	if n, err := d.read(body); err != nil {
+		d.fail(frame[:consensus.HeaderLen+uint64(n)])
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	var r io.Reader = bytes.NewReader(body)
+	if header.Compressed {
+		if r, err = decompressBody(r, consensus.MaxMsgLen); err != nil {
+			d.fail(frame)
+			return nil, err
+		}
+	}
+
+	if err := msg.Read(r); err != nil {
+		d.fail(frame)
+		return nil, err
+	}
+
+	return msg, nil
+}
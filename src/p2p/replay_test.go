@@ -0,0 +1,79 @@
+package p2p
+
+import (
+	"bytes"
+	"consensus"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// encodeMessages returns wire bytes of msgs
+func encodeMessages(t *testing.T, msgs ...Message) []byte {
+	t.Helper()
+	buff := new(bytes.Buffer)
+	if _, err := WriteMessages(buff, msgs); err != nil {
+		t.Fatal(err)
+	}
+
+	return buff.Bytes()
+}
+
+func TestReplayResync(t *testing.T) {
+	ping := &Ping{TotalDifficulty: 1000, Height: 42, Nonce: 7}
+
+	// PeerError claiming longer message than its body
+	corruptBody := encodeMessages(t, &PeerError{Code: ErrCodeBadMessage, Message: "bad"})
+	binary.BigEndian.PutUint64(corruptBody[consensus.HeaderLen+4:], 1000)
+
+	// header of unknown magic code
+	corruptHeader := encodeMessages(t, ping)
+	corruptHeader[0]++
+
+	tests := []struct {
+		name    string
+		corrupt []byte
+	}{
+		{"corrupted body", corruptBody},
+		{"corrupted header", corruptHeader},
+		{"garbage", []byte{0x1e, 0x00, 0xc5, 0x42}},
+	}
+
+	for _, tt := range tests {
+		stream := append(append([]byte(nil), tt.corrupt...), encodeMessages(t, ping)...)
+		dec := NewReplayDecoder(bytes.NewReader(stream))
+
+		if msg, err := dec.Next(); err == nil {
+			t.Errorf("%s: read %v, want error", tt.name, msg)
+			continue
+		}
+
+		msg, err := dec.Next()
+		if err != nil {
+			t.Errorf("%s: message after the corrupted one: %v", tt.name, err)
+			continue
+		}
+		if got, ok := msg.(*Ping); !ok || *got != *ping {
+			t.Errorf("%s: recovered %v, want %v", tt.name, msg, ping)
+		}
+
+		if _, err := dec.Next(); err != io.EOF {
+			t.Errorf("%s: end of stream: got %v, want %v", tt.name, err, io.EOF)
+		}
+	}
+}
+
+func TestReplayTruncated(t *testing.T) {
+	stream := encodeMessages(t, &Ping{Nonce: 1}, &Ping{Nonce: 2})
+	dec := NewReplayDecoder(bytes.NewReader(stream[:len(stream)-1]))
+
+	if msg, err := dec.Next(); err != nil || msg.(*Ping).Nonce != 1 {
+		t.Fatalf("first message: got %v, %v", msg, err)
+	}
+	if _, err := dec.Next(); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated message: got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if _, err := dec.Next(); err != io.EOF {
+		t.Errorf("end of stream: got %v, want %v", err, io.EOF)
+	}
+}
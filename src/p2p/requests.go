@@ -0,0 +1,111 @@
+package p2p
+
+import (
+	"consensus"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// requestTimeout is how long we wait for a response to a request
+const requestTimeout = 30 * time.Second
+
+var (
+	// ErrRequestTimeout is returned when peer doesn't respond to request in time
+	ErrRequestTimeout = errors.New("request timed out")
+	// ErrRequestPending is returned when the same request is already waiting for response
+	ErrRequestPending = errors.New("request already pending")
+)
+
+// requestKey identifies a request by the type of the expected response
+// and an id, e.g. hash of the requested block. Requests without id use zero hash.
+type requestKey struct {
+	typ uint8
+	id  consensus.Hash
+}
+
+// pendingRequests correlates requests with responses routed by the read loop
+type pendingRequests struct {
+	sync.Mutex
+
+	// The following fields are only meant to be used *atomically*
+	timedOut uint64
+
+	requests map[requestKey]chan Message
+}
+
+// newPendingRequests creates empty pending requests
+func newPendingRequests() *pendingRequests {
+	return &pendingRequests{
+		requests: make(map[requestKey]chan Message),
+	}
+}
+
+// register registers request expecting response for key
+func (pr *pendingRequests) register(key requestKey) (chan Message, error) {
+	pr.Lock()
+	defer pr.Unlock()
+
+	if _, ok := pr.requests[key]; ok {
+		return nil, ErrRequestPending
+	}
+
+	ch := make(chan Message, 1)
+	pr.requests[key] = ch
+	return ch, nil
+}
+
+// deliver passes response to the request registered for key, returns
+// false if there's no such request
+func (pr *pendingRequests) deliver(key requestKey, msg Message) bool {
+	pr.Lock()
+	defer pr.Unlock()
+
+	ch, ok := pr.requests[key]
+	if !ok {
+		return false
+	}
+
+	delete(pr.requests, key)
+	ch <- msg
+	return true
+}
+
+// cancel removes request registered for key
+func (pr *pendingRequests) cancel(key requestKey) {
+	pr.Lock()
+	defer pr.Unlock()
+
+	delete(pr.requests, key)
+}
+
+// wait waits for response to request registered for key, the request is
+// removed and counted as timed out if no response arrives within timeout.
+// The request is removed as well once ctx is done or quit is closed as
+// the peer disconnects, a response arriving later is not delivered.
+func (pr *pendingRequests) wait(ctx context.Context, key requestKey, ch chan Message, timeout time.Duration, quit <-chan struct{}) (Message, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case msg := <-ch:
+		return msg, nil
+	case <-ctx.Done():
+		pr.cancel(key)
+		return nil, ctx.Err()
+	case <-quit:
+		pr.cancel(key)
+		return nil, ErrPeerDisconnected
+	case <-timer.C:
+		pr.cancel(key)
+		atomic.AddUint64(&pr.timedOut, 1)
+		return nil, ErrRequestTimeout
+	}
+}
+
+// TimedOut returns number of requests which timed out
+func (pr *pendingRequests) TimedOut() uint64 {
+	return atomic.LoadUint64(&pr.timedOut)
+}
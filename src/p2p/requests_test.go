@@ -0,0 +1,87 @@
+package p2p
+
+import (
+	"consensus"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPendingRequestsDeliver(t *testing.T) {
+	pr := newPendingRequests()
+	key := requestKey{typ: consensus.MsgTypeBlock, id: consensus.Hash{1}}
+
+	ch, err := pr.register(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pr.register(key); err != ErrRequestPending {
+		t.Errorf("second registration returned %v, want %v", err, ErrRequestPending)
+	}
+
+	if pr.deliver(requestKey{typ: consensus.MsgTypeBlock}, new(consensus.Block)) {
+		t.Error("response delivered to request of another id")
+	}
+
+	resp := new(consensus.Block)
+	if !pr.deliver(key, resp) {
+		t.Fatal("response not delivered")
+	}
+
+	msg, err := pr.wait(context.Background(), key, ch, time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg != resp {
+		t.Errorf("wait returned %v, want the delivered response", msg)
+	}
+}
+
+func TestPendingRequestsTimeout(t *testing.T) {
+	pr := newPendingRequests()
+	key := requestKey{typ: consensus.MsgTypeHeaders}
+
+	ch, err := pr.register(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pr.wait(context.Background(), key, ch, time.Millisecond, nil); err != ErrRequestTimeout {
+		t.Fatalf("wait returned %v, want %v", err, ErrRequestTimeout)
+	}
+
+	if n := pr.TimedOut(); n != 1 {
+		t.Errorf("%d requests timed out, want 1", n)
+	}
+
+	if pr.deliver(key, new(Headers)) {
+		t.Error("late response delivered to timed out request")
+	}
+
+	if _, err := pr.register(key); err != nil {
+		t.Errorf("timed out request was not removed: %v", err)
+	}
+}
+
+func TestPendingRequestsQuit(t *testing.T) {
+	pr := newPendingRequests()
+	key := requestKey{typ: consensus.MsgTypeHeaders}
+
+	ch, err := pr.register(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	quit := make(chan struct{})
+	close(quit)
+
+	if _, err := pr.wait(context.Background(), key, ch, time.Minute, quit); err != ErrPeerDisconnected {
+		t.Fatalf("wait after disconnect returned %v, want %v", err, ErrPeerDisconnected)
+	}
+
+	if _, err := pr.register(key); err != nil {
+		t.Errorf("request was not removed after disconnect: %v", err)
+	}
+}
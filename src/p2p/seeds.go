@@ -0,0 +1,103 @@
+package p2p
+
+import (
+	"consensus"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// lookupIP resolves host A and AAAA records, replaceable for testing
+var lookupIP = net.LookupIP
+
+// splitPeerAddr splits "host", "host:port", "[ipv6]" or "[ipv6]:port" into
+// host and port, the port defaults to default network port
+func splitPeerAddr(s string) (string, int, error) {
+	port := int(consensus.DefaultNetwork().Port)
+
+	// bare host or IPv6 address without port
+	if !strings.HasPrefix(s, "[") && strings.Count(s, ":") != 1 {
+		return s, port, nil
+	}
+
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		return s[1 : len(s)-1], port, nil
+	}
+
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if port, err = strconv.Atoi(portStr); err != nil || port <= 0 || port > 0xffff {
+		return "", 0, fmt.Errorf("invalid port in address %s", s)
+	}
+
+	return host, port, nil
+}
+
+// ParsePeerAddr parses peer address "host", "host:port", "[ipv6]" or
+// "[ipv6]:port", the port defaults to default network port. Hostnames are resolved
+// to their first address.
+func ParsePeerAddr(s string) (*net.TCPAddr, error) {
+	host, port, err := splitPeerAddr(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if host == "" {
+		return nil, fmt.Errorf("missing host in address %s", s)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return &net.TCPAddr{IP: ip, Port: port}, nil
+	}
+
+	ips, err := lookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no address for host %s", host)
+	}
+
+	return &net.TCPAddr{IP: ips[0], Port: port}, nil
+}
+
+// ResolveSeeds resolves seed "host" or "host:port" into peer addresses, at
+// default network port unless given, without duplicates. Addresses of the hostnames
+// which resolved are returned along with errors of the ones which didn't.
+func ResolveSeeds(hostnames []string) ([]*net.TCPAddr, error) {
+	var addrs []*net.TCPAddr
+	var errs []error
+	seen := make(map[string]bool)
+
+	for _, seed := range hostnames {
+		host, port, err := splitPeerAddr(seed)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("resolve seed %s: %v", seed, err))
+			continue
+		}
+
+		ips, err := lookupIP(host)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("resolve seed %s: %v", seed, err))
+			continue
+		}
+
+		for _, ip := range ips {
+			addr := &net.TCPAddr{IP: ip, Port: port}
+			if seen[addr.String()] {
+				continue
+			}
+
+			seen[addr.String()] = true
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs, errors.Join(errs...)
+}
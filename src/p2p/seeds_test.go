@@ -0,0 +1,96 @@
+package p2p
+
+import (
+	"consensus"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeLookup replaces lookupIP with records of hosts for the test
+func fakeLookup(t *testing.T, records map[string][]string) {
+	lookupIP = func(host string) ([]net.IP, error) {
+		addrs, ok := records[host]
+		if !ok {
+			return nil, errors.New("no such host " + host)
+		}
+
+		ips := make([]net.IP, len(addrs))
+		for i, addr := range addrs {
+			ips[i] = net.ParseIP(addr)
+		}
+		return ips, nil
+	}
+	t.Cleanup(func() { lookupIP = net.LookupIP })
+}
+
+func TestResolveSeeds(t *testing.T) {
+	fakeLookup(t, map[string][]string{
+		"seed1.example": {"1.2.3.4", "2001:db8::1"},
+		// shares an address with seed1
+		"seed2.example": {"1.2.3.4", "5.6.7.8"},
+	})
+
+	addrs, err := ResolveSeeds([]string{"seed1.example", "seed2.example", "seed2.example:3415", "missing.example"})
+	if err == nil || !strings.Contains(err.Error(), "missing.example") {
+		t.Errorf("got error %v, want failure of missing.example", err)
+	}
+
+	port := consensus.DefaultNetwork().Port
+	want := []string{
+		(&net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: int(port)}).String(),
+		(&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: int(port)}).String(),
+		(&net.TCPAddr{IP: net.ParseIP("5.6.7.8"), Port: int(port)}).String(),
+		"1.2.3.4:3415",
+		"5.6.7.8:3415",
+	}
+
+	if len(addrs) != len(want) {
+		t.Fatalf("resolved %v, want %v", addrs, want)
+	}
+	for i := range want {
+		if addrs[i].String() != want[i] {
+			t.Errorf("address %d resolved as %v, want %s", i, addrs[i], want[i])
+		}
+	}
+}
+
+func TestParsePeerAddr(t *testing.T) {
+	fakeLookup(t, map[string][]string{
+		"seed.example": {"5.6.7.8", "9.9.9.9"},
+	})
+	port := int(consensus.DefaultNetwork().Port)
+
+	tests := []struct {
+		s    string
+		ip   string
+		port int
+	}{
+		{"1.2.3.4", "1.2.3.4", port},
+		{"1.2.3.4:3415", "1.2.3.4", 3415},
+		{"2001:db8::1", "2001:db8::1", port},
+		{"[2001:db8::1]", "2001:db8::1", port},
+		{"[2001:db8::1]:3415", "2001:db8::1", 3415},
+		{"seed.example", "5.6.7.8", port},
+		{"seed.example:3415", "5.6.7.8", 3415},
+	}
+
+	for _, tt := range tests {
+		addr, err := ParsePeerAddr(tt.s)
+		if err != nil {
+			t.Errorf("%s: %v", tt.s, err)
+			continue
+		}
+
+		if !addr.IP.Equal(net.ParseIP(tt.ip)) || addr.Port != tt.port {
+			t.Errorf("%s parsed as %v, want %s port %d", tt.s, addr, tt.ip, tt.port)
+		}
+	}
+
+	for _, invalid := range []string{"", ":3415", "1.2.3.4:0", "1.2.3.4:65536", "1.2.3.4:port", "[2001:db8::1]:", "missing.example"} {
+		if addr, err := ParsePeerAddr(invalid); err == nil {
+			t.Errorf("%q parsed as %v", invalid, addr)
+		}
+	}
+}
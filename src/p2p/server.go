@@ -1 +1,274 @@
 package p2p
+
+import (
+	"consensus"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// defaultKeepAlivePeriod default time between TCP keepalive probes
+const defaultKeepAlivePeriod = 30 * time.Second
+
+var (
+	// ErrNoOutboundSlots is returned when dialing while all outbound slots are used
+	ErrNoOutboundSlots = errors.New("no free outbound peer slots")
+	// ErrDuplicatePeer is returned when the peer is already connected
+	ErrDuplicatePeer = errors.New("peer already connected")
+	// ErrPeerBackoff is returned when dialing banned peer or one recently failing to connect
+	ErrPeerBackoff = errors.New("peer banned or backing off after failed connections")
+)
+
+// NodeConfig is configuration of p2p node
+type NodeConfig struct {
+	// ListenAddr address to listen for inbound connections on
+	ListenAddr string
+	// InboundSlots maximum number of peers connected to us
+	InboundSlots int
+	// OutboundSlots maximum number of peers we connect to. They are
+	// reserved separately so inbound peers can't take all connections.
+	OutboundSlots int
+	// DialTimeout how long we wait for TCP connection to a peer
+	DialTimeout time.Duration
+	// HandshakeTimeout how long we wait for the handshake once connected
+	HandshakeTimeout time.Duration
+	// KeepAlive enables TCP keepalive on peer connections
+	KeepAlive bool
+	// KeepAlivePeriod time between TCP keepalive probes, zero means OS default
+	KeepAlivePeriod time.Duration
+}
+
+// DefaultNodeConfig returns default node configuration
+func DefaultNodeConfig() NodeConfig {
+	return NodeConfig{
+		ListenAddr:       fmt.Sprintf(":%d", consensus.DefaultNetwork().Port),
+		InboundSlots:     117,
+		OutboundSlots:    8,
+		DialTimeout:      defaultDialTimeout,
+		HandshakeTimeout: defaultHandshakeTimeout,
+		KeepAlive:        true,
+		KeepAlivePeriod:  defaultKeepAlivePeriod,
+	}
+}
+
+// Server accepts inbound peers and dials outbound ones
+type Server struct {
+	config NodeConfig
+
+	// known peer addresses
+	store *PeerStore
+	// connected peers
+	peers *PeerSet
+
+	// guards slot counters
+	slotsMu sync.Mutex
+	// used slots by direction
+	slots [2]int
+
+	listener net.Listener
+	wg       sync.WaitGroup
+}
+
+// NewServer creates p2p server
+func NewServer(config NodeConfig, store *PeerStore) *Server {
+	return &Server{
+		config: config,
+		store:  store,
+		peers:  NewPeerSet(),
+	}
+}
+
+// Peers returns connected peers
+func (s *Server) Peers() *PeerSet {
+	return s.peers
+}
+
+// reserveSlot takes a peer slot in direction, returns false if all are used
+func (s *Server) reserveSlot(direction Direction) bool {
+	s.slotsMu.Lock()
+	defer s.slotsMu.Unlock()
+
+	max := s.config.InboundSlots
+	if direction == Outbound {
+		max = s.config.OutboundSlots
+	}
+
+	if s.slots[direction] >= max {
+		return false
+	}
+
+	s.slots[direction]++
+	return true
+}
+
+// releaseSlot frees a peer slot in direction
+func (s *Server) releaseSlot(direction Direction) {
+	s.slotsMu.Lock()
+	defer s.slotsMu.Unlock()
+
+	s.slots[direction]--
+}
+
+// Start starts listening for inbound peers
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.config.ListenAddr)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("listen on ", listener.Addr())
+	s.listener = listener
+
+	s.wg.Add(1)
+	go s.acceptHandler()
+	return nil
+}
+
+// Stop stops listening and waits for the accept loop to exit
+func (s *Server) Stop() {
+	if s.listener != nil {
+		s.listener.Close()
+	}
+
+	s.wg.Wait()
+}
+
+// acceptHandler accepts inbound connections while inbound slots are free.
+//
+// NOTE: This method MUST be run as a goroutine.
+func (s *Server) acceptHandler() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			logger.Info("stop accepting peers: ", err)
+			return
+		}
+
+		if !s.reserveSlot(Inbound) {
+			logger.Debug("no free inbound slots, reject ", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		go func() {
+			if err := s.setKeepAlive(conn); err != nil {
+				logger.Debug("cannot set keepalive: ", err)
+			}
+
+			setHandshakeDeadline(conn, s.config.HandshakeTimeout)
+			p, err := AcceptNewPeer(conn)
+			if err != nil {
+				logger.Info("cannot accept peer: ", err)
+				conn.Close()
+				s.releaseSlot(Inbound)
+				return
+			}
+			conn.SetDeadline(time.Time{})
+
+			if err := s.runPeer(p, Inbound); err != nil {
+				logger.Info("cannot accept peer: ", err)
+			}
+		}()
+	}
+}
+
+// Connect dials peer at addr using an outbound slot. A peer accepting TCP
+// but failing handshake counts as failed connection as well, see
+// PeerStore.ConnectFailed.
+func (s *Server) Connect(addr string) (*Peer, error) {
+	raddr, err := ParsePeerAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.store.CanConnect(raddr) {
+		return nil, ErrPeerBackoff
+	}
+
+	if !s.reserveSlot(Outbound) {
+		return nil, ErrNoOutboundSlots
+	}
+
+	p, err := DialPeer(addr, s.config.DialTimeout, s.config.HandshakeTimeout, s.listenPort())
+	if err != nil {
+		s.releaseSlot(Outbound)
+		if s.store.ConnectFailed(raddr) {
+			logger.Info("peer marked bad after failed connections: ", raddr)
+		}
+		return nil, err
+	}
+	s.store.ConnectSucceeded(raddr)
+
+	if err := s.setKeepAlive(p.conn); err != nil {
+		logger.Debug("cannot set keepalive: ", err)
+	}
+
+	if err := s.runPeer(p, Outbound); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// listenPort returns port the server accepts connections on, zero if
+// it's not listening
+func (s *Server) listenPort() uint16 {
+	if s.listener == nil {
+		return 0
+	}
+
+	return uint16(tcpAddr(s.listener.Addr()).Port)
+}
+
+// setKeepAlive applies TCP keepalive configuration to TCP connections
+func (s *Server) setKeepAlive(conn net.Conn) error {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	if err := tcp.SetKeepAlive(s.config.KeepAlive); err != nil {
+		return err
+	}
+
+	if !s.config.KeepAlive || s.config.KeepAlivePeriod == 0 {
+		return nil
+	}
+
+	return tcp.SetKeepAlivePeriod(s.config.KeepAlivePeriod)
+}
+
+// runPeer starts peer and cleans up when it disconnects. Peer already
+// connected (by PeerID) is closed with ErrDuplicatePeer.
+func (s *Server) runPeer(p *Peer, direction Direction) error {
+	// inbound peers connect from ephemeral ports, store the address they
+	// listen on to connect back later
+	addr := p.ListenAddr()
+
+	if !s.peers.Add(p) {
+		p.conn.Close()
+		s.releaseSlot(direction)
+		return ErrDuplicatePeer
+	}
+
+	p.SetPeerStore(s.store)
+	if addr.Port != 0 {
+		s.store.AddPeer(addr, p.PeerCapabilities())
+	}
+	s.store.SetConnected(addr, true)
+	p.Start()
+
+	go func() {
+		p.WaitForDisconnect()
+
+		s.peers.Remove(p)
+		s.store.SetConnected(addr, false)
+		s.releaseSlot(direction)
+	}()
+
+	return nil
+}
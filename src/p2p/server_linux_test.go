@@ -0,0 +1,91 @@
+package p2p
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	dialed, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := l.Accept()
+	if err != nil {
+		dialed.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dialed.Close()
+		accepted.Close()
+	})
+
+	return dialed.(*net.TCPConn), accepted.(*net.TCPConn)
+}
+
+// sockopt returns socket option of conn
+func sockopt(t *testing.T, conn *net.TCPConn, level, opt int) int {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var value int
+	var optErr error
+	if err := raw.Control(func(fd uintptr) {
+		value, optErr = syscall.GetsockoptInt(int(fd), level, opt)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if optErr != nil {
+		t.Fatal(optErr)
+	}
+
+	return value
+}
+
+func TestKeepAliveApplied(t *testing.T) {
+	dialed, accepted := tcpPair(t)
+
+	config := DefaultNodeConfig()
+	config.KeepAlivePeriod = 45 * time.Second
+	s := NewServer(config, NewPeerStore())
+	for _, conn := range []*net.TCPConn{dialed, accepted} {
+		if err := s.setKeepAlive(conn); err != nil {
+			t.Fatal(err)
+		}
+		if on := sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); on == 0 {
+			t.Error("keepalive not enabled")
+		}
+		if idle := sockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); idle != 45 {
+			t.Errorf("keepalive idle %ds, want 45s", idle)
+		}
+	}
+
+	// Go enables keepalive by default, disabled configuration turns it off
+	config.KeepAlive = false
+	s = NewServer(config, NewPeerStore())
+	if err := s.setKeepAlive(dialed); err != nil {
+		t.Fatal(err)
+	}
+	if on := sockopt(t, dialed, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); on != 0 {
+		t.Error("keepalive enabled by disabled configuration")
+	}
+
+	// connections other than TCP are left alone
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	if err := s.setKeepAlive(local); err != nil {
+		t.Errorf("keepalive on pipe: %v", err)
+	}
+}
@@ -0,0 +1,236 @@
+package p2p
+
+import (
+	"bytes"
+	"consensus"
+	"net"
+	"testing"
+	"time"
+)
+
+// remoteHand returns hand of a remote node identified by nonce
+func remoteHand(nonce uint64, sender, receiver net.Addr) *hand {
+	return &hand{
+		Version:         consensus.ProtocolVersion,
+		Capabilities:    consensus.CapFullNode,
+		Nonce:           nonce,
+		TotalDifficulty: 1,
+		Genesis:         consensus.DefaultNetwork().GenesisHash(),
+		MaxMsgLen:       consensus.MaxMsgLen,
+		SenderAddr:      tcpAddr(sender),
+		ReceiverAddr:    tcpAddr(receiver),
+		UserAgent:       "remote",
+	}
+}
+
+// remoteShake returns shake of a remote node identified by nonce
+func remoteShake(nonce uint64) *shake {
+	return &shake{
+		Version:         consensus.ProtocolVersion,
+		Capabilities:    consensus.CapFullNode,
+		Nonce:           nonce,
+		TotalDifficulty: 1,
+		Genesis:         consensus.DefaultNetwork().GenesisHash(),
+		MaxMsgLen:       consensus.MaxMsgLen,
+		UserAgent:       "remote",
+	}
+}
+
+// dialServer connects to s as a remote node identified by nonce and
+// completes the handshake
+func dialServer(t *testing.T, s *Server, nonce uint64) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	if _, err := WriteMessage(conn, remoteHand(nonce, conn.LocalAddr(), conn.RemoteAddr())); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadMessage(conn, new(shake)); err != nil {
+		t.Fatal(err)
+	}
+
+	return conn
+}
+
+// listenRemote accepts one connection as a remote node identified by nonce,
+// returns address to dial
+func listenRemote(t *testing.T, nonce uint64) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+
+		if _, err := ReadMessage(conn, new(hand)); err != nil {
+			return
+		}
+		WriteMessage(conn, remoteShake(nonce))
+	}()
+
+	return l.Addr().String()
+}
+
+// startServer starts server listening on loopback with slots
+func startServer(t *testing.T, inbound, outbound int) *Server {
+	t.Helper()
+	config := DefaultNodeConfig()
+	config.ListenAddr = "127.0.0.1:0"
+	config.InboundSlots = inbound
+	config.OutboundSlots = outbound
+
+	s := NewServer(config, NewPeerStore())
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+
+	return s
+}
+
+func TestFullInboundDoesNotBlockOutbound(t *testing.T) {
+	s := startServer(t, 1, 1)
+
+	dialServer(t, s, 1)
+	eventually(t, "inbound peer connected", func() bool { return s.Peers().Len() == 1 })
+
+	if s.reserveSlot(Inbound) {
+		t.Fatal("inbound slot free with the inbound peer connected")
+	}
+
+	p, err := s.Connect(listenRemote(t, 2))
+	if err != nil {
+		t.Fatalf("outbound connection with inbound slots full: %v", err)
+	}
+	t.Cleanup(p.Close)
+
+	if n := s.Peers().Len(); n != 2 {
+		t.Errorf("%d peers connected, want 2", n)
+	}
+
+	// outbound slots are full now as well
+	if _, err := s.Connect(listenRemote(t, 3)); err != ErrNoOutboundSlots {
+		t.Errorf("outbound connection with all slots used: got %v, want %v", err, ErrNoOutboundSlots)
+	}
+}
+
+func TestDialTimeoutUnroutable(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+
+	// TEST-NET-1 address, never routed
+	start := time.Now()
+	p, err := DialPeer("192.0.2.1:3414", timeout, time.Minute, 0)
+	if err == nil {
+		p.Close()
+		t.Fatal("dialing unroutable address succeeded")
+	}
+
+	if d := time.Since(start); d > timeout+time.Second {
+		t.Errorf("dial failed after %v, want within %v", d, timeout)
+	}
+}
+
+func TestInboundAdvertisedPortStored(t *testing.T) {
+	s := startServer(t, 1, 1)
+
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	source := conn.LocalAddr().(*net.TCPAddr)
+	advertised := &net.TCPAddr{IP: source.IP, Port: source.Port + 1}
+	if _, err := WriteMessage(conn, remoteHand(^localNonce, advertised, conn.RemoteAddr())); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadMessage(conn, new(shake)); err != nil {
+		t.Fatal(err)
+	}
+
+	known := func(addr *net.TCPAddr) bool {
+		s.store.RLock()
+		defer s.store.RUnlock()
+		_, ok := s.store.peers[addr.String()]
+		return ok
+	}
+	eventually(t, "advertised address stored", func() bool { return known(advertised) })
+	if known(source) {
+		t.Errorf("source address %v stored", source)
+	}
+}
+
+// listenGarbage accepts connections and answers hand with garbage, returns
+// address to dial
+func listenGarbage(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := ReadMessage(conn, new(hand)); err != nil {
+					return
+				}
+				conn.Write(bytes.Repeat([]byte{0xff}, int(consensus.HeaderLen)))
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestHandshakeFailuresMarkPeerBad(t *testing.T) {
+	clock := consensus.NewMockClock(time.Unix(1500000000, 0))
+	store := NewPeerStore()
+	store.SetClock(clock)
+	s := NewServer(DefaultNodeConfig(), store)
+
+	addr := listenGarbage(t)
+	raddr, err := ParsePeerAddr(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i < maxConnectFailures; i++ {
+		if _, err := s.Connect(addr); err == nil {
+			t.Fatal("handshake with garbage succeeded")
+		}
+		if store.IsBanned(raddr) {
+			t.Fatalf("peer marked bad after %d failed handshakes", i)
+		}
+
+		// failed handshake backs off like failed dial
+		if _, err := s.Connect(addr); err != ErrPeerBackoff {
+			t.Fatalf("reconnect after failed handshake: got %v, want %v", err, ErrPeerBackoff)
+		}
+		clock.Advance(connectBackoff << uint(i-1))
+	}
+
+	if _, err := s.Connect(addr); err == nil {
+		t.Fatal("handshake with garbage succeeded")
+	}
+	if !store.IsBanned(raddr) {
+		t.Errorf("peer not marked bad after %d failed handshakes", maxConnectFailures)
+	}
+}
@@ -0,0 +1,270 @@
+package p2p
+
+import (
+	"consensus"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// peerFreshness is how long a peer address is considered fresh after it was last seen
+	peerFreshness = 3 * 24 * time.Hour
+	// connectBackoff is how long we wait before reconnecting after the first
+	// failed connection, doubled with every next failure
+	connectBackoff = 10 * time.Second
+	// maxConnectFailures is the number of failed connections in a row after
+	// which the peer is marked bad
+	maxConnectFailures = 5
+	// badPeerBan is how long a peer marked bad is banned
+	badPeerBan = time.Hour
+)
+
+// peerRecord is what the store knows about a peer address
+type peerRecord struct {
+	// network address of the peer
+	Addr *net.TCPAddr
+	// advertised capabilities
+	Capabilities consensus.Capabilities
+	// last time the peer was seen/advertised
+	LastSeen time.Time
+	// peer is banned until
+	BannedUntil time.Time
+	// connection with the peer is established
+	Connected bool
+	// number of failed connections in a row
+	ConnectFailures int
+	// no connection is attempted until
+	RetryAfter time.Time
+}
+
+// PeerStore keeps known peer addresses
+type PeerStore struct {
+	sync.RWMutex
+
+	peers map[string]*peerRecord
+
+	// tells time of bans and freshness
+	clock consensus.Clock
+}
+
+// NewPeerStore creates empty in-memory peer store
+func NewPeerStore() *PeerStore {
+	return &PeerStore{
+		peers: make(map[string]*peerRecord),
+		clock: consensus.RealClock,
+	}
+}
+
+// SetClock sets clock telling time of bans and freshness
+func (s *PeerStore) SetClock(c consensus.Clock) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.clock = c
+}
+
+// record returns peer record creating it if needed, must be called with lock held
+func (s *PeerStore) record(addr *net.TCPAddr) *peerRecord {
+	key := addr.String()
+	rec, ok := s.peers[key]
+	if !ok {
+		rec = &peerRecord{Addr: addr}
+		s.peers[key] = rec
+	}
+
+	return rec
+}
+
+// AddPeer adds or refreshes peer address with its capabilities
+func (s *PeerStore) AddPeer(addr *net.TCPAddr, caps consensus.Capabilities) {
+	s.Lock()
+	defer s.Unlock()
+
+	rec := s.record(addr)
+	rec.Capabilities = caps
+	rec.LastSeen = s.clock.Now()
+}
+
+// AddPeerAddr adds peer address advertised without capabilities, returns
+// false if the address is already known, its capabilities and freshness
+// are left as they are
+func (s *PeerStore) AddPeerAddr(addr *net.TCPAddr) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.peers[addr.String()]; ok {
+		return false
+	}
+
+	rec := s.record(addr)
+	rec.Capabilities = consensus.CapUnknown
+	rec.LastSeen = s.clock.Now()
+	return true
+}
+
+// Ban bans peer address for duration d
+func (s *PeerStore) Ban(addr *net.TCPAddr, d time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.record(addr).BannedUntil = s.clock.Now().Add(d)
+}
+
+// IsBanned checks whether peer address is currently banned
+func (s *PeerStore) IsBanned(addr *net.TCPAddr) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	rec, ok := s.peers[addr.String()]
+	return ok && s.clock.Now().Before(rec.BannedUntil)
+}
+
+// CanConnect checks whether connection to peer address may be attempted:
+// it's neither banned nor backing off after failed connections
+func (s *PeerStore) CanConnect(addr *net.TCPAddr) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	rec, ok := s.peers[addr.String()]
+	if !ok {
+		return true
+	}
+
+	now := s.clock.Now()
+	return !now.Before(rec.BannedUntil) && !now.Before(rec.RetryAfter)
+}
+
+// ConnectFailed records failed connection to peer address, be it TCP or
+// handshake failure, and backs off reconnecting. After maxConnectFailures
+// in a row the peer is marked bad: banned for badPeerBan. Returns true if
+// the peer is marked bad.
+func (s *PeerStore) ConnectFailed(addr *net.TCPAddr) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	rec := s.record(addr)
+	now := s.clock.Now()
+
+	rec.ConnectFailures++
+	if rec.ConnectFailures >= maxConnectFailures {
+		rec.ConnectFailures = 0
+		rec.RetryAfter = time.Time{}
+		rec.BannedUntil = now.Add(badPeerBan)
+		return true
+	}
+
+	rec.RetryAfter = now.Add(connectBackoff << uint(rec.ConnectFailures-1))
+	return false
+}
+
+// ConnectSucceeded clears failed connections of peer address
+func (s *PeerStore) ConnectSucceeded(addr *net.TCPAddr) {
+	s.Lock()
+	defer s.Unlock()
+
+	rec := s.record(addr)
+	rec.ConnectFailures = 0
+	rec.RetryAfter = time.Time{}
+}
+
+// SetConnected marks whether a connection with the peer is established
+func (s *PeerStore) SetConnected(addr *net.TCPAddr, connected bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.record(addr).Connected = connected
+}
+
+// netGroup returns the network group of ip: /16 for IPv4 and /32 for IPv6
+func netGroup(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return string(ip4[:2])
+	}
+
+	return string(ip.To16()[:4])
+}
+
+// SelectOutbound returns up to n fresh, not banned and not connected peers
+// having all capabilities caps. Peers are picked round-robin across network
+// groups so that outbound connections are spread over as many groups as possible.
+func (s *PeerStore) SelectOutbound(n int, caps consensus.Capabilities) []*net.TCPAddr {
+	s.RLock()
+	now := s.clock.Now()
+	groups := make(map[string][]*net.TCPAddr)
+	for _, rec := range s.peers {
+		if rec.Connected || now.Before(rec.BannedUntil) || now.Before(rec.RetryAfter) ||
+			now.Sub(rec.LastSeen) > peerFreshness ||
+			rec.Capabilities&caps != caps {
+			continue
+		}
+
+		group := netGroup(rec.Addr.IP)
+		groups[group] = append(groups[group], rec.Addr)
+	}
+	s.RUnlock()
+
+	buckets := make([][]*net.TCPAddr, 0, len(groups))
+	for _, addrs := range groups {
+		rand.Shuffle(len(addrs), func(i, j int) { addrs[i], addrs[j] = addrs[j], addrs[i] })
+		buckets = append(buckets, addrs)
+	}
+	rand.Shuffle(len(buckets), func(i, j int) { buckets[i], buckets[j] = buckets[j], buckets[i] })
+
+	var result []*net.TCPAddr
+	for len(result) < n && len(buckets) > 0 {
+		next := buckets[:0]
+		for _, addrs := range buckets {
+			if len(result) == n {
+				break
+			}
+
+			result = append(result, addrs[0])
+			if len(addrs) > 1 {
+				next = append(next, addrs[1:])
+			}
+		}
+		buckets = next
+	}
+
+	return result
+}
+
+// Peers returns up to max fresh and not banned peer addresses having all
+// capabilities caps
+func (s *PeerStore) Peers(caps consensus.Capabilities, max int) []*net.TCPAddr {
+	peers := s.PeerAddrs(caps, max)
+
+	result := make([]*net.TCPAddr, len(peers))
+	for i := range peers {
+		result[i] = peers[i].Addr
+	}
+
+	return result
+}
+
+// PeerAddrs returns up to max fresh and not banned peer addresses having all
+// capabilities caps, along with their capabilities. Peers are picked in map
+// iteration order, so which ones are returned varies between calls.
+func (s *PeerStore) PeerAddrs(caps consensus.Capabilities, max int) []PeerAddr {
+	s.RLock()
+	defer s.RUnlock()
+
+	now := s.clock.Now()
+	var result []PeerAddr
+	for _, rec := range s.peers {
+		if len(result) == max {
+			break
+		}
+
+		if now.Before(rec.BannedUntil) || now.Sub(rec.LastSeen) > peerFreshness ||
+			rec.Capabilities&caps != caps {
+			continue
+		}
+
+		result = append(result, PeerAddr{Addr: rec.Addr, Capabilities: rec.Capabilities})
+	}
+
+	return result
+}
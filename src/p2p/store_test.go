@@ -0,0 +1,95 @@
+package p2p
+
+import (
+	"consensus"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// mustAddr parses "ip:port" address
+func mustAddr(t *testing.T, s string) *net.TCPAddr {
+	t.Helper()
+	addr, err := net.ResolveTCPAddr("tcp", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr
+}
+
+func TestSelectOutboundDiversity(t *testing.T) {
+	s := NewPeerStore()
+
+	// many peers in one /16
+	for i := 0; i < 50; i++ {
+		s.AddPeer(mustAddr(t, fmt.Sprintf("10.1.%d.%d:3414", i/10, i%10+1)), consensus.CapFullNode)
+	}
+
+	others := []string{"20.1.0.1:3414", "30.1.0.1:3414", "40.1.0.1:3414"}
+	for _, addr := range others {
+		s.AddPeer(mustAddr(t, addr), consensus.CapFullNode)
+	}
+
+	// excluded ones
+	banned := mustAddr(t, "50.1.0.1:3414")
+	s.AddPeer(banned, consensus.CapFullNode)
+	s.Ban(banned, badPeerBan)
+
+	connected := mustAddr(t, "60.1.0.1:3414")
+	s.AddPeer(connected, consensus.CapFullNode)
+	s.SetConnected(connected, true)
+
+	s.AddPeer(mustAddr(t, "70.1.0.1:3414"), consensus.CapUnknown)
+
+	selected := s.SelectOutbound(5, consensus.CapFullNode)
+	if len(selected) != 5 {
+		t.Fatalf("%d peers selected, want 5", len(selected))
+	}
+
+	groups := make(map[string]int)
+	for _, addr := range selected {
+		groups[addr.IP.To4()[:2].String()]++
+	}
+
+	// every group gets a peer before any gets a second one
+	if n := groups[net.IP{10, 1}.String()]; n != 2 {
+		t.Errorf("%d peers selected from the crowded /16, want 2: %v", n, selected)
+	}
+
+	for _, addr := range others {
+		if groups[mustAddr(t, addr).IP.To4()[:2].String()] != 1 {
+			t.Errorf("peer %s not selected: %v", addr, selected)
+		}
+	}
+}
+
+func TestBanExpiry(t *testing.T) {
+	clock := consensus.NewMockClock(time.Unix(1500000000, 0))
+	store := NewPeerStore()
+	store.SetClock(clock)
+
+	addr := mustAddr(t, "1.2.3.4:3414")
+	store.AddPeer(addr, consensus.CapFullNode)
+	store.Ban(addr, time.Hour)
+
+	if !store.IsBanned(addr) || store.CanConnect(addr) {
+		t.Fatal("peer not banned")
+	}
+	if peers := store.Peers(consensus.CapUnknown, 10); len(peers) != 0 {
+		t.Errorf("banned peer advertised: %v", peers)
+	}
+
+	clock.Advance(time.Hour - time.Second)
+	if !store.IsBanned(addr) {
+		t.Fatal("ban expired a second early")
+	}
+
+	clock.Advance(time.Second)
+	if store.IsBanned(addr) || !store.CanConnect(addr) {
+		t.Error("ban didn't expire")
+	}
+	if peers := store.Peers(consensus.CapUnknown, 10); len(peers) != 1 {
+		t.Errorf("peer not advertised after ban expired, got %v", peers)
+	}
+}
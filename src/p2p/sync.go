@@ -0,0 +1,508 @@
+package p2p
+
+import (
+	"consensus"
+	"context"
+	"errors"
+	"sync"
+)
+
+var (
+	// ErrNoArchivalPeer is returned when block beyond the cut-through horizon
+	// is needed but no connected peer keeps full history
+	ErrNoArchivalPeer = errors.New("no archival peer connected")
+	// ErrUnknownParent is returned when received headers don't extend the local chain
+	ErrUnknownParent = errors.New("headers parent not in the chain")
+)
+
+// maxBlocksInFlight maximum number of block requests waiting for response,
+// the next queued block is requested as one arrives
+const maxBlocksInFlight = 8
+
+// SyncState is state of the chain synchronization
+type SyncState int32
+
+const (
+	// SyncIdle chain is in sync with known peers
+	SyncIdle SyncState = iota
+	// SyncHeaders headers are requested from a peer with more work
+	SyncHeaders
+	// SyncBlocks blocks of received headers are requested
+	SyncBlocks
+)
+
+// String implements Stringer interface
+func (s SyncState) String() string {
+	switch s {
+	case SyncIdle:
+		return "idle"
+	case SyncHeaders:
+		return "header sync"
+	case SyncBlocks:
+		return "block sync"
+	}
+
+	return "unknown"
+}
+
+// SyncProgress reports progress of the chain synchronization
+type SyncProgress struct {
+	// CurrentHeight height of the local chain head
+	CurrentHeight uint64
+	// TargetHeight highest height advertised by the sync peer
+	TargetHeight uint64
+	// HeadersDownloaded number of headers received
+	HeadersDownloaded uint64
+	// BlocksDownloaded number of requested blocks received
+	BlocksDownloaded uint64
+	// Percent estimated percentage of the target height reached
+	Percent float64
+}
+
+// Chain is the local chain synchronized by SyncManager
+type Chain interface {
+	// TotalDifficulty of the chain head
+	TotalDifficulty() consensus.Difficulty
+	// Head returns hash and height of the chain head
+	Head() (consensus.Hash, uint64)
+	// NextDifficulty returns difficulty the next block must be mined at
+	NextDifficulty() consensus.Difficulty
+	// Locator returns hashes of known blocks, from the most recent one
+	Locator() []consensus.Hash
+	// HasBlock checks whether block is in the chain
+	HasBlock(hash consensus.Hash) bool
+	// Header returns header of block hash in the chain
+	Header(hash consensus.Hash) (*consensus.BlockHeader, bool)
+	// DifficultyWindow returns difficulty window of the blocks up to hash
+	DifficultyWindow(hash consensus.Hash) (*consensus.DifficultyWindow, bool)
+	// AddBlock adds block to the chain
+	AddBlock(b *consensus.Block) error
+}
+
+// HeaderSource gives block headers served to peers asking for them
+type HeaderSource interface {
+	// BlockHeight returns height of block hash if it's in the chain
+	BlockHeight(hash consensus.Hash) (uint64, bool)
+	// HeadersFrom returns at most max headers of the chain starting at height
+	HeadersFrom(height uint64, max int) []consensus.BlockHeader
+}
+
+// FindForkPoint returns height of the first locator hash we have, that is
+// the highest block shared with the peer sending locator. False if we have
+// none of them.
+func FindForkPoint(locator []consensus.Hash, have func(consensus.Hash) (uint64, bool)) (uint64, bool) {
+	for _, hash := range locator {
+		if height, ok := have(hash); ok {
+			return height, true
+		}
+	}
+
+	return 0, false
+}
+
+// SyncPeer is a peer the chain is synchronized from
+type SyncPeer interface {
+	PeerCapabilities() consensus.Capabilities
+	SendHeaderRequest(locator []consensus.Hash) ([]*consensus.BlockHeader, error)
+	SendBlockRequest(ctx context.Context, hash consensus.Hash) (*consensus.Block, error)
+}
+
+// SyncManager drives chain synchronization: when a peer advertises more
+// total difficulty it requests headers then blocks of these headers from
+// the peer and gets back to idle once all blocks are received.
+type SyncManager struct {
+	sync.Mutex
+
+	chain Chain
+	state SyncState
+
+	// peer we sync from
+	peer SyncPeer
+	// connected peers, blocks beyond the cut-through horizon are requested
+	// from archival ones
+	peers map[SyncPeer]struct{}
+	// hashes of requested blocks
+	pending map[consensus.Hash]struct{}
+	// requested blocks waiting for a request slot
+	queue []queuedBlock
+	// hashes of blocks requested from peers, at most maxBlocksInFlight
+	inFlight map[consensus.Hash]struct{}
+	// context of block requests in flight
+	blocksCtx context.Context
+	// cancels block requests in flight
+	cancelBlocks context.CancelFunc
+	// received blocks waiting for their parent
+	orphans *OrphanPool
+	// cache of served blocks, invalidated on reorg
+	blockCache *BlockCache
+
+	// highest height advertised by the sync peer
+	targetHeight uint64
+	// number of headers received
+	headersDownloaded uint64
+	// number of requested blocks received
+	blocksDownloaded uint64
+}
+
+// NewSyncManager creates idle sync manager of chain
+func NewSyncManager(chain Chain) *SyncManager {
+	return &SyncManager{
+		chain:    chain,
+		peers:    make(map[SyncPeer]struct{}),
+		pending:  make(map[consensus.Hash]struct{}),
+		inFlight: make(map[consensus.Hash]struct{}),
+		orphans:  NewOrphanPool(defaultMaxOrphans),
+	}
+}
+
+// SetBlockCache sets cache of blocks served to peers, it's invalidated
+// when a synced block reorganizes the chain
+func (m *SyncManager) SetBlockCache(c *BlockCache) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.blockCache = c
+}
+
+// State returns current sync state
+func (m *SyncManager) State() SyncState {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.state
+}
+
+// Progress returns progress of the chain synchronization
+func (m *SyncManager) Progress() SyncProgress {
+	m.Lock()
+	defer m.Unlock()
+
+	_, height := m.chain.Head()
+	progress := SyncProgress{
+		CurrentHeight:     height,
+		TargetHeight:      m.targetHeight,
+		HeadersDownloaded: m.headersDownloaded,
+		BlocksDownloaded:  m.blocksDownloaded,
+		Percent:           100,
+	}
+
+	if height < m.targetHeight {
+		progress.Percent = float64(height) * 100 / float64(m.targetHeight)
+	}
+
+	return progress
+}
+
+// Tip returns the chain tip
+func (m *SyncManager) Tip() Tip {
+	hash, height := m.chain.Head()
+	return Tip{
+		Hash:            hash,
+		Height:          height,
+		TotalDifficulty: m.chain.TotalDifficulty(),
+	}
+}
+
+// NetworkHashrate estimates network hashrate in graphs per second from
+// the current chain difficulty
+func (m *SyncManager) NetworkHashrate() float64 {
+	return consensus.EstimateHashrate(m.chain.NextDifficulty(), consensus.DefaultNetwork().BlockTimeSec)
+}
+
+// HasBlock checks whether block is in the chain
+func (m *SyncManager) HasBlock(hash consensus.Hash) bool {
+	return m.chain.HasBlock(hash)
+}
+
+// AddPeer adds connected peer blocks may be requested from
+func (m *SyncManager) AddPeer(peer SyncPeer) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.peers[peer] = struct{}{}
+}
+
+// RemovePeer stops sync from peer, e.g. on disconnect. Its pending block
+// requests are cancelled and sync gets back to idle to pick another peer.
+func (m *SyncManager) RemovePeer(peer SyncPeer) {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.peers, peer)
+	if m.peer != peer {
+		return
+	}
+
+	m.reset()
+}
+
+// reset drops sync peer and its pending block requests then gets back to
+// idle, must be called with lock held
+func (m *SyncManager) reset() {
+	if m.cancelBlocks != nil {
+		m.cancelBlocks()
+		m.cancelBlocks = nil
+	}
+
+	m.pending = make(map[consensus.Hash]struct{})
+	m.queue = nil
+	m.inFlight = make(map[consensus.Hash]struct{})
+	m.blocksCtx = nil
+	m.peer = nil
+	m.setState(SyncIdle)
+}
+
+// setState transitions to state, must be called with lock held
+func (m *SyncManager) setState(state SyncState) {
+	logger.Info("sync state: ", m.state, " -> ", state)
+	m.state = state
+}
+
+// OnPing starts header sync from peer if it has more total difficulty
+func (m *SyncManager) OnPing(peer SyncPeer, ping *Ping) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.state != SyncIdle || ping.TotalDifficulty <= m.chain.TotalDifficulty() {
+		return
+	}
+
+	m.peer = peer
+	if ping.Height > m.targetHeight {
+		m.targetHeight = ping.Height
+	}
+	m.setState(SyncHeaders)
+	go m.requestHeaders(peer, m.chain.Locator())
+}
+
+// requestHeaders requests headers from the sync peer and passes them to
+// OnHeaders, sync gets back to idle if the peer doesn't respond
+func (m *SyncManager) requestHeaders(peer SyncPeer, locator []consensus.Hash) {
+	resp, err := peer.SendHeaderRequest(locator)
+	if err != nil {
+		logger.Info("cannot sync headers: ", err)
+
+		m.Lock()
+		if m.state == SyncHeaders && m.peer == peer {
+			m.reset()
+		}
+		m.Unlock()
+		return
+	}
+
+	headers := make([]consensus.BlockHeader, len(resp))
+	for i := range resp {
+		headers[i] = *resp[i]
+	}
+
+	m.OnHeaders(peer, headers)
+}
+
+// OnHeaders requests blocks of headers received from the sync peer
+func (m *SyncManager) OnHeaders(peer SyncPeer, headers []consensus.BlockHeader) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.state != SyncHeaders || peer != m.peer {
+		return
+	}
+
+	if len(headers) == 0 {
+		m.reset()
+		return
+	}
+
+	if err := m.validateHeaders(headers); err != nil {
+		logger.Warn("invalid headers from sync peer: ", err)
+		m.reset()
+		return
+	}
+
+	m.headersDownloaded += uint64(len(headers))
+	if last := headers[len(headers)-1].Height; last > m.targetHeight {
+		m.targetHeight = last
+	}
+
+	queue := make([]queuedBlock, len(headers))
+	for i := range headers {
+		source, err := m.blockPeer(peer, headers[i].Height)
+		if err != nil {
+			logger.Warn("cannot sync block: ", err)
+			m.reset()
+			return
+		}
+		queue[i] = queuedBlock{peer: source, hash: headers[i].Hash()}
+	}
+
+	m.blocksCtx, m.cancelBlocks = context.WithCancel(context.Background())
+
+	m.setState(SyncBlocks)
+	for _, block := range queue {
+		m.pending[block.hash] = struct{}{}
+	}
+	m.queue = queue
+	m.requestQueued()
+}
+
+// queuedBlock is a block waiting for a request slot
+type queuedBlock struct {
+	// peer the block is requested from
+	peer SyncPeer
+	hash consensus.Hash
+}
+
+// requestQueued requests queued blocks until maxBlocksInFlight requests
+// are in flight, must be called with lock held
+func (m *SyncManager) requestQueued() {
+	for len(m.inFlight) < maxBlocksInFlight && len(m.queue) > 0 {
+		block := m.queue[0]
+		m.queue = m.queue[1:]
+
+		// received without request meanwhile
+		if _, ok := m.pending[block.hash]; !ok {
+			continue
+		}
+
+		m.inFlight[block.hash] = struct{}{}
+		go m.requestBlock(m.blocksCtx, block.peer, block.hash)
+	}
+}
+
+// validateHeaders checks headers extend the local chain and carry valid
+// proof of work, must be called with lock held
+func (m *SyncManager) validateHeaders(headers []consensus.BlockHeader) error {
+	prev, ok := m.chain.Header(headers[0].Previous)
+	if !ok {
+		return ErrUnknownParent
+	}
+
+	window, ok := m.chain.DifficultyWindow(headers[0].Previous)
+	if !ok {
+		return ErrUnknownParent
+	}
+
+	chain := make([]*consensus.BlockHeader, len(headers))
+	for i := range headers {
+		chain[i] = &headers[i]
+	}
+
+	if err := consensus.ValidateHeaderChain(chain, prev, window); err != nil {
+		return err
+	}
+
+	for i := range headers {
+		if err := consensus.ValidatePoW(&headers[i], *consensus.DefaultNetwork()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// blockPeer returns peer to request block at height from: the sync peer
+// unless the block is beyond the cut-through horizon and the sync peer
+// isn't archival, must be called with lock held
+func (m *SyncManager) blockPeer(peer SyncPeer, height uint64) (SyncPeer, error) {
+	if height+uint64(consensus.CutThroughHorizon) >= m.targetHeight ||
+		peer.PeerCapabilities()&consensus.CapArchival != 0 {
+		return peer, nil
+	}
+
+	for p := range m.peers {
+		if p.PeerCapabilities()&consensus.CapArchival != 0 {
+			return p, nil
+		}
+	}
+
+	return nil, ErrNoArchivalPeer
+}
+
+// requestBlock requests block from peer and passes it to OnBlock, sync
+// gets back to idle if the peer doesn't respond
+func (m *SyncManager) requestBlock(ctx context.Context, peer SyncPeer, hash consensus.Hash) {
+	b, err := peer.SendBlockRequest(ctx, hash)
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Info("cannot sync block: ", err)
+
+		m.Lock()
+		if _, ok := m.pending[hash]; ok && m.state == SyncBlocks {
+			m.reset()
+		}
+		m.Unlock()
+		return
+	}
+
+	m.OnBlock(peer, b)
+}
+
+// OnBlock adds requested block to the chain, once all requested blocks are
+// received it requests next headers. Sync gets back to idle when the peer
+// has no more headers to serve.
+func (m *SyncManager) OnBlock(peer SyncPeer, b *consensus.Block) {
+	m.Lock()
+	defer m.Unlock()
+
+	hash := b.Header.Hash()
+	if _, ok := m.pending[hash]; !ok {
+		return
+	}
+	delete(m.pending, hash)
+	m.blocksDownloaded++
+
+	if _, ok := m.inFlight[hash]; ok {
+		delete(m.inFlight, hash)
+		m.requestQueued()
+	}
+
+	if m.chain.HasBlock(b.Header.Previous) {
+		m.connectBlock(b)
+	} else {
+		m.orphans.Add(b)
+	}
+
+	if m.state != SyncBlocks || len(m.pending) > 0 {
+		return
+	}
+
+	// headers are served in batches, ask for the next ones
+	if m.cancelBlocks != nil {
+		m.cancelBlocks()
+		m.cancelBlocks = nil
+	}
+	m.setState(SyncHeaders)
+	go m.requestHeaders(m.peer, m.chain.Locator())
+}
+
+// onReorg drops state built on the previous chain, must be called with
+// lock held
+func (m *SyncManager) onReorg() {
+	logger.Info("chain reorganized")
+	if m.blockCache != nil {
+		m.blockCache.Invalidate()
+	}
+}
+
+// connectBlock adds block to the chain followed by its orphan descendants,
+// must be called with lock held
+func (m *SyncManager) connectBlock(b *consensus.Block) {
+	queue := []*consensus.Block{b}
+	for len(queue) > 0 {
+		b, queue = queue[0], queue[1:]
+
+		head, _ := m.chain.Head()
+		if err := m.chain.AddBlock(b); err != nil {
+			logger.Warn("cannot add synced block: ", err)
+			continue
+		}
+
+		// block became head without extending the previous one
+		if newHead, _ := m.chain.Head(); newHead != head && b.Header.Previous != head {
+			m.onReorg()
+		}
+
+		queue = append(queue, m.orphans.TakeChildren(b.Header.Hash())...)
+	}
+}
@@ -0,0 +1,414 @@
+package p2p
+
+import (
+	"consensus"
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// forkChain keeps the heaviest of blocks added by height, ties keep the head
+type forkChain struct {
+	head   *consensus.Block
+	blocks map[consensus.Hash]*consensus.Block
+}
+
+func (c *forkChain) TotalDifficulty() consensus.Difficulty { return 0 }
+func (c *forkChain) NextDifficulty() consensus.Difficulty  { return 0 }
+func (c *forkChain) Locator() []consensus.Hash             { return nil }
+
+func (c *forkChain) Head() (consensus.Hash, uint64) {
+	return c.head.Header.Hash(), c.head.Header.Height
+}
+
+func (c *forkChain) HasBlock(hash consensus.Hash) bool {
+	_, ok := c.blocks[hash]
+	return ok
+}
+
+func (c *forkChain) Header(hash consensus.Hash) (*consensus.BlockHeader, bool) {
+	b, ok := c.blocks[hash]
+	if !ok {
+		return nil, false
+	}
+	return &b.Header, true
+}
+
+func (c *forkChain) DifficultyWindow(hash consensus.Hash) (*consensus.DifficultyWindow, bool) {
+	return nil, false
+}
+
+func (c *forkChain) AddBlock(b *consensus.Block) error {
+	c.blocks[b.Header.Hash()] = b
+	if b.Header.Height > c.head.Header.Height {
+		c.head = b
+	}
+	return nil
+}
+
+// countingSource counts blocks fetched from it
+type countingSource struct {
+	block   *consensus.Block
+	fetched int
+}
+
+func (s *countingSource) GetBlock(hash consensus.Hash) *consensus.Block {
+	s.fetched++
+	return s.block
+}
+
+func TestSyncReorgInvalidatesBlockCache(t *testing.T) {
+	genesis := &consensus.Block{}
+	chain := &forkChain{
+		head:   genesis,
+		blocks: map[consensus.Hash]*consensus.Block{genesis.Header.Hash(): genesis},
+	}
+
+	block := func(prev *consensus.Block, nonce uint64) *consensus.Block {
+		b := &consensus.Block{}
+		b.Header.Previous = prev.Header.Hash()
+		b.Header.Height = prev.Header.Height + 1
+		b.Header.Nonce = nonce
+		return b
+	}
+
+	a1 := block(genesis, 1)
+	b1 := block(genesis, 2)
+	b2 := block(b1, 2)
+
+	source := &countingSource{block: a1}
+	cache := NewBlockCache(source, 8)
+
+	m := NewSyncManager(chain)
+	m.SetBlockCache(cache)
+
+	m.connectBlock(a1)
+	cache.Get(a1.Header.Hash())
+
+	// fork block not becoming head keeps the cache
+	m.connectBlock(b1)
+	cache.Get(a1.Header.Hash())
+	if source.fetched != 1 {
+		t.Fatalf("block fetched %d times, want 1", source.fetched)
+	}
+
+	m.connectBlock(b2)
+	cache.Get(a1.Header.Hash())
+	if source.fetched != 2 {
+		t.Errorf("block fetched %d times after reorg, want 2", source.fetched)
+	}
+}
+
+// powParams are network params with Cuckoo graphs small enough to mine
+// headers in tests
+var powParams = func() consensus.NetworkParams {
+	params := consensus.TestnetParams
+	params.Sizeshift = 10
+	params.Easiness = 100
+	return params
+}()
+
+// mineHeader sets nonce and proof of work of h meeting its target
+func mineHeader(t *testing.T, h *consensus.BlockHeader, params consensus.NetworkParams) {
+	t.Helper()
+	for i := 0; i < 10000; i++ {
+		proof, ok := consensus.NewCuckoo(h.PrePowBytes(), params.Sizeshift).FindCycle(params.Easiness)
+		if ok {
+			h.Pow = proof
+			if consensus.ValidatePoW(h, params) == nil {
+				return
+			}
+		}
+		h.Nonce++
+	}
+	t.Fatal("cannot mine header")
+}
+
+// syncChain is a chain collecting synced blocks on top of genesis
+type syncChain struct {
+	difficulty consensus.Difficulty
+	genesis    consensus.BlockHeader
+	blocks     []*consensus.Block
+}
+
+func (c *syncChain) TotalDifficulty() consensus.Difficulty {
+	return c.difficulty
+}
+
+func (c *syncChain) Head() (consensus.Hash, uint64) {
+	return consensus.Hash{}, uint64(len(c.blocks))
+}
+
+func (c *syncChain) NextDifficulty() consensus.Difficulty {
+	return 1
+}
+
+func (c *syncChain) Locator() []consensus.Hash {
+	return nil
+}
+
+func (c *syncChain) HasBlock(hash consensus.Hash) bool {
+	return true
+}
+
+func (c *syncChain) Header(hash consensus.Hash) (*consensus.BlockHeader, bool) {
+	if hash != c.genesis.Hash() {
+		return nil, false
+	}
+	return &c.genesis, true
+}
+
+func (c *syncChain) DifficultyWindow(hash consensus.Hash) (*consensus.DifficultyWindow, bool) {
+	if hash != c.genesis.Hash() {
+		return nil, false
+	}
+	return consensus.NewDifficultyWindow(powParams), true
+}
+
+func (c *syncChain) AddBlock(b *consensus.Block) error {
+	c.blocks = append(c.blocks, b)
+	return nil
+}
+
+// syncPeer serves header batches in order and blocks, counting requests
+type syncPeer struct {
+	sync.Mutex
+
+	headerRequests int
+	blockRequests  int
+
+	batches chan []*consensus.BlockHeader
+	blocks  map[consensus.Hash]*consensus.Block
+}
+
+func (p *syncPeer) PeerCapabilities() consensus.Capabilities {
+	return consensus.CapFullNode
+}
+
+func (p *syncPeer) SendHeaderRequest(locator []consensus.Hash) ([]*consensus.BlockHeader, error) {
+	p.Lock()
+	p.headerRequests++
+	p.Unlock()
+
+	return <-p.batches, nil
+}
+
+func (p *syncPeer) SendBlockRequest(ctx context.Context, hash consensus.Hash) (*consensus.Block, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.blockRequests++
+	return p.blocks[hash], nil
+}
+
+// waitSyncState waits for m to get to state want
+func waitSyncState(t *testing.T, m *SyncManager, want SyncState) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for m.State() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("state %v, want %v", m.State(), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// mineBlocks mines n blocks on top of chain genesis served by peer, returns
+// their headers
+func mineBlocks(t *testing.T, chain *syncChain, peer *syncPeer, n int) []*consensus.BlockHeader {
+	t.Helper()
+	headers := make([]*consensus.BlockHeader, n)
+	prev := &chain.genesis
+	for i := range headers {
+		b := &consensus.Block{}
+		b.Header.Height = prev.Height + 1
+		b.Header.Previous = prev.Hash()
+		b.Header.Timestamp = prev.Timestamp + powParams.BlockTimeSec
+		b.Header.Bits = prev.Bits
+		mineHeader(t, &b.Header, powParams)
+
+		headers[i] = &b.Header
+		peer.blocks[b.Header.Hash()] = b
+		prev = &b.Header
+	}
+
+	return headers
+}
+
+func TestSyncCycle(t *testing.T) {
+	consensus.SetDefaultNetwork(&powParams)
+	t.Cleanup(func() { consensus.SetDefaultNetwork(&consensus.MainnetParams) })
+
+	chain := &syncChain{difficulty: 10, genesis: powParams.Genesis}
+	peer := &syncPeer{
+		batches: make(chan []*consensus.BlockHeader, 2),
+		blocks:  make(map[consensus.Hash]*consensus.Block),
+	}
+	m := NewSyncManager(chain)
+
+	m.OnPing(peer, &Ping{TotalDifficulty: 5})
+	if m.State() != SyncIdle {
+		t.Fatalf("sync started from peer with less work, state %v", m.State())
+	}
+
+	headers := mineBlocks(t, chain, peer, 3*maxBlocksInFlight)
+
+	// one batch of headers, then peer has no more to serve
+	peer.batches <- headers
+	peer.batches <- nil
+
+	m.OnPing(peer, &Ping{TotalDifficulty: 20})
+	waitSyncState(t, m, SyncIdle)
+
+	m.Lock()
+	added := len(chain.blocks)
+	m.Unlock()
+
+	if added != len(headers) {
+		t.Errorf("%d blocks added to the chain, want %d", added, len(headers))
+	}
+
+	peer.Lock()
+	defer peer.Unlock()
+
+	if peer.headerRequests != 2 {
+		t.Errorf("headers requested %d times, want 2", peer.headerRequests)
+	}
+
+	if peer.blockRequests != len(headers) {
+		t.Errorf("%d blocks requested, want %d", peer.blockRequests, len(headers))
+	}
+}
+
+// gatedPeer serves each block once a value is sent to gate
+type gatedPeer struct {
+	*syncPeer
+	gate chan struct{}
+}
+
+func (p *gatedPeer) SendBlockRequest(ctx context.Context, hash consensus.Hash) (*consensus.Block, error) {
+	select {
+	case <-p.gate:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return p.syncPeer.SendBlockRequest(ctx, hash)
+}
+
+func TestSyncProgressAdvances(t *testing.T) {
+	consensus.SetDefaultNetwork(&powParams)
+	t.Cleanup(func() { consensus.SetDefaultNetwork(&consensus.MainnetParams) })
+
+	chain := &syncChain{difficulty: 10, genesis: powParams.Genesis}
+	peer := &gatedPeer{
+		syncPeer: &syncPeer{
+			batches: make(chan []*consensus.BlockHeader, 2),
+			blocks:  make(map[consensus.Hash]*consensus.Block),
+		},
+		gate: make(chan struct{}),
+	}
+	m := NewSyncManager(chain)
+
+	const blocks = 6
+	headers := mineBlocks(t, chain, peer.syncPeer, blocks)
+	peer.batches <- headers
+	peer.batches <- nil
+
+	if p := m.Progress(); p.Percent != 100 {
+		t.Errorf("synced chain at %v%%, want 100%%", p.Percent)
+	}
+
+	m.OnPing(peer, &Ping{TotalDifficulty: 20, Height: blocks})
+	var prev float64
+	for i := 1; i <= blocks; i++ {
+		peer.gate <- struct{}{}
+		eventually(t, "block received", func() bool { return m.Progress().BlocksDownloaded == uint64(i) })
+
+		p := m.Progress()
+		if p.Percent <= prev {
+			t.Errorf("progress %v%% after %d blocks, not above %v%%", p.Percent, i, prev)
+		}
+		if p.TargetHeight != blocks || p.HeadersDownloaded != blocks {
+			t.Errorf("target height %d and %d headers downloaded, want %d", p.TargetHeight, p.HeadersDownloaded, blocks)
+		}
+		prev = p.Percent
+	}
+
+	if prev != 100 {
+		t.Errorf("progress %v%% once all blocks are received, want 100%%", prev)
+	}
+	waitSyncState(t, m, SyncIdle)
+}
+
+func TestFindForkPoint(t *testing.T) {
+	chain := newHeaderChain(10)
+	ours := func(heights ...int) []consensus.Hash {
+		var locator []consensus.Hash
+		for _, h := range heights {
+			locator = append(locator, chain[h].Hash())
+		}
+		return locator
+	}
+	// hashes of a fork we don't have
+	theirs := []consensus.Hash{{1}, {2}, {3}}
+
+	tests := []struct {
+		name    string
+		locator []consensus.Hash
+		height  uint64
+		ok      bool
+	}{
+		{"fully in our chain", ours(9, 8, 6, 2, 0), 9, true},
+		{"partly in our chain", append(theirs, ours(5, 1, 0)...), 5, true},
+		{"not in our chain", theirs, 0, false},
+		{"empty", nil, 0, false},
+	}
+	for _, tt := range tests {
+		height, ok := FindForkPoint(tt.locator, chain.BlockHeight)
+		if height != tt.height || ok != tt.ok {
+			t.Errorf("%s: fork point %d, %v, want %d, %v", tt.name, height, ok, tt.height, tt.ok)
+		}
+	}
+}
+
+// capPeer is a sync peer advertising caps
+type capPeer struct {
+	*syncPeer
+	caps consensus.Capabilities
+}
+
+func (p *capPeer) PeerCapabilities() consensus.Capabilities {
+	return p.caps
+}
+
+func TestOldBlockSkipsNonArchivalPeers(t *testing.T) {
+	light := &capPeer{syncPeer: new(syncPeer), caps: consensus.CapUtxoHist | consensus.CapPeerList}
+	otherLight := &capPeer{syncPeer: new(syncPeer), caps: consensus.CapUtxoHist}
+	archival := &capPeer{syncPeer: new(syncPeer), caps: consensus.CapArchival}
+
+	m := NewSyncManager(&syncChain{})
+	m.targetHeight = uint64(consensus.CutThroughHorizon) + 100
+	m.AddPeer(light)
+	m.AddPeer(otherLight)
+
+	m.Lock()
+	defer m.Unlock()
+
+	// recent block is requested from the sync peer
+	if p, err := m.blockPeer(light, 100); err != nil || p != light {
+		t.Errorf("block within horizon requested from %v, %v, want the sync peer", p, err)
+	}
+
+	if p, err := m.blockPeer(light, 99); err != ErrNoArchivalPeer {
+		t.Errorf("old block without archival peer requested from %v, %v, want %v", p, err, ErrNoArchivalPeer)
+	}
+
+	m.peers[archival] = struct{}{}
+	if p, err := m.blockPeer(light, 99); err != nil || p != archival {
+		t.Errorf("old block requested from %v, %v, want the archival peer", p, err)
+	}
+	if p, err := m.blockPeer(archival, 0); err != nil || p != archival {
+		t.Errorf("old block requested from %v, %v, want the archival sync peer", p, err)
+	}
+}
@@ -0,0 +1,185 @@
+package p2p
+
+import (
+	"bytes"
+	"consensus"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	// UTXOChunkSize number of outputs in a full UTXO set chunk
+	UTXOChunkSize = 1000
+	// maxUTXOChunks maximum number of chunks requested at once
+	maxUTXOChunks = 16
+	// maxUTXOProofHashes maximum number of hashes in chunk Merkle proof
+	maxUTXOProofHashes = 64
+)
+
+// GetUTXOSet asks for UTXO set snapshot in chunks of UTXOChunkSize
+// outputs, for fast sync. The peer replies with up to MaxChunks
+// UTXOSetChunk messages starting at output index StartIndex.
+type GetUTXOSet struct {
+	StartIndex uint64
+	MaxChunks  uint32
+}
+
+// Bytes implements Message interface
+func (m *GetUTXOSet) Bytes() []byte {
+	buff := new(bytes.Buffer)
+
+	if err := binary.Write(buff, binary.BigEndian, m.StartIndex); err != nil {
+		panic(err)
+	}
+
+	if err := binary.Write(buff, binary.BigEndian, m.MaxChunks); err != nil {
+		panic(err)
+	}
+
+	return buff.Bytes()
+}
+
+// Type implements Message interface
+func (m *GetUTXOSet) Type() uint8 {
+	return consensus.MsgTypeGetUTXOSet
+}
+
+// Read implements Message interface
+func (m *GetUTXOSet) Read(r io.Reader) error {
+
+	if err := binary.Read(r, binary.BigEndian, &m.StartIndex); err != nil {
+		return err
+	}
+
+	if err := binary.Read(r, binary.BigEndian, &m.MaxChunks); err != nil {
+		return err
+	}
+
+	if m.MaxChunks == 0 || m.MaxChunks > maxUTXOChunks {
+		return fmt.Errorf("invalid number of UTXO chunks: %d not in 1..%d", m.MaxChunks, maxUTXOChunks)
+	}
+
+	// requested range must not wrap around
+	if end := m.StartIndex + uint64(m.MaxChunks)*UTXOChunkSize; end < m.StartIndex {
+		return fmt.Errorf("UTXO range out of bounds: %d + %d chunks", m.StartIndex, m.MaxChunks)
+	}
+
+	return nil
+}
+
+// UTXOSetChunk is a range of UTXO set output commitments starting at
+// output index StartIndex, with Merkle mountain range proof of the range
+// against UTXORoot of the snapshot block header
+type UTXOSetChunk struct {
+	StartIndex uint64
+	Commits    []consensus.Commitment
+	// hashes of the Merkle mountain range proof
+	Proof []consensus.Hash
+}
+
+// Bytes implements Message interface, at most UTXOChunkSize of the first
+// commitments and maxUTXOProofHashes of the first proof hashes are written
+func (m *UTXOSetChunk) Bytes() []byte {
+	buff := new(bytes.Buffer)
+
+	// writing to bytes.Buffer never fails
+	m.WriteTo(buff)
+	return buff.Bytes()
+}
+
+// WriteTo implements io.WriterTo interface
+func (m *UTXOSetChunk) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+
+	commits := m.Commits
+	if len(commits) > UTXOChunkSize {
+		commits = commits[:UTXOChunkSize]
+	}
+
+	proof := m.Proof
+	if len(proof) > maxUTXOProofHashes {
+		proof = proof[:maxUTXOProofHashes]
+	}
+
+	if err := binary.Write(cw, binary.BigEndian, m.StartIndex); err != nil {
+		return int64(cw.n), err
+	}
+
+	if err := binary.Write(cw, binary.BigEndian, uint16(len(commits))); err != nil {
+		return int64(cw.n), err
+	}
+
+	for i := range commits {
+		if _, err := cw.Write(commits[i][:]); err != nil {
+			return int64(cw.n), err
+		}
+	}
+
+	if err := binary.Write(cw, binary.BigEndian, uint8(len(proof))); err != nil {
+		return int64(cw.n), err
+	}
+
+	for i := range proof {
+		if _, err := cw.Write(proof[i][:]); err != nil {
+			return int64(cw.n), err
+		}
+	}
+
+	return int64(cw.n), nil
+}
+
+// Type implements Message interface
+func (m *UTXOSetChunk) Type() uint8 {
+	return consensus.MsgTypeUTXOSetChunk
+}
+
+// Read implements Message interface
+func (m *UTXOSetChunk) Read(r io.Reader) error {
+
+	if err := binary.Read(r, binary.BigEndian, &m.StartIndex); err != nil {
+		return err
+	}
+
+	var commitsLen uint16
+	if err := binary.Read(r, binary.BigEndian, &commitsLen); err != nil {
+		return err
+	}
+
+	if commitsLen > UTXOChunkSize {
+		return fmt.Errorf("too many UTXO chunk outputs: %d > %d", commitsLen, UTXOChunkSize)
+	}
+
+	if m.StartIndex+uint64(commitsLen) < m.StartIndex {
+		return fmt.Errorf("UTXO range out of bounds: %d + %d", m.StartIndex, commitsLen)
+	}
+
+	m.Commits = make([]consensus.Commitment, commitsLen)
+	for i := range m.Commits {
+		if _, err := io.ReadFull(r, m.Commits[i][:]); err != nil {
+			return err
+		}
+
+		if !m.Commits[i].IsValid() {
+			return consensus.ErrInvalidCommitment
+		}
+	}
+
+	var proofLen uint8
+	if err := binary.Read(r, binary.BigEndian, &proofLen); err != nil {
+		return err
+	}
+
+	if proofLen > maxUTXOProofHashes {
+		return fmt.Errorf("too long UTXO chunk proof: %d > %d", proofLen, maxUTXOProofHashes)
+	}
+
+	m.Proof = make([]consensus.Hash, proofLen)
+	for i := range m.Proof {
+		if _, err := io.ReadFull(r, m.Proof[i][:]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,132 @@
+package p2p
+
+import (
+	"bytes"
+	"consensus"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"strings"
+	"testing"
+)
+
+// generatorCommit returns secp256k1 generator G compressed with prefix,
+// a valid commitment for each of 0x02, 0x03, 0x08 and 0x09
+func generatorCommit(t *testing.T, prefix byte) consensus.Commitment {
+	t.Helper()
+	x, err := hex.DecodeString("79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := consensus.Commitment{prefix}
+	copy(c[1:], x)
+	if !c.IsValid() {
+		t.Fatalf("commitment %x not valid", c)
+	}
+	return c
+}
+
+func TestUTXOSetChunkRoundTrip(t *testing.T) {
+	msg := &UTXOSetChunk{
+		StartIndex: 2000,
+		Commits: []consensus.Commitment{
+			generatorCommit(t, 0x02),
+			generatorCommit(t, 0x03),
+			generatorCommit(t, 0x08),
+			generatorCommit(t, 0x09),
+		},
+		Proof: []consensus.Hash{{1}, {2}},
+	}
+
+	var got UTXOSetChunk
+	r := bytes.NewReader(msg.Bytes())
+	if err := got.Read(r); err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Len() != 0 || got.StartIndex != msg.StartIndex || len(got.Commits) != len(msg.Commits) || len(got.Proof) != len(msg.Proof) {
+		t.Fatalf("UTXOSetChunk read as %+v with %d bytes left, want %+v", got, r.Len(), msg)
+	}
+	for i := range msg.Commits {
+		if got.Commits[i] != msg.Commits[i] {
+			t.Errorf("commitment %d read as %x, want %x", i, got.Commits[i], msg.Commits[i])
+		}
+	}
+	for i := range msg.Proof {
+		if got.Proof[i] != msg.Proof[i] {
+			t.Errorf("proof hash %d read as %x, want %x", i, got.Proof[i], msg.Proof[i])
+		}
+	}
+}
+
+func TestUTXOSetChunkCapped(t *testing.T) {
+	commits := make([]consensus.Commitment, UTXOChunkSize+1)
+	for i := range commits {
+		commits[i] = generatorCommit(t, 0x02)
+	}
+	msg := &UTXOSetChunk{Commits: commits, Proof: make([]consensus.Hash, maxUTXOProofHashes+1)}
+
+	var got UTXOSetChunk
+	if err := got.Read(bytes.NewReader(msg.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got.Commits) != UTXOChunkSize || len(got.Proof) != maxUTXOProofHashes {
+		t.Errorf("UTXOSetChunk carries %d commitments and %d proof hashes, want %d and %d",
+			len(got.Commits), len(got.Proof), UTXOChunkSize, maxUTXOProofHashes)
+	}
+}
+
+func TestUTXOSetChunkRejected(t *testing.T) {
+	overflow := (&UTXOSetChunk{StartIndex: math.MaxUint64, Commits: []consensus.Commitment{generatorCommit(t, 0x02)}}).Bytes()
+	invalid := (&UTXOSetChunk{Commits: make([]consensus.Commitment, 1)}).Bytes()
+
+	for name, data := range map[string][]byte{
+		"range overflow":     overflow,
+		"invalid commitment": invalid,
+	} {
+		if err := new(UTXOSetChunk).Read(bytes.NewReader(data)); err == nil {
+			t.Errorf("%s: UTXOSetChunk read without error", name)
+		}
+	}
+}
+
+func TestGetUTXOSetBounds(t *testing.T) {
+	valid := []GetUTXOSet{
+		{StartIndex: 0, MaxChunks: 1},
+		{StartIndex: 5000, MaxChunks: maxUTXOChunks},
+		{StartIndex: math.MaxUint64 - maxUTXOChunks*UTXOChunkSize, MaxChunks: maxUTXOChunks},
+	}
+	for _, msg := range valid {
+		var got GetUTXOSet
+		if err := got.Read(bytes.NewReader(msg.Bytes())); err != nil {
+			t.Errorf("%+v: %v", msg, err)
+		} else if got != msg {
+			t.Errorf("GetUTXOSet read as %+v, want %+v", got, msg)
+		}
+	}
+
+	invalid := []struct {
+		msg  GetUTXOSet
+		want string
+	}{
+		{GetUTXOSet{MaxChunks: 0}, "invalid number of UTXO chunks"},
+		{GetUTXOSet{MaxChunks: maxUTXOChunks + 1}, "invalid number of UTXO chunks"},
+		{GetUTXOSet{StartIndex: math.MaxUint64 - UTXOChunkSize + 1, MaxChunks: 1}, "out of bounds"},
+		{GetUTXOSet{StartIndex: math.MaxUint64, MaxChunks: maxUTXOChunks}, "out of bounds"},
+	}
+	for _, v := range invalid {
+		err := new(GetUTXOSet).Read(bytes.NewReader(v.msg.Bytes()))
+		if err == nil || !strings.Contains(err.Error(), v.want) {
+			t.Errorf("%+v: got %v, want %s error", v.msg, err, v.want)
+		}
+	}
+
+	// GetUTXOSet body is StartIndex then MaxChunks, a truncated body fails
+	data := make([]byte, 10)
+	binary.BigEndian.PutUint64(data, 1)
+	if err := new(GetUTXOSet).Read(bytes.NewReader(data)); err == nil {
+		t.Error("truncated GetUTXOSet read without error")
+	}
+}